@@ -3,21 +3,40 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"snap-ci/config"
 	"snap-ci/git"
+	"snap-ci/hook"
 	"snap-ci/pipeline"
+	"snap-ci/queue"
+	"snap-ci/schedule"
+	"snap-ci/secrets"
 	"snap-ci/storage"
+	"snap-ci/tokens"
+	"snap-ci/types"
+	"snap-ci/users"
+	"snap-ci/watch"
 	"snap-ci/web"
+	"snap-ci/workspace"
 
 	"github.com/urfave/cli/v2" // Or Cobra
+	"gopkg.in/yaml.v3"
 )
 
 const (
@@ -25,6 +44,24 @@ const (
 	ngrokAPIPort        = 4040
 )
 
+// userNameFlag names the user the `user` subcommands act on.
+var userNameFlag = &cli.StringFlag{Name: "username", Aliases: []string{"u"}, Usage: "Name of the user", Required: true}
+
+// workersFlag sets how many queued runs are executed concurrently.
+var workersFlag = &cli.IntFlag{
+	Name:    "workers",
+	Usage:   "Number of pipeline runs executed concurrently",
+	Value:   queue.DefaultWorkers,
+	EnvVars: []string{"SNAPCI_WORKERS"},
+}
+
+// secretRepoFlag selects the repository whose secrets are managed.
+var secretRepoFlag = &cli.StringFlag{
+	Name:     "repo",
+	Usage:    "Repository the secret belongs to: 'owner/repo-name' on GitHub, or 'host/path' on GitLab and Gitea",
+	Required: true,
+}
+
 func ensureNgrokInstalled() error {
 	_, err := exec.LookPath("ngrok")
 	if err != nil {
@@ -81,12 +118,127 @@ func main() {
 		Name:    "snapci",
 		Usage:   "A lightweight CI/CD pipeline tool",
 		Version: "0.1.0",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "workspace-root",
+				Usage:   "Directory in which each run gets its own workspace",
+				Value:   workspace.DefaultRoot,
+				EnvVars: []string{"SNAPCI_WORKSPACE_ROOT"},
+			},
+			&cli.StringFlag{
+				Name:    "workspace-cleanup",
+				Usage:   "When to delete a run's workspace: 'on-success' (keep failed runs), 'always' or 'never'",
+				Value:   workspace.CleanupOnSuccess,
+				EnvVars: []string{"SNAPCI_WORKSPACE_CLEANUP"},
+			},
+			&cli.IntFlag{
+				Name:    "keep-workspaces",
+				Usage:   "Keep at most N finished workspaces on disk (0 = no limit)",
+				EnvVars: []string{"SNAPCI_KEEP_WORKSPACES"},
+			},
+			&cli.IntFlag{
+				Name:    "default-timeout",
+				Usage:   "Timeout in minutes for jobs that don't set timeout-minutes (0 = no limit)",
+				Value:   int(pipeline.DefaultJobTimeout / time.Minute),
+				EnvVars: []string{"SNAPCI_DEFAULT_TIMEOUT"},
+			},
+			&cli.IntFlag{
+				Name:    "default-step-timeout",
+				Usage:   "Timeout in minutes for steps that don't set timeout-minutes (0 = bounded by the job's timeout only)",
+				EnvVars: []string{"SNAPCI_DEFAULT_STEP_TIMEOUT"},
+			},
+			&cli.StringFlag{
+				Name:    "storage",
+				Usage:   "Storage backend for runs, logs and auth data: 'json' or 'sqlite'",
+				Value:   storage.BackendJSON,
+				EnvVars: []string{"SNAPCI_STORAGE"},
+			},
+			&cli.StringFlag{
+				Name:    "storage-path",
+				Usage:   "Root directory of the json backend, or database file of the sqlite backend (default \"" + storage.DefaultSQLitePath + "\")",
+				EnvVars: []string{"SNAPCI_STORAGE_PATH"},
+			},
+			&cli.StringFlag{
+				Name:    "users-file",
+				Usage:   "File holding the web dashboard users and their password hashes",
+				Value:   users.DefaultFile,
+				EnvVars: []string{"SNAPCI_USERS_FILE"},
+			},
+			&cli.StringFlag{
+				Name:    "api-tokens-file",
+				Usage:   "File holding the hashes of the API tokens",
+				Value:   tokens.DefaultFile,
+				EnvVars: []string{"SNAPCI_API_TOKENS_FILE"},
+			},
+			&cli.StringFlag{
+				Name:    "schedules-file",
+				Usage:   "File holding the schedules from on.schedule and when each last ran",
+				Value:   schedule.DefaultFile,
+				EnvVars: []string{"SNAPCI_SCHEDULES_FILE"},
+			},
+			&cli.StringFlag{
+				Name:    "watches-file",
+				Usage:   "File holding the repositories polled by `snapci watch start` and their last-seen branch heads",
+				Value:   watch.DefaultFile,
+				EnvVars: []string{"SNAPCI_WATCHES_FILE"},
+			},
+			&cli.StringFlag{
+				Name:    "hooks-file",
+				Usage:   "File holding the bare repositories with a post-receive hook installed by `snapci hook install`",
+				Value:   hook.DefaultFile,
+				EnvVars: []string{"SNAPCI_HOOKS_FILE"},
+			},
+			&cli.StringFlag{
+				Name:    "hook-socket",
+				Usage:   "Unix socket on which `snapci webhooks` and `snapci watch start` accept pushes from post-receive hooks",
+				Value:   git.DefaultHookSocket,
+				EnvVars: []string{"SNAPCI_HOOK_SOCKET"},
+			},
+			&cli.StringFlag{
+				Name:    "github-api-url",
+				Usage:   "Base URL of the GitHub REST API, for webhook setup and commit statuses",
+				Value:   git.DefaultGitHubAPIURL,
+				EnvVars: []string{"SNAPCI_GITHUB_API_URL"},
+			},
+			&cli.StringFlag{
+				Name:    "dashboard-url",
+				Usage:   "Public URL of the web dashboard, linked from commit statuses",
+				Value:   git.DefaultDashboardURL,
+				EnvVars: []string{"SNAPCI_DASHBOARD_URL"},
+			},
+			&cli.StringFlag{
+				Name:    "secrets-key-file",
+				Usage:   "File holding the master key that encrypts secrets (ignored when " + secrets.MasterKeyEnv + " is set)",
+				Value:   secrets.DefaultKeyFile,
+				EnvVars: []string{"SNAPCI_MASTER_KEY_FILE"},
+			},
+		},
+		Before: func(c *cli.Context) error {
+			pipeline.DefaultJobTimeout = time.Duration(c.Int("default-timeout")) * time.Minute
+			pipeline.DefaultStepTimeout = time.Duration(c.Int("default-step-timeout")) * time.Minute
+			secrets.Configure(c.String("secrets-key-file"))
+			tokens.File.Configure(c.String("api-tokens-file"))
+			users.File.Configure(c.String("users-file"))
+			schedule.File.Configure(c.String("schedules-file"))
+			watch.File.Configure(c.String("watches-file"))
+			hook.File.Configure(c.String("hooks-file"))
+			git.ConfigureHookSocket(c.String("hook-socket"))
+			git.ConfigureGitHub(c.String("github-api-url"), c.String("dashboard-url"))
+			if err := storage.Configure(c.String("storage"), c.String("storage-path")); err != nil {
+				return err
+			}
+			return workspace.Configure(c.String("workspace-root"), workspace.Policy{
+				Cleanup:  c.String("workspace-cleanup"),
+				KeepLast: c.Int("keep-workspaces"),
+			})
+		},
 		Commands: []*cli.Command{
 			{
 				Name:  "run",
 				Usage: "Trigger a pipeline run (for testing)",
 				Flags: []cli.Flag{
 					&cli.StringFlag{Name: "config", Value: ".ci.yaml", Usage: "Path to .ci.yaml"},
+					&cli.StringFlag{Name: "repo", Usage: "Repository whose secrets are available to the run (optional)"},
 				},
 				Action: func(c *cli.Context) error {
 					cfgPath := c.String("config")
@@ -94,28 +246,89 @@ func main() {
 					if err != nil {
 						return err
 					}
+					var repoSecrets map[string]string
+					if repo := c.String("repo"); repo != "" {
+						if repoSecrets, err = secrets.Load(repo); err != nil {
+							return fmt.Errorf("failed to load secrets: %w", err)
+						}
+					}
 
 					//  Normally, this would be triggered by a webhook
 					//  For testing, we trigger it manually
-					jobResults, err := pipeline.ExecutePipeline(*cfg)
-					if err != nil {
+					repoName := c.String("repo")
+					if repoName == "" {
+						repoName = "manual-run/repo" // Placeholder
+					}
+					run := &types.PipelineRun{
+						ID:           storage.NewRunID(),
+						RepoName:     repoName,
+						Branch:       "manual-branch",           // Placeholder
+						CommitSHA:    "manual-sha",              // Placeholder
+						CommitMsg:    "Manual pipeline trigger", // Placeholder
+						CommitAuthor: "manual-user",             // Placeholder
+						TriggeredBy:  "cli-user",
+						TriggerType:  "cli",
+						Status:       types.RunRunning,
+						StartTime:    time.Now(),
+					}
+					if err := storage.StoreRun(cfg, run); err != nil {
 						return err
 					}
+					// Once recorded, a run that cannot be executed is recorded as failed rather than left running
+					fail := func(reason error) error {
+						run.Status = types.RunFailure
+						run.Error = reason.Error()
+						run.EndTime = time.Now()
+						if err := storage.StoreRun(cfg, run); err != nil {
+							log.Printf("Error storing failed run %s: %v", run.ID, err)
+						}
+						return reason
+					}
+					runLog, err := storage.OpenRunLog(run.ID)
+					if err != nil {
+						return fail(err)
+					}
+					defer runLog.Close()
+
+					// A local run builds the working tree it is started from, not a checkout
+					workDir, err := filepath.Abs(filepath.Dir(cfgPath))
+					if err != nil {
+						return fail(fmt.Errorf("failed to resolve the directory of %s: %w", cfgPath, err))
+					}
+					// Steps run in their own process groups, so Ctrl+C has to cancel them explicitly
+					ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+					defer stop()
+					defer storage.ClearCancelRequest(run.ID)
+					jobResults, request, err := git.ExecuteRun(ctx, cfg, pipeline.Options{
+						WorkDir: workDir,
+						Output:  io.MultiWriter(os.Stdout, runLog), // Show step output live in the terminal
+						Run:     run,
+						Secrets: repoSecrets,
+					})
+					if err != nil && request == nil && ctx.Err() == nil {
+						return fail(fmt.Errorf("pipeline execution failed: %w", err))
+					}
 
 					//  Store results and display in CLI
-					// FIX: Provide placeholder values for the new arguments required by storage.StoreRun
-					if err := storage.StoreRun(
-						cfg,
-						jobResults,
-						"manual-run/repo",         // Placeholder
-						"manual-branch",           // Placeholder
-						"manual-sha",              // Placeholder
-						"Manual pipeline trigger", // Placeholder
-						"manual-user",             // Placeholder
-						"cli-user",                // Placeholder
-					); err != nil {
+					run.Results = jobResults
+					run.EndTime = time.Now()
+					run.Status = types.RunFailure
+					if pipeline.Succeeded(jobResults) {
+						run.Status = types.RunSuccess
+					}
+					if request != nil { // Cancelled with `snapci cancel`, the dashboard or the API
+						run.Status = types.RunCancelled
+						run.CancelledBy = request.RequestedBy
+						run.CancelledAt = request.RequestedAt
+					} else if ctx.Err() != nil { // Interrupted with Ctrl+C
+						run.Status = types.RunCancelled
+						run.CancelledBy = run.TriggeredBy
+						run.CancelledAt = run.EndTime
+					}
+					if err := storage.StoreRun(cfg, run); err != nil {
 						return err
 					}
+					fmt.Printf("Run %s finished with status: %s\n", run.ID, run.Status)
 					storage.DisplayRunResults(jobResults)
 
 					return nil
@@ -124,15 +337,15 @@ func main() {
 			{
 				Name:  "webhooks",
 				Usage: "Start the webhook listener",
+				Flags: []cli.Flag{workersFlag},
 				Action: func(c *cli.Context) error {
 					//  Start the webhook listener
-					git.StartWebhookListener()
-					return nil
+					return git.StartWebhookListener(c.Int("workers"))
 				},
 			},
 			{
 				Name:  "webhook",
-				Usage: "Manage GitHub webhooks for automatic registration",
+				Usage: "Manage webhooks: register GitHub webhooks, or get the secret for GitLab and Gitea webhooks",
 				Subcommands: []*cli.Command{
 					{
 						Name:  "setup",
@@ -164,6 +377,21 @@ func main() {
 							return nil
 						},
 					},
+					{
+						Name:  "secret",
+						Usage: "Print the webhook secret of a repository, generating one if needed, to configure a GitLab or Gitea webhook by hand",
+						Flags: []cli.Flag{
+							&cli.StringFlag{Name: "repo", Required: true, Usage: "Repository as 'owner/repo-name' on GitHub, or as 'host/path' on GitLab and Gitea"},
+						},
+						Action: func(c *cli.Context) error {
+							secret, err := git.WebhookSecretFor(c.String("repo"))
+							if err != nil {
+								return err
+							}
+							fmt.Println(secret)
+							return nil
+						},
+					},
 					// Add other webhook management subcommands if needed (e.g., "delete", "list")
 				},
 			},
@@ -172,35 +400,124 @@ func main() {
 				Usage: "View logs for a run",
 				Flags: []cli.Flag{
 					&cli.StringFlag{Name: "id", Usage: "Id of the run view logs for"},
+					&cli.BoolFlag{Name: "follow", Aliases: []string{"f"}, Usage: "Stream the log of a queued or running run until it finishes"},
 				},
 				Action: func(c *cli.Context) error {
 					runID := c.String("id")
 					if runID == "" {
 						return cli.Exit("Please provide a run ID using the --id flag", 1)
 					}
+					if c.Bool("follow") {
+						return followRunLogs(runID)
+					}
 					if err := displayRunLogs(runID); err != nil {
 						return err
 					}
 					return nil //  Implement log viewing logic here
 				},
 			},
+			{
+				Name:  "cancel",
+				Usage: "Cancel a queued or running run",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "id", Usage: "Id of the run to cancel"},
+					&cli.StringFlag{Name: "by", Usage: "Name recorded as the one who cancelled the run (defaults to $USER)"},
+				},
+				Action: func(c *cli.Context) error {
+					runID := c.String("id")
+					if runID == "" {
+						return cli.Exit("Please provide a run ID using the --id flag", 1)
+					}
+					requestedBy := c.String("by")
+					if requestedBy == "" {
+						requestedBy = os.Getenv("USER")
+					}
+					if requestedBy == "" {
+						requestedBy = "cli-user"
+					}
+					if err := storage.RequestCancel(runID, requestedBy); err != nil {
+						return err
+					}
+					fmt.Printf("Cancellation of run %s requested; its worker will stop it shortly.\n", runID)
+					return nil
+				},
+			},
 			{
 				Name:  "status",
 				Usage: "View the status of recent or specific runs",
+				Description: "Without --id, lists the most recent runs matching the filters. With --id, shows the\n" +
+					"run with the timing of each job and step, and exits with status 1 if the run failed\n" +
+					"or was cancelled. Runs skipped by their `on:` triggers count as not failed.",
 				Flags: []cli.Flag{
-					&cli.StringFlag{Name: "id", Usage: "Id of the run to view status for"},
-					&cli.BoolFlag{Name: "recent", Usage: "View the status of recent runs"},
+					&cli.StringFlag{Name: "id", Usage: "Id of the run to view status and step timings for"},
+					&cli.BoolFlag{Name: "recent", Usage: "View the status of recent runs (the default without --id)"},
+					&cli.IntFlag{Name: "limit", Value: 20, Usage: "Maximum number of runs to list, 0 for all"},
+					&cli.StringFlag{Name: "repo", Usage: "Only runs of this repository (owner/repo-name)"},
+					&cli.StringFlag{Name: "branch", Usage: "Only runs of this branch"},
+					&cli.StringFlag{Name: "status", Usage: "Only runs with this status: pending, running, success, failure, cancelled or skipped"},
+					&cli.StringFlag{Name: "trigger", Usage: "Only runs with this trigger type, e.g. webhook, manual or cli"},
+					&cli.StringFlag{Name: "since", Usage: "Only runs started since this time: a duration ago (e.g. 2h, 7d), a date or an RFC 3339 time"},
+					&cli.StringFlag{Name: "until", Usage: "Only runs started before this time, in the same formats as --since"},
+					&cli.StringFlag{Name: "output", Aliases: []string{"o"}, Value: "table", Usage: "Output format: table, json or yaml"},
 				},
 				Action: func(c *cli.Context) error {
-					//  Implement status viewing logic here
-					fmt.Println("Status command not yet implemented")
-					return nil
+					format := c.String("output")
+					if format != "table" && format != "json" && format != "yaml" {
+						return cli.Exit(fmt.Sprintf("Unknown output format '%s', use table, json or yaml", format), 2)
+					}
+
+					if runID := c.String("id"); runID != "" {
+						run, err := storage.GetRun(runID)
+						if err != nil {
+							return err
+						}
+						if format == "table" {
+							displayRunTiming(run)
+						} else if err := printStructured(format, run); err != nil {
+							return err
+						}
+						if run.Finished() && run.Status != types.RunSuccess && run.Status != types.RunSkipped {
+							return cli.Exit("", 1) // Lets scripts gate on the run's outcome
+						}
+						return nil
+					}
+
+					filter := storage.RunFilter{
+						RepoName:    c.String("repo"),
+						Branch:      c.String("branch"),
+						Status:      strings.ToLower(c.String("status")),
+						TriggerType: c.String("trigger"),
+						Limit:       c.Int("limit"),
+					}
+					now := time.Now()
+					var err error
+					if filter.Since, err = parseTimeFlag(c.String("since"), now); err != nil {
+						return cli.Exit(fmt.Sprintf("Invalid --since: %v", err), 2)
+					}
+					if filter.Until, err = parseTimeFlag(c.String("until"), now); err != nil {
+						return cli.Exit(fmt.Sprintf("Invalid --until: %v", err), 2)
+					}
+
+					runs, err := storage.ListRuns(filter)
+					if err != nil {
+						return err
+					}
+					if format != "table" {
+						return printStructured(format, runs)
+					}
+					if len(runs) == 0 {
+						fmt.Println("No runs found.")
+						return nil
+					}
+					return displayRunList(runs)
 				},
 			},
 			{
 				Name:  "web",
 				Usage: "Start the web UI",
+				Flags: []cli.Flag{workersFlag},
 				Action: func(c *cli.Context) error {
+					git.StartRunQueue(c.Int("workers")) // Executes runs triggered through the API
 					web.StartWebServer()
 					return nil
 				},
@@ -211,16 +528,21 @@ func main() {
 				Subcommands: []*cli.Command{
 					{
 						Name:  "add",
-						Usage: "Add Github Personal Access Token (PAT) for a private repository",
+						Usage: "Add the access token of a private repository on GitHub, GitLab or Gitea",
 						Flags: []cli.Flag{
 							&cli.StringFlag{
 								Name:     "repo",
-								Usage:    "GitHub repository in the format 'owner/repo-name' (e.g., 'myorg/myproject')",
+								Usage:    "Repository as 'owner/repo-name' on GitHub, or as 'host/path' on GitLab and Gitea (e.g., 'gitlab.example.com/group/project')",
 								Required: true,
 							},
+							&cli.StringFlag{
+								Name:  "provider",
+								Usage: "Where the repository is hosted: github, gitlab or gitea (also for Forgejo)",
+								Value: types.ProviderGitHub,
+							},
 							&cli.StringFlag{
 								Name:     "token",
-								Usage:    "GitHub Personal Access Token with 'repo:hooks' scope",
+								Usage:    "Access token: a GitHub PAT, a GitLab personal or project access token, or a Gitea access token",
 								Required: true,
 								EnvVars:  []string{"GITHUB_TOKEN"}, // Allow token from env var
 							},
@@ -229,10 +551,10 @@ func main() {
 							repo := c.String("repo")
 							token := c.String("token")
 							if token == "" {
-								return cli.Exit("Github PAT is required. Use --token flag or set GITHUB_TOKEN env var", 1)
+								return cli.Exit("An access token is required. Use --token flag or set GITHUB_TOKEN env var", 1)
 							}
 							log.Printf("Storing Authentication data for %s...", repo)
-							if err := storage.StoreRepoAuth(repo, token); err != nil {
+							if err := storage.StoreRepoAuth(repo, c.String("provider"), token); err != nil {
 								return fmt.Errorf("failed to store authentication data: %w", err)
 							}
 							log.Printf("Authentication for %s successfully stored. Use this repo in git clone operations", repo)
@@ -241,6 +563,485 @@ func main() {
 					},
 				},
 			},
+			{
+				Name:  "secret",
+				Usage: "Manage encrypted secrets available to a repository's pipelines as ${{ secrets.NAME }}",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "set",
+						Usage: "Create or update a secret (the value is read from stdin when --value is not given)",
+						Flags: []cli.Flag{
+							secretRepoFlag,
+							&cli.StringFlag{Name: "name", Usage: "Name of the secret, e.g. DEPLOY_KEY", Required: true},
+							&cli.StringFlag{Name: "value", Usage: "Value of the secret"},
+						},
+						Action: func(c *cli.Context) error {
+							value := c.String("value")
+							if !c.IsSet("value") {
+								data, err := io.ReadAll(os.Stdin)
+								if err != nil {
+									return fmt.Errorf("failed to read secret value from stdin: %w", err)
+								}
+								value = strings.TrimSuffix(string(data), "\n")
+							}
+							if err := secrets.Set(c.String("repo"), c.String("name"), value); err != nil {
+								return fmt.Errorf("failed to store secret: %w", err)
+							}
+							log.Printf("Secret %s stored for %s.", c.String("name"), c.String("repo"))
+							return nil
+						},
+					},
+					{
+						Name:  "list",
+						Usage: "List the names of a repository's secrets",
+						Flags: []cli.Flag{secretRepoFlag},
+						Action: func(c *cli.Context) error {
+							infos, err := secrets.List(c.String("repo"))
+							if err != nil {
+								return err
+							}
+							if len(infos) == 0 {
+								fmt.Printf("No secrets stored for %s.\n", c.String("repo"))
+								return nil
+							}
+							for _, info := range infos {
+								fmt.Printf("%-30s updated %s\n", info.Name, info.UpdatedAt.Format("2006-01-02 15:04:05"))
+							}
+							return nil
+						},
+					},
+					{
+						Name:  "rm",
+						Usage: "Remove a secret",
+						Flags: []cli.Flag{
+							secretRepoFlag,
+							&cli.StringFlag{Name: "name", Usage: "Name of the secret", Required: true},
+						},
+						Action: func(c *cli.Context) error {
+							if err := secrets.Remove(c.String("repo"), c.String("name")); err != nil {
+								return err
+							}
+							log.Printf("Secret %s removed from %s.", c.String("name"), c.String("repo"))
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "user",
+				Usage: "Manage web dashboard users and their roles (viewer, operator, admin)",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "add",
+						Usage: "Create a user (the password is read from stdin when --password is not given)",
+						Flags: []cli.Flag{
+							userNameFlag,
+							&cli.StringFlag{Name: "role", Value: users.RoleViewer, Usage: "viewer (read runs), operator (also trigger, rerun and cancel) or admin (also auth, webhooks and secrets)"},
+							&cli.StringFlag{Name: "password", Usage: "Password (prefer stdin, which keeps it out of the shell history)"},
+						},
+						Action: func(c *cli.Context) error {
+							password, err := passwordArg(c)
+							if err != nil {
+								return err
+							}
+							if err := users.Add(c.String("username"), password, c.String("role")); err != nil {
+								return err
+							}
+							fmt.Printf("User %s added with role %s.\n", c.String("username"), c.String("role"))
+							return nil
+						},
+					},
+					{
+						Name:  "rm",
+						Usage: "Remove a user; their sessions end immediately",
+						Flags: []cli.Flag{userNameFlag},
+						Action: func(c *cli.Context) error {
+							if err := users.Remove(c.String("username")); err != nil {
+								return err
+							}
+							fmt.Printf("User %s removed.\n", c.String("username"))
+							return nil
+						},
+					},
+					{
+						Name:  "passwd",
+						Usage: "Change the password of a user (read from stdin when --password is not given)",
+						Flags: []cli.Flag{
+							userNameFlag,
+							&cli.StringFlag{Name: "password", Usage: "New password (prefer stdin, which keeps it out of the shell history)"},
+						},
+						Action: func(c *cli.Context) error {
+							password, err := passwordArg(c)
+							if err != nil {
+								return err
+							}
+							if err := users.SetPassword(c.String("username"), password); err != nil {
+								return err
+							}
+							fmt.Printf("Password of %s changed.\n", c.String("username"))
+							return nil
+						},
+					},
+					{
+						Name:  "list",
+						Usage: "List users and their roles",
+						Action: func(c *cli.Context) error {
+							all, err := users.List()
+							if err != nil {
+								return err
+							}
+							if len(all) == 0 {
+								fmt.Println("No users.")
+								return nil
+							}
+							for _, user := range all {
+								fmt.Printf("%-30s %-10s created %s\n", user.Username, user.Role, user.CreatedAt.Format("2006-01-02 15:04:05"))
+							}
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "schedule",
+				Usage: "Inspect the schedules from `on.schedule`, which `snapci webhooks` and `snapci watch start` run",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "list",
+						Usage: "List schedules with their last and next run",
+						Action: func(c *cli.Context) error {
+							entries, err := schedule.List()
+							if err != nil {
+								return err
+							}
+							if len(entries) == 0 {
+								fmt.Println("No schedules. They are taken from on.schedule in .ci.yaml when a run builds the default branch.")
+								return nil
+							}
+							w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+							fmt.Fprintln(w, "REPO\tBRANCH\tCRON\tTIMEZONE\tLAST RUN\tNEXT RUN")
+							for _, e := range entries {
+								last, next := "-", "-"
+								if loc, err := time.LoadLocation(e.Timezone); err == nil && !e.LastFire.IsZero() {
+									last = e.LastFire.In(loc).Format("2006-01-02 15:04 MST")
+								}
+								if t, err := e.Next(); err != nil {
+									next = "invalid: " + err.Error()
+								} else if !t.IsZero() {
+									next = t.Format("2006-01-02 15:04 MST")
+								}
+								timezone := e.Timezone
+								if timezone == "" {
+									timezone = "UTC"
+								}
+								fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", e.RepoName, e.Branch, e.Cron, timezone, last, next)
+							}
+							return w.Flush()
+						},
+					},
+				},
+			},
+			{
+				Name:  "watch",
+				Usage: "Poll repositories that cannot send webhooks and run their pipelines when a branch moves",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "add",
+						Usage: "Watch a repository, or change the URL or branches of a watched one",
+						Flags: []cli.Flag{
+							&cli.StringFlag{Name: "repo", Required: true, Usage: "Name of the repository, e.g. 'owner/repo-name'; its stored token and secrets are looked up by this name"},
+							&cli.StringFlag{Name: "url", Required: true, Usage: "Any URL git can fetch from, e.g. https://git.example.com/team/app.git or file:///srv/git/app.git"},
+							&cli.StringSliceFlag{Name: "branch", Usage: "Branch to watch; a glob such as 'release/*' and repeatable (default: the repository's default branch)"},
+						},
+						Action: func(c *cli.Context) error {
+							if err := watch.Add(c.String("repo"), c.String("url"), c.StringSlice("branch")); err != nil {
+								return err
+							}
+							fmt.Printf("Watching %s. Runs start when a watched branch moves after the first poll.\n", c.String("repo"))
+							return nil
+						},
+					},
+					{
+						Name:  "rm",
+						Usage: "Stop watching a repository",
+						Flags: []cli.Flag{
+							&cli.StringFlag{Name: "repo", Required: true, Usage: "Name of the repository"},
+						},
+						Action: func(c *cli.Context) error {
+							if err := watch.Remove(c.String("repo")); err != nil {
+								return err
+							}
+							fmt.Printf("Stopped watching %s.\n", c.String("repo"))
+							return nil
+						},
+					},
+					{
+						Name:  "list",
+						Usage: "List watched repositories with their last-seen branch heads",
+						Action: func(c *cli.Context) error {
+							repos, err := watch.List()
+							if err != nil {
+								return err
+							}
+							if len(repos) == 0 {
+								fmt.Println("No watched repositories. Add one with `snapci watch add`.")
+								return nil
+							}
+							w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+							fmt.Fprintln(w, "REPO\tURL\tBRANCHES\tLAST POLL\tHEADS")
+							for _, repo := range repos {
+								branches := strings.Join(repo.Branches, ",")
+								if branches == "" {
+									branches = "(default)"
+								}
+								lastPoll := "never"
+								if !repo.Polled.IsZero() {
+									lastPoll = repo.Polled.Format("2006-01-02 15:04:05")
+								}
+								var heads []string
+								for branch, sha := range repo.Heads {
+									if len(sha) > 7 {
+										sha = sha[:7]
+									}
+									heads = append(heads, branch+"@"+sha)
+								}
+								sort.Strings(heads)
+								fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", repo.Name, repo.URL, branches, lastPoll, strings.Join(heads, " "))
+							}
+							return w.Flush()
+						},
+					},
+					{
+						Name:  "start",
+						Usage: "Poll the watched repositories and execute the runs they trigger, along with due schedules",
+						Flags: []cli.Flag{
+							workersFlag,
+							&cli.DurationFlag{
+								Name:    "interval",
+								Usage:   "Time between polls of the watched repositories",
+								Value:   git.DefaultPollInterval,
+								EnvVars: []string{"SNAPCI_POLL_INTERVAL"},
+							},
+						},
+						Action: func(c *cli.Context) error {
+							return git.StartWatcher(c.Int("workers"), c.Duration("interval"))
+						},
+					},
+				},
+			},
+			{
+				Name:  "hook",
+				Usage: "Build pushes to local bare repositories with a git post-receive hook",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "install",
+						Usage: "Install a post-receive hook in a bare repository (run it with the same global flags and from the same directory as the server)",
+						Flags: []cli.Flag{
+							&cli.StringFlag{Name: "repo", Required: true, Usage: "Path of the bare repository, e.g. /srv/git/app.git"},
+							&cli.StringFlag{Name: "name", Usage: "Name of the repository for runs, tokens and secrets (default: the directory name without .git)"},
+							&cli.BoolFlag{Name: "inline", Usage: "Build in the hook itself, showing the output to the pusher, instead of handing pushes to a running server"},
+							&cli.BoolFlag{Name: "force", Usage: "Replace a post-receive hook that snapci did not write"},
+						},
+						Action: func(c *cli.Context) error {
+							executable, err := os.Executable()
+							if err != nil {
+								return fmt.Errorf("failed to locate the snapci executable: %w", err)
+							}
+							dir, err := os.Getwd()
+							if err != nil {
+								return err
+							}
+							repoPath, err := hook.CanonicalPath(c.String("repo"))
+							if err != nil {
+								return err
+							}
+
+							// The hook repeats the global flags this command was given
+							command := []string{executable}
+							for i := 1; i+1 < len(os.Args); i++ {
+								if os.Args[i] == "hook" && os.Args[i+1] == "install" {
+									command = append(command, os.Args[1:i]...)
+									break
+								}
+							}
+							command = append(command, "hook", "post-receive", "--path", repoPath)
+							if c.Bool("inline") {
+								command = append(command, "--inline")
+							}
+
+							repo, err := hook.Install(c.String("name"), repoPath, c.Bool("inline"), c.Bool("force"), dir, command)
+							if err != nil {
+								return err
+							}
+							fmt.Printf("Installed post-receive hook in %s; pushes run the pipeline of %s.\n", repo.Path, repo.Name)
+							if !repo.Inline {
+								fmt.Printf("Pushes are handed to the server listening on %s (`snapci webhooks` or `snapci watch start`).\n", c.String("hook-socket"))
+							}
+							return nil
+						},
+					},
+					{
+						Name:  "list",
+						Usage: "List bare repositories with an installed hook",
+						Action: func(c *cli.Context) error {
+							repos, err := hook.List()
+							if err != nil {
+								return err
+							}
+							if len(repos) == 0 {
+								fmt.Println("No hooks installed. Install one with `snapci hook install`.")
+								return nil
+							}
+							w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+							fmt.Fprintln(w, "NAME\tPATH\tMODE\tINSTALLED")
+							for _, repo := range repos {
+								mode := "server"
+								if repo.Inline {
+									mode = "inline"
+								}
+								fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", repo.Name, repo.Path, mode, repo.InstalledAt.Format("2006-01-02 15:04:05"))
+							}
+							return w.Flush()
+						},
+					},
+					{
+						Name:   "post-receive",
+						Usage:  "Called by installed hooks with the updated refs on stdin",
+						Hidden: true,
+						Flags: []cli.Flag{
+							&cli.StringFlag{Name: "path", Required: true, Usage: "Path of the bare repository"},
+							&cli.BoolFlag{Name: "inline", Usage: "Build in this process"},
+						},
+						Action: func(c *cli.Context) error {
+							pusher := os.Getenv("USER")
+							if pusher == "" {
+								pusher = os.Getenv("LOGNAME")
+							}
+							updates, err := git.ParseHookUpdates(os.Stdin, c.String("path"), pusher)
+							if err != nil {
+								return err
+							}
+							// The push is accepted whatever happens here, so problems are only reported
+							for _, update := range updates {
+								if c.Bool("inline") {
+									if err := git.RunHookUpdate(update); err != nil {
+										fmt.Fprintf(os.Stderr, "snapci: build of %s failed: %v\n", update.Ref, err)
+									}
+									continue
+								}
+								runID, ignored, err := git.SendHookUpdate(update)
+								switch {
+								case err != nil:
+									fmt.Fprintf(os.Stderr, "snapci: not building %s: %v\n", update.Ref, err)
+								case runID == "":
+									fmt.Fprintf(os.Stderr, "snapci: not building %s: %s\n", update.Ref, ignored)
+								default:
+									fmt.Fprintf(os.Stderr, "snapci: queued run %s for %s\n", runID, update.Ref)
+								}
+							}
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "token",
+				Usage: "Manage API tokens for the /api/v1 endpoints of the web server",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "create",
+						Usage: "Create a token; it is shown only once",
+						Flags: []cli.Flag{
+							&cli.StringFlag{Name: "name", Required: true, Usage: "Unique name of the token, e.g. the tool using it"},
+							&cli.StringFlag{Name: "role", Value: users.RoleViewer, Usage: "viewer (read runs and logs) or operator (also trigger, rerun and cancel)"},
+						},
+						Action: func(c *cli.Context) error {
+							token, err := tokens.Create(c.String("name"), c.String("role"))
+							if err != nil {
+								return err
+							}
+							fmt.Fprintf(os.Stderr, "Token %s created with role %s. Store it now, it cannot be shown again:\n", c.String("name"), c.String("role"))
+							fmt.Println(token)
+							return nil
+						},
+					},
+					{
+						Name:  "list",
+						Usage: "List token names and roles",
+						Action: func(c *cli.Context) error {
+							infos, err := tokens.List()
+							if err != nil {
+								return err
+							}
+							if len(infos) == 0 {
+								fmt.Println("No API tokens.")
+								return nil
+							}
+							for _, info := range infos {
+								fmt.Printf("%-30s %-10s created %s\n", info.Name, info.Role, info.CreatedAt.Format("2006-01-02 15:04:05"))
+							}
+							return nil
+						},
+					},
+					{
+						Name:  "revoke",
+						Usage: "Revoke a token",
+						Flags: []cli.Flag{
+							&cli.StringFlag{Name: "name", Required: true, Usage: "Name of the token"},
+						},
+						Action: func(c *cli.Context) error {
+							if err := tokens.Revoke(c.String("name")); err != nil {
+								return err
+							}
+							fmt.Printf("Token %s revoked.\n", c.String("name"))
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "storage",
+				Usage: "Manage the storage backend",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "migrate",
+						Usage: "Import runs, logs, auth data, webhook deliveries and cancel requests from JSON files into the configured backend",
+						Flags: []cli.Flag{
+							&cli.StringFlag{Name: "from", Value: ".", Usage: "Directory containing run_metadata/, run_logs/, auth_data/, webhook_deliveries/ and cancel_requests/"},
+						},
+						Action: func(c *cli.Context) error {
+							if c.String("storage") != storage.BackendSQLite {
+								return cli.Exit("Select the destination backend with --storage sqlite (and optionally --storage-path)", 1)
+							}
+							source := storage.NewJSONStore(c.String("from"))
+							destination, err := storage.Open(c.String("storage"), c.String("storage-path"))
+							if err != nil {
+								return err
+							}
+							defer destination.Close()
+
+							stats, err := storage.Migrate(source, destination)
+							if err != nil {
+								return fmt.Errorf("migration failed after %d runs: %w", stats.Runs, err)
+							}
+							fmt.Printf("Migrated %d runs, %d run logs, %d auth records, %d webhook deliveries and %d cancel requests.\n", stats.Runs, stats.Logs, stats.RepoAuth, stats.Deliveries, stats.CancelRequests)
+							return nil
+						},
+					},
+					{
+						Name:  "upgrade",
+						Usage: "Rewrite the runs in the configured backend in the current format",
+						Action: func(c *cli.Context) error {
+							upgraded, err := storage.UpgradeRuns()
+							if err != nil {
+								return fmt.Errorf("upgrade failed after %d runs: %w", upgraded, err)
+							}
+							fmt.Printf("Upgraded %d runs.\n", upgraded)
+							return nil
+						},
+					},
+				},
+			},
 			{
 				Name:  "start",
 				Usage: "Starts the webhook listener, ngrok tunnel, and optionally sets up Github webhook.",
@@ -254,6 +1055,7 @@ func main() {
 						Usage:   "Optional: GitHub Personal Access Token with 'repo:hooks' scope",
 						EnvVars: []string{"GITHUB_TOKEN"},
 					},
+					workersFlag,
 				},
 				Action: func(c *cli.Context) error {
 					if err := ensureNgrokInstalled(); err != nil {
@@ -268,7 +1070,7 @@ func main() {
 
 					go func() {
 						log.Println("Starting webhook listener...")
-						if err := git.StartWebhookListener(); err != nil {
+						if err := git.StartWebhookListener(c.Int("workers")); err != nil {
 							log.Fatalf("Fatal: Failed to start webhook listener: %v", err)
 						}
 					}()
@@ -313,7 +1115,7 @@ func main() {
 				Flags: []cli.Flag{
 					&cli.StringFlag{
 						Name:     "repo",
-						Usage:    "GitHub repository in the format 'owner/repo-name' (e.g., 'myorg/myproject')",
+						Usage:    "Repository as 'owner/repo-name' on GitHub, or as 'host/path' on GitLab and Gitea",
 						Required: true,
 					},
 					&cli.StringFlag{
@@ -346,6 +1148,7 @@ func main() {
 	}
 
 	err := app.Run(os.Args)
+	storage.Close()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -367,11 +1170,215 @@ func displayRunLogs(runID string) error {
 
 	for jobName, result := range run.Results {
 		fmt.Printf("Job: %s - Status: %s\n", jobName, result.Status)
-		for stepName, stepResult := range result.Steps {
-			fmt.Printf("Step: %s - Status: %s\n", stepName, stepResult.Status)
+		for _, stepResult := range result.Steps {
+			fmt.Printf("Step %d: %s - Status: %s\n", stepResult.Index+1, stepResult.Name, stepResult.Status)
 			fmt.Printf("Logs:\n%s\n", stepResult.Logs)
 		}
 		fmt.Println("---")
 	}
 	return nil
 }
+
+// passwordArg returns the --password flag, or else the first line of stdin.
+// When stdin is a terminal the user is prompted and the input is not echoed.
+func passwordArg(c *cli.Context) (string, error) {
+	if c.IsSet("password") {
+		return c.String("password"), nil
+	}
+
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		fmt.Fprint(os.Stderr, "Password: ")
+		if setTerminalEcho(false) == nil {
+			defer func() {
+				setTerminalEcho(true)
+				fmt.Fprintln(os.Stderr)
+			}()
+		}
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", fmt.Errorf("failed to read password from stdin: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// setTerminalEcho turns echoing of typed characters on the controlling terminal on or off.
+func setTerminalEcho(on bool) error {
+	mode := "-echo"
+	if on {
+		mode = "echo"
+	}
+	cmd := exec.Command("stty", mode)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
+
+// displayRunTiming prints the status of a run with a table of when each job
+// and step started, how long it took and the exit code of each step, in the
+// order they ran.
+func displayRunTiming(run *storage.RunMetadata) {
+	fmt.Printf("Run %s (%s@%s): %s\n", run.ID, run.RepoName, run.Branch, run.Status)
+	if run.PRNumber != 0 {
+		fork := ""
+		if run.FromFork {
+			fork = " (fork: no secrets or stored PAT)"
+		}
+		fmt.Printf("Pull request #%d from %s into %s%s\n", run.PRNumber, run.HeadRepo, run.BaseBranch, fork)
+	}
+	if run.SkipReason != "" {
+		fmt.Printf("Skipped: %s\n", run.SkipReason)
+	}
+	if !run.StartTime.IsZero() && !run.EndTime.IsZero() {
+		fmt.Printf("Started %s, took %s\n", run.StartTime.Format(time.DateTime), formatDuration(run.EndTime.Sub(run.StartTime)))
+	}
+	fmt.Println()
+
+	jobNames := make([]string, 0, len(run.Results))
+	for jobName := range run.Results {
+		jobNames = append(jobNames, jobName)
+	}
+	sort.Slice(jobNames, func(i, j int) bool {
+		a, b := run.Results[jobNames[i]], run.Results[jobNames[j]]
+		if !a.StartTime.Equal(b.StartTime) {
+			return startedBefore(a.StartTime, b.StartTime)
+		}
+		return jobNames[i] < jobNames[j]
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "JOB\tSTEP\tSTATUS\tEXIT\tSTART\tDURATION")
+	for _, jobName := range jobNames {
+		result := run.Results[jobName]
+		fmt.Fprintf(w, "%s\t\t%s\t\t%s\t%s\n", jobName, result.Status, formatClock(result.StartTime), formatDuration(result.Duration))
+		for _, step := range result.Steps {
+			exit := "-"
+			if step.ExitCode != types.NoExitCode {
+				exit = strconv.Itoa(step.ExitCode)
+			}
+			fmt.Fprintf(w, "\t%s\t%s\t%s\t%s\t%s\n", step.Name, step.Status, exit, formatClock(step.StartTime), formatDuration(step.Duration))
+		}
+	}
+	w.Flush()
+}
+
+// displayRunList prints one aligned row per run, most recent first.
+func displayRunList(runs []storage.RunMetadata) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tREPO\tBRANCH\tSTATUS\tTRIGGER\tSTARTED\tDURATION")
+	for _, run := range runs {
+		started, duration := "-", "-"
+		if !run.StartTime.IsZero() {
+			started = run.StartTime.Local().Format(time.DateTime)
+			if !run.EndTime.IsZero() {
+				duration = formatDuration(run.EndTime.Sub(run.StartTime))
+			}
+		}
+		trigger := run.TriggerType
+		if trigger == "" {
+			trigger = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", run.ID, run.RepoName, run.Branch, run.Status, trigger, started, duration)
+	}
+	return w.Flush()
+}
+
+// printStructured writes v to stdout as indented JSON, or as YAML with the
+// same field names as the JSON.
+func printStructured(format string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode output: %w", err)
+	}
+	if format == "yaml" {
+		var doc any
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return fmt.Errorf("failed to encode output: %w", err)
+		}
+		if data, err = yaml.Marshal(doc); err != nil {
+			return fmt.Errorf("failed to encode output: %w", err)
+		}
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	_, err = fmt.Println(string(data))
+	return err
+}
+
+// parseTimeFlag parses a --since or --until value: a duration before now
+// (Go syntax, plus a "d" suffix for days), a date (2006-01-02, local time)
+// or an RFC 3339 time. An empty value yields the zero time.
+func parseTimeFlag(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return now.AddDate(0, 0, -n), nil
+		}
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, value, time.Local); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("'%s' is not a duration, date or RFC 3339 time", value)
+}
+
+// startedBefore orders start times, putting jobs and steps that never
+// started (skipped or cancelled) last.
+func startedBefore(a, b time.Time) bool {
+	if a.IsZero() || b.IsZero() {
+		return !a.IsZero() && b.IsZero()
+	}
+	return a.Before(b)
+}
+
+// formatClock formats the time of day a job or step started, or "-" if it never did.
+func formatClock(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format("15:04:05.000")
+}
+
+// formatDuration rounds a duration for display, or returns "-" for none.
+func formatDuration(d time.Duration) string {
+	if d <= 0 {
+		return "-"
+	}
+	return d.Round(time.Millisecond).String()
+}
+
+// followRunLogs tails the live log of a run, the same stream the web dashboard
+// shows, until the run has finished.
+func followRunLogs(runID string) error {
+	if _, err := storage.GetRun(runID); err != nil {
+		return err
+	}
+
+	var offset int64
+	for {
+		// Check the status before reading so no line written before the run finished is missed
+		run, err := storage.GetRun(runID)
+		if err != nil {
+			return err
+		}
+
+		data, next, err := storage.ReadRunLog(runID, offset)
+		if err != nil {
+			return err
+		}
+		os.Stdout.Write(data)
+		offset = next
+
+		if run.Finished() && len(data) == 0 {
+			fmt.Printf("--- Run %s finished with status: %s\n", runID, run.Status)
+			return nil
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
@@ -1,27 +1,135 @@
 package config
 
 import (
+	"fmt"
 	"os"
 
 	"gopkg.in/yaml.v3"
 )
 
+// DefaultMaxParallel is the number of jobs run concurrently when the
+// pipeline does not set max-parallel.
+const DefaultMaxParallel = 4
+
 // Config represents the .ci.yaml structure
 type Config struct {
-	Name string         `yaml:"name"`
-	On   []string       `yaml:"on"` //  e.g., push, pull_request
-	Jobs map[string]Job `yaml:"jobs"`
+	Name        string            `yaml:"name"`
+	On          Triggers          `yaml:"on"` // Events that start the pipeline, e.g. push, with filters
+	MaxParallel int               `yaml:"max-parallel"`
+	Env         map[string]string `yaml:"env"` // Variables for every step of the pipeline
+	Jobs        map[string]Job    `yaml:"jobs"`
 }
 
 type Job struct {
-	Needs []string `yaml:"needs"`
-	Steps []Step   `yaml:"steps"`
-	Name  string   `yaml:"name"`
+	Needs          StringList        `yaml:"needs"`
+	Strategy       Strategy          `yaml:"strategy"`
+	Env            map[string]string `yaml:"env"` // Overrides pipeline-level env for this job's steps
+	Steps          []Step            `yaml:"steps"`
+	Name           string            `yaml:"name"`
+	TimeoutMinutes int               `yaml:"timeout-minutes"` // Limit for the whole job, 0 = global default
+}
+
+// Strategy controls how a single job is expanded into several variants.
+type Strategy struct {
+	Matrix   Matrix `yaml:"matrix"`
+	FailFast *bool  `yaml:"fail-fast"` // Defaults to true when unset
+}
+
+// IsFailFast reports whether the remaining variants of a matrix job should
+// be abandoned once one of them fails.
+func (s Strategy) IsFailFast() bool {
+	return s.FailFast == nil || *s.FailFast
+}
+
+// Matrix holds the axes of a `strategy.matrix` block, e.g.
+//
+//	matrix:
+//	  go: ["1.21", "1.22"]
+//	  os: [linux, darwin]
+//	  include:
+//	    - go: "1.23"
+//	      os: linux
+//	  exclude:
+//	    - go: "1.21"
+//	      os: darwin
+type Matrix struct {
+	Keys    []string            // Axis names in the order they are declared
+	Axes    map[string][]string // Axis name -> values
+	Include []map[string]string
+	Exclude []map[string]string
+}
+
+// IsEmpty reports whether the job has no matrix at all.
+func (m Matrix) IsEmpty() bool {
+	return len(m.Keys) == 0 && len(m.Include) == 0
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler, keeping axis declaration order.
+func (m *Matrix) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: strategy.matrix must be a mapping", value.Line)
+	}
+
+	m.Axes = make(map[string][]string)
+	for i := 0; i+1 < len(value.Content); i += 2 {
+		key := value.Content[i].Value
+		node := value.Content[i+1]
+
+		switch key {
+		case "include":
+			if err := node.Decode(&m.Include); err != nil {
+				return fmt.Errorf("line %d: invalid matrix include: %w", node.Line, err)
+			}
+		case "exclude":
+			if err := node.Decode(&m.Exclude); err != nil {
+				return fmt.Errorf("line %d: invalid matrix exclude: %w", node.Line, err)
+			}
+		default:
+			var values StringList
+			if err := node.Decode(&values); err != nil {
+				return fmt.Errorf("line %d: invalid values for matrix axis '%s': %w", node.Line, key, err)
+			}
+			if len(values) == 0 {
+				return fmt.Errorf("line %d: matrix axis '%s' has no values", node.Line, key)
+			}
+			m.Keys = append(m.Keys, key)
+			m.Axes[key] = values
+		}
+	}
+	return nil
 }
 
 type Step struct {
-	Name string `yaml:"name"`
-	Run  string `yaml:"run"`
+	Name           string            `yaml:"name"`
+	Run            string            `yaml:"run"`
+	Env            map[string]string `yaml:"env"`             // Overrides pipeline- and job-level env for this step
+	TimeoutMinutes int               `yaml:"timeout-minutes"` // Limit for this step, 0 = global default, if any, else bounded by the job only
+}
+
+// StringList accepts either a single scalar or a sequence in YAML,
+// so both `needs: build` and `needs: [build, lint]` are valid.
+type StringList []string
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (s *StringList) UnmarshalYAML(value *yaml.Node) error {
+	switch value.Kind {
+	case yaml.ScalarNode:
+		var single string
+		if err := value.Decode(&single); err != nil {
+			return err
+		}
+		*s = StringList{single}
+		return nil
+	case yaml.SequenceNode:
+		var list []string
+		if err := value.Decode(&list); err != nil {
+			return err
+		}
+		*s = list
+		return nil
+	default:
+		return fmt.Errorf("line %d: expected a string or a list of strings", value.Line)
+	}
 }
 
 // LoadConfig reads and parses the .ci.yaml file
@@ -0,0 +1,28 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestMatrixUnmarshalYAML(t *testing.T) {
+	var strategy Strategy
+	err := yaml.Unmarshal([]byte("matrix:\n  os: [linux, darwin]\n  go: \"1.22\"\n"), &strategy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := strategy.Matrix
+	if strings.Join(m.Keys, ",") != "os,go" || len(m.Axes["os"]) != 2 || m.Axes["go"][0] != "1.22" {
+		t.Errorf("Matrix = %+v", m)
+	}
+
+	if err := yaml.Unmarshal([]byte("matrix: [go]\n"), &strategy); err == nil {
+		t.Error("Unmarshal() of a matrix sequence succeeded")
+	}
+	err = yaml.Unmarshal([]byte("matrix:\n  go: []\n"), &strategy)
+	if err == nil || !strings.Contains(err.Error(), "matrix axis 'go' has no values") {
+		t.Errorf("Unmarshal() of an empty axis: error = %v", err)
+	}
+}
@@ -0,0 +1,240 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Triggers holds the `on:` block of a pipeline: the events that start it,
+// each with optional filters. It accepts a single event, a list of events or
+// a mapping of events to filters, e.g.
+//
+//	on:
+//	  push:
+//	    branches: [main, release/*]
+//	    tags: [v*]
+//	    paths: [src/**]
+//	    paths-ignore: [docs/**]
+//	  schedule:
+//	    - cron: "0 3 * * 1-5"
+//	      timezone: Europe/Berlin
+//
+// A pipeline without `on:` runs for every event, but not on a schedule.
+type Triggers struct {
+	Events   map[string]EventFilter // Event name -> filters; nil without `on:`
+	Schedule []Schedule
+}
+
+// Schedule is an entry of `on.schedule`: the pipeline runs on the default
+// branch whenever the cron expression matches, in the given IANA timezone
+// (UTC if empty).
+type Schedule struct {
+	Cron     string `yaml:"cron" json:"cron"`
+	Timezone string `yaml:"timezone" json:"timezone,omitempty"`
+}
+
+// scheduleEvent is the `on:` key of schedules, and the event name of scheduled runs.
+const scheduleEvent = "schedule"
+
+// EventFilter narrows down which events of a kind start the pipeline.
+// Patterns are globs: `*` and `?` match within a path segment, `**` matches
+// across segments.
+type EventFilter struct {
+	Branches    []string `yaml:"branches" json:"branches,omitempty"`
+	Tags        []string `yaml:"tags" json:"tags,omitempty"`
+	Paths       []string `yaml:"paths" json:"paths,omitempty"`
+	PathsIgnore []string `yaml:"paths-ignore" json:"paths_ignore,omitempty"`
+}
+
+// Event is something that may start a pipeline, matched against its triggers.
+type Event struct {
+	Name  string   // e.g. push
+	Ref   string   // Full ref, e.g. refs/heads/main or refs/tags/v1.0
+	Files []string // Paths changed by the event, nil if unknown
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (t *Triggers) UnmarshalYAML(value *yaml.Node) error {
+	if value.Tag == "!!null" {
+		*t = Triggers{} // Same as no `on:` at all
+		return nil
+	}
+	triggers := Triggers{Events: map[string]EventFilter{}}
+	switch value.Kind {
+	case yaml.ScalarNode, yaml.SequenceNode:
+		var events StringList
+		if err := value.Decode(&events); err != nil {
+			return err
+		}
+		for _, event := range events {
+			triggers.Events[event] = EventFilter{}
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(value.Content); i += 2 {
+			event := value.Content[i].Value
+			node := value.Content[i+1]
+			if event == scheduleEvent {
+				if err := node.Decode(&triggers.Schedule); err != nil {
+					return fmt.Errorf("line %d: 'on.schedule' must be a list of entries with cron and timezone: %w", node.Line, err)
+				}
+				continue
+			}
+			var filter EventFilter
+			if node.Tag != "!!null" {
+				if err := node.Decode(&filter); err != nil {
+					return fmt.Errorf("line %d: invalid filters for 'on.%s': %w", node.Line, event, err)
+				}
+			}
+			triggers.Events[event] = filter
+		}
+	default:
+		return fmt.Errorf("line %d: 'on' must be an event, a list of events or a mapping of events to filters", value.Line)
+	}
+	*t = triggers
+	return nil
+}
+
+// MarshalJSON encodes Triggers in the shape of the `on:` mapping, with the
+// schedule under "schedule" next to the events.
+func (t Triggers) MarshalJSON() ([]byte, error) {
+	if t.Events == nil && t.Schedule == nil {
+		return []byte("null"), nil
+	}
+	out := make(map[string]any, len(t.Events)+1)
+	for event, filter := range t.Events {
+		out[event] = filter
+	}
+	if t.Schedule != nil {
+		out[scheduleEvent] = t.Schedule
+	}
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON decodes Triggers, also accepting the list of event names
+// stored with runs before `on:` had filters.
+func (t *Triggers) UnmarshalJSON(data []byte) error {
+	*t = Triggers{}
+	if string(data) == "null" {
+		return nil
+	}
+	t.Events = map[string]EventFilter{}
+	if len(data) > 0 && data[0] == '[' {
+		var events []string
+		if err := json.Unmarshal(data, &events); err != nil {
+			return err
+		}
+		for _, event := range events {
+			t.Events[event] = EventFilter{}
+		}
+		return nil
+	}
+	var entries map[string]json.RawMessage
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	for event, raw := range entries {
+		if event == scheduleEvent {
+			if err := json.Unmarshal(raw, &t.Schedule); err != nil {
+				return err
+			}
+			continue
+		}
+		var filter EventFilter
+		if err := json.Unmarshal(raw, &filter); err != nil {
+			return err
+		}
+		t.Events[event] = filter
+	}
+	return nil
+}
+
+// Match reports whether the event starts the pipeline, and if not, why.
+func (t Triggers) Match(event Event) (bool, string) {
+	if event.Name == scheduleEvent {
+		if len(t.Schedule) == 0 {
+			return false, "'on' no longer has a schedule"
+		}
+		return true, ""
+	}
+	if t.Events == nil {
+		return true, ""
+	}
+	filter, ok := t.Events[event.Name]
+	if !ok {
+		return false, fmt.Sprintf("'on' does not include %s events", event.Name)
+	}
+
+	if tag, isTag := strings.CutPrefix(event.Ref, "refs/tags/"); isTag {
+		if len(filter.Tags) == 0 && len(filter.Branches) > 0 {
+			return false, fmt.Sprintf("tag '%s' pushed, but on.%s only lists branches", tag, event.Name)
+		}
+		if len(filter.Tags) > 0 && !MatchAnyGlob(filter.Tags, tag) {
+			return false, fmt.Sprintf("tag '%s' does not match on.%s.tags", tag, event.Name)
+		}
+		return true, "" // Path filters only apply to branches
+	}
+
+	branch := strings.TrimPrefix(event.Ref, "refs/heads/")
+	if len(filter.Branches) == 0 && len(filter.Tags) > 0 {
+		return false, fmt.Sprintf("branch '%s' pushed, but on.%s only lists tags", branch, event.Name)
+	}
+	if len(filter.Branches) > 0 && !MatchAnyGlob(filter.Branches, branch) {
+		return false, fmt.Sprintf("branch '%s' does not match on.%s.branches", branch, event.Name)
+	}
+
+	// Without the list of changed files, e.g. for a new branch, path filters cannot exclude anything
+	if len(event.Files) == 0 || (len(filter.Paths) == 0 && len(filter.PathsIgnore) == 0) {
+		return true, ""
+	}
+	for _, file := range event.Files {
+		if (len(filter.Paths) == 0 || MatchAnyGlob(filter.Paths, file)) && !MatchAnyGlob(filter.PathsIgnore, file) {
+			return true, ""
+		}
+	}
+	switch {
+	case len(filter.Paths) == 0:
+		return false, fmt.Sprintf("all %d changed files match on.%s.paths-ignore", len(event.Files), event.Name)
+	case len(filter.PathsIgnore) > 0:
+		return false, fmt.Sprintf("none of the %d changed files match on.%s.paths but not paths-ignore", len(event.Files), event.Name)
+	}
+	return false, fmt.Sprintf("none of the %d changed files match on.%s.paths", len(event.Files), event.Name)
+}
+
+// MatchAnyGlob reports whether name matches any of the globs, with the same
+// syntax as the branch, tag and path filters of `on:`.
+func MatchAnyGlob(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if globRegexp(pattern).MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// globRegexp translates a glob into an anchored regular expression.
+func globRegexp(pattern string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			b.WriteString("(.*/)?") // Zero or more directories
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
@@ -0,0 +1,182 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatchAnyGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"main", "main", true},
+		{"main", "main2", false},
+		{"main", "xmain", false},
+		{"release/*", "release/1.0", true},
+		{"release/*", "release/", true},
+		{"release/*", "release/1.0/hotfix", false},
+		{"release/*", "release", false},
+		{"release/**", "release/1.0/hotfix", true},
+		{"v?.0", "v1.0", true},
+		{"v?.0", "v10.0", false},
+		{"v?", "v/", false},
+		{"v*", "v1.2.3", true},
+		{"v1.*", "v1x2", false}, // Dots are literal
+		{"feature-(x)", "feature-(x)", true},
+		{"src/**", "src/main.go", true},
+		{"src/**", "src/a/b/c.go", true},
+		{"src/**", "src", false},
+		{"src/**/*.go", "src/main.go", true},
+		{"src/**/*.go", "src/a/b/main.go", true},
+		{"src/**/*.go", "src/a/b/main.js", false},
+		{"**/*.md", "README.md", true},
+		{"**/*.md", "docs/guide/intro.md", true},
+		{"*.md", "docs/intro.md", false},
+		{"**", "anything/at/all", true},
+		{"docs/ü*", "docs/über.md", true},
+		{"", "", true},
+		{"", "main", false},
+	}
+	for _, tt := range tests {
+		if got := MatchAnyGlob([]string{tt.pattern}, tt.name); got != tt.want {
+			t.Errorf("MatchAnyGlob(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+
+	if MatchAnyGlob(nil, "main") {
+		t.Error("MatchAnyGlob(nil, \"main\") = true, want false")
+	}
+	if !MatchAnyGlob([]string{"dev", "release/*"}, "release/2.0") {
+		t.Error("MatchAnyGlob with several patterns did not match the second one")
+	}
+}
+
+func TestTriggersMatch(t *testing.T) {
+	push := func(filter EventFilter) Triggers {
+		return Triggers{Events: map[string]EventFilter{"push": filter}}
+	}
+
+	tests := []struct {
+		name       string
+		triggers   Triggers
+		event      Event
+		want       bool
+		wantReason string
+	}{
+		{
+			name:     "no on block runs every event",
+			triggers: Triggers{},
+			event:    Event{Name: "pull_request", Ref: "refs/heads/feature"},
+			want:     true,
+		},
+		{
+			name:       "no on block does not run on a schedule",
+			triggers:   Triggers{},
+			event:      Event{Name: "schedule", Ref: "refs/heads/main"},
+			wantReason: "no longer has a schedule",
+		},
+		{
+			name:     "schedule",
+			triggers: Triggers{Schedule: []Schedule{{Cron: "0 3 * * *"}}},
+			event:    Event{Name: "schedule", Ref: "refs/heads/main"},
+			want:     true,
+		},
+		{
+			name:       "event not listed",
+			triggers:   push(EventFilter{}),
+			event:      Event{Name: "pull_request", Ref: "refs/heads/main"},
+			wantReason: "'on' does not include pull_request events",
+		},
+		{
+			name:     "branch glob",
+			triggers: push(EventFilter{Branches: []string{"main", "release/*"}}),
+			event:    Event{Name: "push", Ref: "refs/heads/release/1.0"},
+			want:     true,
+		},
+		{
+			name:       "branch not listed",
+			triggers:   push(EventFilter{Branches: []string{"main"}}),
+			event:      Event{Name: "push", Ref: "refs/heads/feature"},
+			wantReason: "branch 'feature' does not match on.push.branches",
+		},
+		{
+			name:       "tag with only branch filters",
+			triggers:   push(EventFilter{Branches: []string{"main"}}),
+			event:      Event{Name: "push", Ref: "refs/tags/v1.0"},
+			wantReason: "only lists branches",
+		},
+		{
+			name:       "branch with only tag filters",
+			triggers:   push(EventFilter{Tags: []string{"v*"}}),
+			event:      Event{Name: "push", Ref: "refs/heads/main"},
+			wantReason: "only lists tags",
+		},
+		{
+			name:     "tag glob",
+			triggers: push(EventFilter{Tags: []string{"v*"}}),
+			event:    Event{Name: "push", Ref: "refs/tags/v1.2.3"},
+			want:     true,
+		},
+		{
+			name:       "tag not listed",
+			triggers:   push(EventFilter{Tags: []string{"v*"}}),
+			event:      Event{Name: "push", Ref: "refs/tags/nightly"},
+			wantReason: "tag 'nightly' does not match on.push.tags",
+		},
+		{
+			name:     "tags ignore path filters",
+			triggers: push(EventFilter{Tags: []string{"v*"}, Paths: []string{"src/**"}}),
+			event:    Event{Name: "push", Ref: "refs/tags/v1.0", Files: []string{"docs/a.md"}},
+			want:     true,
+		},
+		{
+			name:     "changed path matches",
+			triggers: push(EventFilter{Paths: []string{"src/**"}}),
+			event:    Event{Name: "push", Ref: "refs/heads/main", Files: []string{"docs/a.md", "src/main.go"}},
+			want:     true,
+		},
+		{
+			name:       "no changed path matches",
+			triggers:   push(EventFilter{Paths: []string{"src/**"}}),
+			event:      Event{Name: "push", Ref: "refs/heads/main", Files: []string{"docs/a.md"}},
+			wantReason: "none of the 1 changed files match on.push.paths",
+		},
+		{
+			name:       "all changed paths ignored",
+			triggers:   push(EventFilter{PathsIgnore: []string{"docs/**", "*.md"}}),
+			event:      Event{Name: "push", Ref: "refs/heads/main", Files: []string{"docs/a.md", "README.md"}},
+			wantReason: "all 2 changed files match on.push.paths-ignore",
+		},
+		{
+			name:     "one changed path not ignored",
+			triggers: push(EventFilter{PathsIgnore: []string{"docs/**"}}),
+			event:    Event{Name: "push", Ref: "refs/heads/main", Files: []string{"docs/a.md", "go.mod"}},
+			want:     true,
+		},
+		{
+			name:       "paths and paths-ignore",
+			triggers:   push(EventFilter{Paths: []string{"src/**"}, PathsIgnore: []string{"src/**/*_test.go"}}),
+			event:      Event{Name: "push", Ref: "refs/heads/main", Files: []string{"src/a/b_test.go"}},
+			wantReason: "match on.push.paths but not paths-ignore",
+		},
+		{
+			name:     "unknown changed files cannot exclude",
+			triggers: push(EventFilter{Paths: []string{"src/**"}}),
+			event:    Event{Name: "push", Ref: "refs/heads/new-branch"},
+			want:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, reason := tt.triggers.Match(tt.event)
+			if got != tt.want {
+				t.Fatalf("Match() = %v (%s), want %v", got, reason, tt.want)
+			}
+			if !strings.Contains(reason, tt.wantReason) || (tt.want && reason != "") {
+				t.Errorf("Match() reason = %q, want %q", reason, tt.wantReason)
+			}
+		})
+	}
+}
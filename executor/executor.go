@@ -4,57 +4,133 @@ package executor
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt" // Import fmt for better error formatting
+	"io"
 	"log"
+	"os"
 	"os/exec"
 	"snap-ci/types"
 	"strings" // Import strings for trimming whitespace
-	// "time" // If you add timestamps
+	"time"
 )
 
 // Step represents a single execution step.
 type Step struct { // Define the Step struct here or import it if defined elsewhere
-	Name string `yaml:"name"`
-	Run  string `yaml:"run"`
+	Name    string   `yaml:"name"`
+	Run     string   `yaml:"run"`
+	Env     []string `yaml:"-"` // Extra KEY=VALUE pairs added to the process environment
+	Job     string   `yaml:"-"` // Name of the job the step belongs to, used to label streamed output
+	Secrets []string `yaml:"-"` // Values masked in the step's output and logs
 }
 
 // ExecuteStep executes a single step in the pipeline.
-func ExecuteStep(step Step, workingDir string) (types.StepResult, error) {
-	// startTime := time.Now() // If you add timestamps
-
+// If output is not nil, stdout and stderr are streamed to it line by line
+// while the step runs, each line prefixed with a timestamp and the step label.
+// The step runs in its own process group, which is terminated when ctx is
+// done; a step stopped by its deadline is reported as timed out, and one
+// stopped because the run was cancelled is reported as cancelled.
+// Every value in step.Secrets is replaced by *** in the streamed output, the
+// returned logs and the error.
+// The result records when the step ran, for how long, its exit code and its
+// captured output, whatever the outcome.
+func ExecuteStep(ctx context.Context, step Step, workingDir string, output io.Writer) (types.StepResult, error) {
 	cmd := exec.Command("bash", "-c", step.Run)
 	cmd.Dir = workingDir
+	if len(step.Env) > 0 {
+		cmd.Env = append(os.Environ(), step.Env...)
+	}
+
+	redactor := NewRedactor(step.Secrets)
 
 	var stdoutBuf, stderrBuf bytes.Buffer
 	cmd.Stdout = &stdoutBuf
 	cmd.Stderr = &stderrBuf
 
-	err := cmd.Run()
-	// endTime := time.Now() // If you add timestamps
+	// stdout and stderr get separate line writers so partial lines never interleave
+	var stdoutLines, stderrLines *lineWriter
+	if output != nil {
+		label := step.Name
+		if step.Job != "" {
+			label = step.Job + " / " + step.Name
+		}
+		stdoutLines = newLineWriter(output, label, redactor)
+		stderrLines = newLineWriter(output, label, redactor)
+		cmd.Stdout = io.MultiWriter(&stdoutBuf, stdoutLines)
+		cmd.Stderr = io.MultiWriter(&stderrBuf, stderrLines)
+	}
+
+	startTime := time.Now()
+	err := runInProcessGroup(ctx, cmd)
+	endTime := time.Now()
+	if output != nil {
+		stdoutLines.Flush()
+		stderrLines.Flush()
+	}
+
+	// Every outcome below shares the timing and exit code of the process
+	timing := types.StepResult{
+		Name:      step.Name,
+		ExitCode:  exitCode(cmd),
+		StartTime: startTime,
+		EndTime:   endTime,
+		Duration:  endTime.Sub(startTime),
+	}
 
-	// Capture both stdout and stderr
-	stdout := stdoutBuf.String()
-	stderr := stderrBuf.String()
+	// Capture both stdout and stderr, with secrets masked before they are stored
+	stdout := redactor.Redact(stdoutBuf.String())
+	stderr := redactor.Redact(stderrBuf.String())
 	logs := stdout + stderr
 
-	status := "Success"
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		notice := "Step timed out and was terminated"
+		if output != nil {
+			stderrLines.Write([]byte(notice + "\n"))
+		}
+		log.Printf("Step '%s' timed out", step.Name)
+		stepResult := timing
+		stepResult.Status = types.StatusTimedOut
+		stepResult.Logs = logs + notice + "\n"
+		return stepResult, fmt.Errorf("step '%s' timed out", step.Name)
+	}
+
+	if errors.Is(ctx.Err(), context.Canceled) {
+		notice := "Step cancelled and was terminated"
+		if output != nil {
+			stderrLines.Write([]byte(notice + "\n"))
+		}
+		log.Printf("Step '%s' cancelled", step.Name)
+		stepResult := timing
+		stepResult.Status = types.StatusCancelled
+		stepResult.Logs = logs + notice + "\n"
+		return stepResult, fmt.Errorf("step '%s' cancelled", step.Name)
+	}
+
 	if err != nil {
-		status = "Failure"
 		log.Printf("Step '%s' failed: %v", step.Name, err)
+		stepResult := timing
+		stepResult.Status = types.StatusFailure
+		stepResult.Logs = logs
 		// Include stderr in the error message for more context
-		return types.StepResult{}, fmt.Errorf("step '%s' failed: %v, stderr: %s", step.Name, err, strings.TrimSpace(stderr))
+		return stepResult, fmt.Errorf("step '%s' failed: %v, stderr: %s", step.Name, err, strings.TrimSpace(stderr))
 	}
 
-	stepResult := types.StepResult{
-		Name:   step.Name,
-		Status: status,
-		Logs:   logs,
-		// StartTime: startTime, // If you add timestamps
-		// EndTime:   endTime,
-	}
+	stepResult := timing
+	stepResult.Status = types.StatusSuccess
+	stepResult.Logs = logs
 
 	// Log the output (optional, but helpful for debugging)
 	log.Printf("Step '%s' output:\n%s", step.Name, logs)
 
 	return stepResult, nil
 }
+
+// exitCode returns the exit code of a finished command, or types.NoExitCode
+// if it never started or was killed by a signal.
+func exitCode(cmd *exec.Cmd) int {
+	if cmd.ProcessState == nil {
+		return types.NoExitCode
+	}
+	return cmd.ProcessState.ExitCode()
+}
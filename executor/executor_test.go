@@ -0,0 +1,205 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"snap-ci/types"
+)
+
+// useGracePeriod shortens TerminationGracePeriod for the test.
+func useGracePeriod(t *testing.T, d time.Duration) {
+	t.Helper()
+	previous := TerminationGracePeriod
+	TerminationGracePeriod = d
+	t.Cleanup(func() { TerminationGracePeriod = previous })
+}
+
+// alive reports whether the process pid exists and is not a zombie.
+func alive(pid int) bool {
+	if err := syscall.Kill(pid, 0); err != nil {
+		return false
+	}
+	stat, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return true
+	}
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+	return len(fields) == 0 || fields[0] != "Z"
+}
+
+// waitForPid reads the PID a step wrote to path.
+func waitForPid(t *testing.T, path string) int {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if data, err := os.ReadFile(path); err == nil && strings.HasSuffix(string(data), "\n") {
+			pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return pid
+		}
+	}
+	t.Fatalf("the step did not write %s", path)
+	return 0
+}
+
+func TestExecuteStep(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "input.txt"), []byte("from the workspace\n"), 0644)
+
+	tests := []struct {
+		name         string
+		run          string
+		wantStatus   string
+		wantExitCode int
+		wantLogs     string
+		wantErr      string
+	}{
+		{"success", "cat input.txt && echo $GREETING", types.StatusSuccess, 0, "from the workspace\nhello\n", ""},
+		{"failure", "echo out; echo broken >&2; exit 3", types.StatusFailure, 3, "out\nbroken\n", "stderr: broken"},
+		{"missing command", "no-such-command-snapci", types.StatusFailure, 127, "command not found", "exit status 127"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step := Step{Name: tt.name, Run: tt.run, Env: []string{"GREETING=hello"}}
+			result, err := ExecuteStep(context.Background(), step, dir, nil)
+
+			if result.Status != tt.wantStatus || result.ExitCode != tt.wantExitCode {
+				t.Errorf("ExecuteStep() = status %s, exit code %d; want %s, %d", result.Status, result.ExitCode, tt.wantStatus, tt.wantExitCode)
+			}
+			if !strings.Contains(result.Logs, tt.wantLogs) {
+				t.Errorf("logs = %q, want %q", result.Logs, tt.wantLogs)
+			}
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("ExecuteStep() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("ExecuteStep() error = %v, want %q", err, tt.wantErr)
+			}
+			if result.StartTime.IsZero() || result.EndTime.Before(result.StartTime) {
+				t.Errorf("step timing %v - %v", result.StartTime, result.EndTime)
+			}
+		})
+	}
+}
+
+func TestExecuteStepTimeoutTerminatesTheProcessGroup(t *testing.T) {
+	useGracePeriod(t, 5*time.Second)
+	dir := t.TempDir()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	// The background sleep would keep running if only the shell was signalled
+	step := Step{Name: "slow", Run: "sleep 30 & echo $! > pid; echo started; wait"}
+	result, err := ExecuteStep(ctx, step, dir, nil)
+
+	if result.Status != types.StatusTimedOut || err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("ExecuteStep() = %s, %v; want %s", result.Status, err, types.StatusTimedOut)
+	}
+	if result.Duration > 3*time.Second {
+		t.Errorf("the step took %s to terminate, SIGTERM should have ended it", result.Duration)
+	}
+	if result.ExitCode != types.NoExitCode {
+		t.Errorf("exit code = %d, want %d", result.ExitCode, types.NoExitCode)
+	}
+	if !strings.Contains(result.Logs, "started\n") || !strings.Contains(result.Logs, "Step timed out and was terminated") {
+		t.Errorf("logs = %q", result.Logs)
+	}
+
+	pid := waitForPid(t, filepath.Join(dir, "pid"))
+	for deadline := time.Now().Add(2 * time.Second); alive(pid); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatalf("the step's background process %d outlived the step", pid)
+		}
+	}
+}
+
+func TestExecuteStepKillsProcessesIgnoringSIGTERM(t *testing.T) {
+	useGracePeriod(t, 200*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	step := Step{Name: "stubborn", Run: "trap '' TERM; sleep 30"}
+	start := time.Now()
+	result, _ := ExecuteStep(ctx, step, t.TempDir(), nil)
+
+	if result.Status != types.StatusTimedOut {
+		t.Errorf("status = %s, want %s", result.Status, types.StatusTimedOut)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the step took %s to be killed", elapsed)
+	}
+}
+
+func TestExecuteStepCancelled(t *testing.T) {
+	useGracePeriod(t, 5*time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	result, err := ExecuteStep(ctx, Step{Name: "long", Run: "sleep 30"}, t.TempDir(), nil)
+
+	if result.Status != types.StatusCancelled || err == nil {
+		t.Errorf("ExecuteStep() = %s, %v; want %s", result.Status, err, types.StatusCancelled)
+	}
+	if !strings.Contains(result.Logs, "Step cancelled and was terminated") {
+		t.Errorf("logs = %q", result.Logs)
+	}
+}
+
+func TestExecuteStepStreamsRedactedOutput(t *testing.T) {
+	var output bytes.Buffer
+	step := Step{
+		Name:    "deploy",
+		Job:     "release",
+		Run:     "echo token=hunter2; echo oops hunter2 >&2; printf 'no newline'; exit 1",
+		Secrets: []string{"hunter2"},
+	}
+	result, err := ExecuteStep(context.Background(), step, t.TempDir(), &output)
+
+	for _, text := range []string{output.String(), result.Logs, err.Error()} {
+		if strings.Contains(text, "hunter2") {
+			t.Errorf("a secret leaked: %q", text)
+		}
+	}
+	lines := strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("streamed %d lines, want 3: %q", len(lines), output.String())
+	}
+	for _, want := range []string{"[release / deploy] token=***", "[release / deploy] oops ***", "[release / deploy] no newline"} {
+		if !strings.Contains(output.String(), want+"\n") {
+			t.Errorf("streamed output lacks %q: %q", want, output.String())
+		}
+	}
+	if _, err := time.Parse(time.RFC3339, strings.Fields(lines[0])[0]); err != nil {
+		t.Errorf("line %q does not start with a timestamp: %v", lines[0], err)
+	}
+}
+
+func TestRedactor(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		input  string
+		want   string
+	}{
+		{"no secrets", nil, "hunter2", "hunter2"},
+		{"every occurrence", []string{"hunter2"}, "a hunter2 b hunter2", "a *** b ***"},
+		{"short values are ignored", []string{"ab", ""}, "abc", "abc"},
+		{"longest first", []string{"secret", "secret-token"}, "secret-token secret", "*** ***"},
+		{"lines of a multi-line value", []string{"-----BEGIN KEY-----\r\nAAAA\nBBBB"}, "AAAA then BBBB", "*** then ***"},
+	}
+	for _, tt := range tests {
+		if got := NewRedactor(tt.values).Redact(tt.input); got != tt.want {
+			t.Errorf("%s: Redact(%q) = %q, want %q", tt.name, tt.input, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+// executor/process.go
+
+package executor
+
+import (
+	"context"
+	"log"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// TerminationGracePeriod is how long a step's process group gets to exit
+// after SIGTERM before it is killed with SIGKILL.
+var TerminationGracePeriod = 10 * time.Second
+
+// runInProcessGroup starts cmd in its own process group and waits for it.
+// When ctx is done first, the whole group (the shell and everything it
+// spawned) receives SIGTERM, then SIGKILL once the grace period is over.
+func runInProcessGroup(ctx context.Context, cmd *exec.Cmd) error {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	// Don't wait forever for output pipes held open by an escaped grandchild
+	cmd.WaitDelay = TerminationGracePeriod
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	waitDone := make(chan error, 1)
+	go func() { waitDone <- cmd.Wait() }()
+
+	select {
+	case err := <-waitDone:
+		return err
+	case <-ctx.Done():
+	}
+
+	pgid := cmd.Process.Pid // Equal to the group ID thanks to Setpgid
+	log.Printf("Terminating process group %d: %v", pgid, ctx.Err())
+	if err := syscall.Kill(-pgid, syscall.SIGTERM); err != nil && err != syscall.ESRCH {
+		log.Printf("Warning: Failed to send SIGTERM to process group %d: %v", pgid, err)
+	}
+
+	grace := time.NewTimer(TerminationGracePeriod)
+	defer grace.Stop()
+	select {
+	case err := <-waitDone:
+		// The shell is gone; make sure nothing it spawned outlives it
+		syscall.Kill(-pgid, syscall.SIGKILL)
+		return err
+	case <-grace.C:
+	}
+
+	log.Printf("Process group %d still running after %s, sending SIGKILL", pgid, TerminationGracePeriod)
+	if err := syscall.Kill(-pgid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+		log.Printf("Warning: Failed to send SIGKILL to process group %d: %v", pgid, err)
+	}
+	return <-waitDone
+}
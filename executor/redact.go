@@ -0,0 +1,58 @@
+// executor/redact.go
+
+package executor
+
+import (
+	"sort"
+	"strings"
+)
+
+// redactedMask replaces secret values in logs.
+const redactedMask = "***"
+
+// Redactor masks secret values in text.
+type Redactor struct {
+	replacer *strings.Replacer
+}
+
+// NewRedactor returns a Redactor for the given secret values. Each line of a
+// multi-line value (e.g. a deploy key) is masked on its own as well, since
+// output is processed line by line. A nil Redactor masks nothing.
+func NewRedactor(values []string) *Redactor {
+	seen := make(map[string]bool)
+	var masks []string
+	add := func(s string) {
+		// Very short fragments would mask unrelated output
+		if len(s) >= 3 && !seen[s] {
+			seen[s] = true
+			masks = append(masks, s)
+		}
+	}
+	for _, value := range values {
+		add(value)
+		if strings.Contains(value, "\n") {
+			for _, line := range strings.Split(value, "\n") {
+				add(strings.TrimSpace(strings.TrimSuffix(line, "\r")))
+			}
+		}
+	}
+	if len(masks) == 0 {
+		return nil
+	}
+
+	// Longest first, so a value containing another one is masked as a whole
+	sort.Slice(masks, func(i, j int) bool { return len(masks[i]) > len(masks[j]) })
+	pairs := make([]string, 0, 2*len(masks))
+	for _, mask := range masks {
+		pairs = append(pairs, mask, redactedMask)
+	}
+	return &Redactor{replacer: strings.NewReplacer(pairs...)}
+}
+
+// Redact returns s with every secret value replaced by ***.
+func (r *Redactor) Redact(s string) string {
+	if r == nil {
+		return s
+	}
+	return r.replacer.Replace(s)
+}
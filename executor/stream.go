@@ -0,0 +1,51 @@
+// executor/stream.go
+
+package executor
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+)
+
+// lineWriter splits a process's output into lines and forwards each complete
+// line to out, prefixed with a timestamp and the job/step label, with secret
+// values masked.
+type lineWriter struct {
+	out      io.Writer
+	label    string
+	redactor *Redactor
+	buf      []byte
+}
+
+func newLineWriter(out io.Writer, label string, redactor *Redactor) *lineWriter {
+	return &lineWriter{out: out, label: label, redactor: redactor}
+}
+
+// Write never fails: a broken log sink must not fail the step producing the output.
+func (lw *lineWriter) Write(p []byte) (int, error) {
+	lw.buf = append(lw.buf, p...)
+	for {
+		i := bytes.IndexByte(lw.buf, '\n')
+		if i < 0 {
+			break
+		}
+		lw.emit(lw.buf[:i])
+		lw.buf = lw.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush forwards a trailing line that was not terminated by a newline.
+func (lw *lineWriter) Flush() {
+	if len(lw.buf) > 0 {
+		lw.emit(lw.buf)
+		lw.buf = nil
+	}
+}
+
+func (lw *lineWriter) emit(line []byte) {
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	fmt.Fprintf(lw.out, "%s [%s] %s\n", time.Now().UTC().Format(time.RFC3339), lw.label, lw.redactor.Redact(string(line)))
+}
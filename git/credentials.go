@@ -0,0 +1,75 @@
+package git
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+
+	"snap-ci/storage"
+)
+
+// tokenEnv is the environment variable through which git commands get the
+// stored token, so it never appears in their arguments or in a clone's config.
+const tokenEnv = "SNAPCI_GIT_TOKEN"
+
+// credentialHelper answers git's requests for credentials with the token in
+// tokenEnv. GitHub, GitLab and Gitea accept any user name with a token.
+const credentialHelper = `!f() { test "$1" = get && echo username=oauth2 && echo "password=$` + tokenEnv + `"; }; f`
+
+// storedToken returns the stored token of repoName for repoURL, or "" if
+// there is none. Only HTTPS URLs without credentials of their own use one.
+func storedToken(repoURL, repoName string) string {
+	if repoName == "" {
+		return ""
+	}
+	u, err := url.Parse(repoURL)
+	if err != nil || u.Scheme != "https" || u.User != nil {
+		return ""
+	}
+	auth, err := storage.GetRepoAuth(repoName)
+	if err != nil {
+		log.Printf("No stored authentication found for %s: %v. Attempting without token (might fail for private repos).", repoName, err)
+		return ""
+	}
+	token, err := auth.AccessToken()
+	if err != nil {
+		log.Printf("Warning: %v. Attempting without token (might fail for private repos).", err)
+		return ""
+	}
+	return token
+}
+
+// gitCommand returns a git command that authenticates to the host of repoURL
+// with token, or a plain git command if token is empty. The credential helper
+// is set with -c, so it only applies to this command and replaces the user's
+// helpers, which could otherwise store the token.
+func gitCommand(ctx context.Context, repoURL, token string, args ...string) *exec.Cmd {
+	if token == "" {
+		return exec.CommandContext(ctx, "git", args...)
+	}
+	scope := "credential."
+	if u, err := url.Parse(repoURL); err == nil {
+		scope += u.Scheme + "://" + u.Host + "." // Redirects to other hosts don't get the token
+	}
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-c", "credential.helper=", "-c", scope + "helper=" + credentialHelper}, args...)...)
+	cmd.Env = append(os.Environ(), tokenEnv+"="+token, "GIT_TERMINAL_PROMPT=0")
+	return cmd
+}
+
+// redact hides token, and the password of repoURL if it has one, in text that
+// is logged or returned in an error.
+func redact(text, repoURL, token string) string {
+	if u, err := url.Parse(repoURL); err == nil && u.User != nil {
+		text = strings.ReplaceAll(text, repoURL, u.Redacted())
+		if password, ok := u.User.Password(); ok && password != "" {
+			text = strings.ReplaceAll(text, password, "xxxxx")
+		}
+	}
+	if token != "" {
+		text = strings.ReplaceAll(text, token, "xxxxx")
+	}
+	return text
+}
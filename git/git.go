@@ -2,10 +2,11 @@ package git
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
@@ -13,8 +14,7 @@ import (
 	"strings"
 	"time"
 
-	"snap-ci/config"
-	"snap-ci/pipeline"
+	"snap-ci/schedule"
 	"snap-ci/storage"
 )
 
@@ -36,6 +36,33 @@ type PushEvent struct {
 	HeadCommit *Commit    `json:"head_commit"` // Can be null
 }
 
+// PullRequestEvent holds the fields of a GitHub pull_request event payload that snapci uses.
+type PullRequestEvent struct {
+	Action      string      `json:"action"` // e.g. "opened", "synchronize", "closed"
+	Number      int         `json:"number"`
+	PullRequest PullRequest `json:"pull_request"`
+	Repository  Repository  `json:"repository"` // The base repository
+	Sender      Sender      `json:"sender"`
+}
+
+type PullRequest struct {
+	Number  int            `json:"number"`
+	Title   string         `json:"title"`
+	HTMLURL string         `json:"html_url"`
+	Head    PullRequestRef `json:"head"` // The branch to merge
+	Base    PullRequestRef `json:"base"` // The branch to merge into
+}
+
+type PullRequestRef struct {
+	Ref  string      `json:"ref"` // Branch name, e.g. "feature-x"
+	SHA  string      `json:"sha"`
+	Repo *Repository `json:"repo"` // Null if the head repository was deleted
+}
+
+// pullRequestActions are the pull_request actions that start a run: the PR
+// was opened or reopened, or new commits were pushed to it.
+var pullRequestActions = map[string]bool{"opened": true, "synchronize": true, "reopened": true}
+
 type Repository struct {
 	ID            int64   `json:"id"`
 	NodeID        string  `json:"node_id"`
@@ -134,9 +161,17 @@ func GetNgrokPublicURL() (string, error) {
 
 // RegisterGithubWebhook registers or updates a webhook on GitHub.
 // It checks if a webhook exists and attempts to update it, otherwise creates a new one.
+// The webhook is signed with a per-repo secret that is stored alongside the repo's auth data.
 func RegisterGithubWebhook(owner, repo, webhookURL, githubToken string) error {
+	// Stored before the API call so the ping GitHub sends right away can be verified
+	secret, err := WebhookSecretFor(fmt.Sprintf("%s/%s", owner, repo))
+	if err != nil {
+		return err
+	}
+
 	// First, check if a webhook already exists for this URL
-	existingWebhooksURL := fmt.Sprintf("https://api.github.com/repos/%s/%s/hooks", owner, repo)
+	apiURL, _ := githubURLs()
+	existingWebhooksURL := fmt.Sprintf("%s/repos/%s/%s/hooks", apiURL, owner, repo)
 	req, err := http.NewRequest(http.MethodGet, existingWebhooksURL, nil)
 	if err != nil {
 		return fmt.Errorf("failed to create get webhooks request: %w", err)
@@ -179,10 +214,11 @@ func RegisterGithubWebhook(owner, repo, webhookURL, githubToken string) error {
 	hookConfig := map[string]interface{}{
 		"name":   "web",
 		"active": true,
-		"events": []string{"push"},
+		"events": []string{"push", "pull_request"},
 		"config": map[string]string{
 			"url":          webhookURL,
 			"content_type": "json",
+			"secret":       secret,
 			"insecure_ssl": "0", // Always set to "0" for security unless absolutely necessary
 		},
 	}
@@ -191,11 +227,11 @@ func RegisterGithubWebhook(owner, repo, webhookURL, githubToken string) error {
 	var apiTargetURL string
 	if existingHookID != 0 {
 		apiMethod = http.MethodPatch // Update existing webhook
-		apiTargetURL = fmt.Sprintf("https://api.github.com/repos/%s/%s/hooks/%d", owner, repo, existingHookID)
+		apiTargetURL = fmt.Sprintf("%s/repos/%s/%s/hooks/%d", apiURL, owner, repo, existingHookID)
 		log.Printf("Updating existing webhook (ID: %d) for %s/%s to %s", existingHookID, owner, repo, webhookURL)
 	} else {
 		apiMethod = http.MethodPost // Create new webhook
-		apiTargetURL = fmt.Sprintf("https://api.github.com/repos/%s/%s/hooks", owner, repo)
+		apiTargetURL = fmt.Sprintf("%s/repos/%s/%s/hooks", apiURL, owner, repo)
 		log.Printf("Creating new webhook for %s/%s at %s", owner, repo, webhookURL)
 	}
 
@@ -254,18 +290,24 @@ func SetupGitHubWebhook(repoFullName, githubToken string) error {
 		return fmt.Errorf("failed to register GitHub webhook: %w", err)
 	}
 
-	log.Printf("GitHub webhook successfully configured for %s/%s.", repoFullName)
+	log.Printf("GitHub webhook successfully configured for %s.", repoFullName)
 	return nil
 }
 
-// WebhookHandler handles incoming Git webhooks
+// WebhookHandler handles incoming webhooks of GitHub, GitLab, Gitea and Forgejo
 func WebhookHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	payload, err := ioutil.ReadAll(r.Body)
+	payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookPayload))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		log.Printf("Rejecting webhook payload larger than %d bytes", tooLarge.Limit)
+		http.Error(w, "Payload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
 	if err != nil {
 		log.Printf("Error reading webhook payload: %v", err)
 		http.Error(w, "Error reading payload", http.StatusBadRequest)
@@ -273,172 +315,239 @@ func WebhookHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	eventType := r.Header.Get("X-GitHub-Event") // For GitHub
-	log.Printf("Received webhook event of type: %s", eventType)
+	provider, eventType := providerFor(r.Header)
+	if provider == nil {
+		log.Printf("Rejecting webhook delivery without a GitHub, GitLab or Gitea event header")
+		http.Error(w, "Unknown webhook provider", http.StatusBadRequest)
+		return
+	}
+	log.Printf("Received %s webhook event of type: %s", provider.name(), eventType)
 
-	switch eventType {
-	case "push":
-		var pushEvent PushEvent
-		if err := json.Unmarshal(payload, &pushEvent); err != nil {
-			log.Printf("Error unmarshalling push event: %v", err)
-			log.Printf("Payload content: %s", string(payload)) // Log the full payload for debugging
-			http.Error(w, "Error unmarshalling push event", http.StatusBadRequest)
-			return
+	// Only deliveries sent with the repository's webhook secret are accepted
+	repoFullName, err := provider.repoName(payload)
+	if err == nil {
+		var secret string
+		if secret, err = webhookSecret(repoFullName); err == nil {
+			err = provider.verify(r.Header, payload, secret)
 		}
+	}
+	if err != nil {
+		log.Printf("Rejecting webhook delivery for '%s': %v", repoFullName, err)
+		http.Error(w, "Invalid webhook signature", http.StatusUnauthorized)
+		return
+	}
 
-		// Use clone_url for cloning as it's the most reliable URL for git operations
-		repoURL := pushEvent.Repository.CloneURL
-		fullRef := pushEvent.Ref
-		log.Printf("Received push event for: %s on branch: %s", repoURL, fullRef)
+	event, ignored, err := provider.parse(eventType, payload)
+	if err != nil {
+		log.Printf("Error parsing %s event: %v", eventType, err)
+		log.Printf("Payload starts with: %s", truncate(payload, maxLoggedPayload))
+		http.Error(w, "Error parsing webhook event", http.StatusBadRequest)
+		return
+	}
+	if event == nil {
+		log.Printf("Ignoring %s webhook event '%s': %s", provider.name(), eventType, ignored)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
 
-		// Check if it's a delete event (e.g., branch deleted)
-		if pushEvent.Deleted {
-			log.Printf("Ignoring deleted ref: %s", fullRef)
+	if event.Name == "push" {
+		log.Printf("Received push event for: %s on ref: %s", event.CloneURL, event.Ref)
+		if event.Deleted { // e.g. a branch was deleted
+			log.Printf("Ignoring deleted ref: %s", event.Ref)
 			w.WriteHeader(http.StatusOK)
-			fmt.Println("Webhook received and processed (ref deleted)")
 			return
 		}
+		if event.CloneURL == "" || event.Ref == "" {
+			http.Error(w, "Push event is missing the repository's clone URL or the ref", http.StatusBadRequest)
+			return
+		}
+		if !strings.HasPrefix(event.Ref, "refs/heads/") && !strings.HasPrefix(event.Ref, "refs/tags/") {
+			log.Printf("Ignoring ref that is neither a branch nor a tag: %s", event.Ref)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+	} else {
+		if event.CloneURL == "" || event.PRNumber == 0 {
+			http.Error(w, "Pull request event is missing the repository's clone URL or the number", http.StatusBadRequest)
+			return
+		}
+		log.Printf("Received pull request event (%s) for %s#%d: %s into %s", event.Action, event.RepoName, event.PRNumber, event.HeadBranch, event.BaseBranch)
+		if event.FromFork {
+			log.Printf("Pull request %s#%d comes from fork '%s'; its run gets no secrets or stored token", event.RepoName, event.PRNumber, event.HeadRepo)
+		}
+	}
 
-		if repoURL != "" && fullRef != "" {
-			if err := cloneRepo(repoURL, fullRef); err != nil { // cloneRepo handles branch extraction
-				log.Printf("Error cloning repository: %v", err)
-				http.Error(w, "Failed to clone repository", http.StatusInternalServerError)
-				return
-			}
+	// Whether the event matches the pipeline's `on:` triggers is decided once
+	// its .ci.yaml is cloned; runs that don't match are recorded as skipped,
+	// with the reason. The build itself runs on the worker pool, as providers
+	// only wait a few seconds for a response.
+	//
+	// Providers redeliver with the same delivery ID; never run the same
+	// delivery twice. The delivery is only recorded once it is about to
+	// start a run, and forgotten if it cannot, so a redelivery can retry.
+	deliveryID := provider.deliveryID(r.Header)
+	if deliveryID == "" {
+		log.Printf("Warning: %s webhook delivery for %s has no delivery ID", provider.name(), repoFullName)
+	} else {
+		isNew, err := storage.RecordDelivery(deliveryID, eventType, repoFullName)
+		if errors.Is(err, storage.ErrInvalidDeliveryID) {
+			log.Printf("Rejecting webhook delivery for %s: %v", repoFullName, err)
+			http.Error(w, "Invalid delivery", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Printf("Error recording webhook delivery %s: %v", deliveryID, err)
+			http.Error(w, "Failed to record delivery", http.StatusInternalServerError)
+			return
+		}
+		if !isNew {
+			log.Printf("Ignoring duplicate webhook delivery %s", deliveryID)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+	}
 
-			cfg, err := config.LoadConfig("temp_repo/.ci.yaml")
-			if err != nil {
-				log.Printf("Error loading .ci.yaml: %v", err)
-				http.Error(w, "Failed to load .ci.yaml", http.StatusInternalServerError)
-				return
+	run := event.newRun(provider.name(), deliveryID)
+	if err := enqueueRun(run); err != nil {
+		log.Printf("Error queueing run for %s: %v", run.RepoName, err)
+		if deliveryID != "" {
+			if err := storage.ForgetDelivery(deliveryID); err != nil {
+				log.Printf("Warning: %v; a redelivery of %s will be ignored", err, deliveryID)
 			}
+		}
+		http.Error(w, "Failed to queue run", http.StatusServiceUnavailable)
+		return
+	}
 
-			jobResults, err := pipeline.ExecutePipeline(*cfg) // ExecutePipeline returns map[string]types.JobResult
-			if err != nil {
-				log.Printf("Pipeline execution failed: %v", err)
-				http.Error(w, "Pipeline execution failed", http.StatusInternalServerError)
-				return
-			}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"run_id": run.ID, "status": run.Status})
+}
 
-			// Extract new metadata from pushEvent
-			repoName := pushEvent.Repository.FullName
-			branch := strings.TrimPrefix(fullRef, "refs/heads/") // "refs/heads/main" -> "main"
-			commitSHA := ""
-			commitMsg := ""
-			commitAuthor := ""
-			if pushEvent.HeadCommit != nil {
-				commitSHA = pushEvent.HeadCommit.ID
-				commitMsg = pushEvent.HeadCommit.Message
-				commitAuthor = pushEvent.HeadCommit.Author.Name
-			}
-			triggeredBy := pushEvent.Sender.Login
-
-			// Call StoreRun with the new metadata fields
-			if err := storage.StoreRun(
-				cfg,
-				jobResults,
-				repoName,
-				branch,
-				commitSHA,
-				commitMsg,
-				commitAuthor,
-				triggeredBy,
-			); err != nil {
-				log.Printf("Error storing run results: %v", err)
-				http.Error(w, "Failed to store run results", http.StatusInternalServerError)
-				return
-			}
+// maxWebhookPayload is the largest webhook payload that is read; larger
+// requests are rejected before they are verified.
+const maxWebhookPayload = 5 << 20
+
+// maxLoggedPayload is how much of a payload that fails to parse is logged.
+const maxLoggedPayload = 512
+
+// truncate returns at most n bytes of payload, marking where it was cut.
+func truncate(payload []byte, n int) string {
+	if len(payload) <= n {
+		return string(payload)
+	}
+	return fmt.Sprintf("%s... (%d bytes)", payload[:n], len(payload))
+}
+
+// maxPushCommits is the most commits GitHub lists in a push event; longer
+// pushes are truncated.
+const maxPushCommits = 2048
 
-			storage.DisplayRunResults(jobResults) // Display in CLI output
+// changedFiles returns the paths added, modified or removed by the commits of
+// a push, or nil if the push does not list them all.
+func changedFiles(commits []Commit) []string {
+	if len(commits) == 0 || len(commits) >= maxPushCommits {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var files []string
+	for _, commit := range commits {
+		for _, list := range [][]string{commit.Added, commit.Modified, commit.Removed} {
+			for _, file := range list {
+				if !seen[file] {
+					seen[file] = true
+					files = append(files, file)
+				}
+			}
 		}
-	case "ping":
-		fmt.Println("Received ping event. Responding with OK.")
-		w.WriteHeader(http.StatusOK)
-		return
-	default:
-		fmt.Printf("Received unhandled webhook event: %s\n", eventType)
-		w.WriteHeader(http.StatusOK)
-		return
 	}
+	return files
+}
+
+// refName returns the branch or tag name of a full ref.
+func refName(fullRef string) string {
+	if tag, ok := strings.CutPrefix(fullRef, "refs/tags/"); ok {
+		return tag
+	}
+	return strings.TrimPrefix(fullRef, "refs/heads/")
+}
 
-	w.WriteHeader(http.StatusOK)
-	fmt.Println("Webhook received and processed")
+// isMergeRef reports whether fullRef is the merge ref of a GitHub pull
+// request, which GitHub recomputes whenever the head or base branch moves.
+func isMergeRef(fullRef string) bool {
+	return strings.HasPrefix(fullRef, "refs/pull/") && strings.HasSuffix(fullRef, "/merge")
 }
 
-// cloneRepo clones the Git repository
-func cloneRepo(repoURL string, fullRef string) error {
-	if _, err := os.Stat("temp_repo"); !os.IsNotExist(err) {
-		log.Println("Removing existing temp_repo directory")
-		if err := os.RemoveAll("temp_repo"); err != nil {
-			return fmt.Errorf("failed to remove existing temp_repo: %w", err)
+// cloneRepo clones the Git repository into destDir, the run's workspace, and
+// checks out fullRef. The stored token of repoName is only used if
+// useStoredAuth is set; runs of untrusted code, such as pull requests from
+// forks, must not get it.
+func cloneRepo(repoURL, repoName, fullRef, destDir string, useStoredAuth bool) error {
+	if entries, err := os.ReadDir(destDir); err == nil && len(entries) > 0 {
+		log.Printf("Removing existing contents of %s", destDir)
+		if err := os.RemoveAll(destDir); err != nil {
+			return fmt.Errorf("failed to clean workspace %s: %w", destDir, err)
 		}
 	}
 
-	var branch string
-	parts := strings.Split(fullRef, "/")
-	if len(parts) > 2 && parts[1] == "heads" {
-		branch = parts[2]
-	} else if len(parts) > 0 && parts[0] == "refs" && len(parts) > 2 && parts[1] == "tags" {
-		log.Printf("Ignoring tag ref for cloning: %s", fullRef)
-		return fmt.Errorf("tag ref received, not cloning: %s", fullRef)
+	// `git clone -b` takes a branch or a tag name; other refs, such as the refs
+	// of pull and merge requests, are fetched after cloning the default branch
+	var branch, fetchRef string
+	if strings.HasPrefix(fullRef, "refs/heads/") || strings.HasPrefix(fullRef, "refs/tags/") {
+		branch = refName(fullRef)
+	} else if strings.HasPrefix(fullRef, "refs/") {
+		fetchRef = fullRef
 	} else {
 		log.Printf("Warning: Could not extract branch name from ref '%s', defaulting to 'main'", fullRef)
 		branch = "main"
 	}
 
-	// --- NEW: Handle private repository authentication ---
-	// Extract owner/repo name from cloneURL for auth lookup
-	// e.g., "https://github.com/owner/repo.git" -> "owner/repo"
-	repoFullName := ""
-	if strings.HasPrefix(repoURL, "https://github.com/") {
-		trimmed := strings.TrimPrefix(repoURL, "https://github.com/")
-		trimmed = strings.TrimSuffix(trimmed, ".git")
-		repoFullName = trimmed
-	} else {
-		// Handle other git providers/protocols if necessary
-		log.Printf("Warning: Unsupported repository URL format for automatic authentication: %s. Proceeding without stored PAT.", repoURL)
+	var token string
+	if !useStoredAuth {
+		log.Printf("Cloning %s without stored authentication", redact(repoURL, repoURL, ""))
+	} else if token = storedToken(repoURL, repoName); token != "" {
+		log.Printf("Using stored token for cloning %s", repoName)
 	}
 
-	auth := &storage.RepoAuth{} // Initialize auth to nil or default
-	if repoFullName != "" {
-		var err error
-		auth, err = storage.GetRepoAuth(repoFullName)
-		if err != nil {
-			log.Printf("No stored authentication found for %s: %v. Attempting to clone without token (might fail for private repos).", repoFullName, err)
-			// If no auth found, proceed without it; git will prompt or fail
-		}
+	cloneCmdArgs := []string{"clone"}
+	if branch != "" {
+		cloneCmdArgs = append(cloneCmdArgs, "-b", branch)
 	}
+	cloneCmdArgs = append(cloneCmdArgs, repoURL, destDir)
 
-	cloneCmdArgs := []string{"clone", "-b", branch}
-	finalRepoURL := repoURL
-
-	if auth != nil && auth.GithubToken != "" {
-		// For HTTPS, embed the token directly into the URL
-		// Format: https://oauth2:<token>@github.com/owner/repo.git
-		if strings.HasPrefix(repoURL, "https://github.com/") {
-			finalRepoURL = fmt.Sprintf("https://oauth2:%s@%s", auth.GithubToken, strings.TrimPrefix(repoURL, "https://"))
-			log.Printf("Using stored GitHub PAT for cloning %s", repoFullName)
-		} else {
-			log.Printf("Warning: Stored PAT is for GitHub, but repoURL is not GitHub HTTPS: %s. Proceeding without embedding token.", repoURL)
-		}
-	}
-
-	cloneCmdArgs = append(cloneCmdArgs, finalRepoURL, "temp_repo")
-
-	cmd := exec.Command("git", cloneCmdArgs...) // Use the slice of arguments
-	log.Printf("Executing: git %s", strings.Join(cloneCmdArgs, " "))
+	// The token is handed to git by a credential helper, so it is neither in
+	// the arguments nor in the clone's config, where pipeline steps could read it
+	cmd := gitCommand(context.Background(), repoURL, token, cloneCmdArgs...)
+	log.Printf("Executing: git %s", redact(strings.Join(cloneCmdArgs, " "), repoURL, token))
 
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		log.Printf("git clone error: %v, output: %s", err, string(output))
-		return fmt.Errorf("git clone failed: %w, output: %s", err, string(output))
+		log.Printf("git clone error: %v, output: %s", err, redact(string(output), repoURL, token))
+		return fmt.Errorf("git clone failed: %w, output: %s", err, redact(string(output), repoURL, token))
+	}
+	log.Printf("git clone output: %s", redact(string(output), repoURL, token))
+
+	if fetchRef != "" {
+		fetchCmd := gitCommand(context.Background(), repoURL, token, "fetch", "origin", fetchRef)
+		fetchCmd.Dir = destDir
+		if output, err := fetchCmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("git fetch of %s failed: %w, output: %s", fetchRef, err, redact(string(output), repoURL, token))
+		}
+		if err := CheckoutCommit(destDir, "FETCH_HEAD"); err != nil {
+			return err
+		}
+		log.Printf("Checked out %s", fetchRef)
 	}
-	log.Printf("git clone output: %s", string(output))
 	return nil
 }
 
-// StartWebhookListener starts the HTTP server to listen for webhooks
-func StartWebhookListener() error {
+// StartWebhookListener starts the run queue with the given number of workers,
+// the scheduler, the socket for post-receive hooks and the HTTP server to
+// listen for webhooks
+func StartWebhookListener(workers int) error {
+	StartRunQueue(workers)
+	schedule.Start(queueScheduledRun)
+	startHookSocket()
 	http.HandleFunc("/webhook", WebhookHandler)
 	port := ":8080"
 	fmt.Printf("Listening for webhooks on port %s...\n", port)
@@ -481,6 +590,18 @@ func GetCurrentCommit(repoDir string) (string, error) {
 	return strings.TrimSpace(string(output)), nil
 }
 
+// GetMergeHead returns the second parent of the checked-out merge commit,
+// the head of the merged branch.
+func GetMergeHead(repoDir string) (string, error) {
+	cmd := exec.Command("git", "rev-parse", "HEAD^2")
+	cmd.Dir = repoDir
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to get head of merge commit: %w", err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
 func GetCurrentBranch(repoDir string) (string, error) {
 	cmd := exec.Command("git", "rev-parse", "--abbrev-ref", "HEAD")
 	cmd.Dir = repoDir
@@ -0,0 +1,127 @@
+package git
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"snap-ci/types"
+)
+
+// giteaProvider handles deliveries of Gitea and Forgejo webhooks, signed
+// with X-Gitea-Signature. Their payloads follow GitHub's.
+type giteaProvider struct{}
+
+// giteaPullRequestActions are the pull_request actions that start a run.
+var giteaPullRequestActions = map[string]bool{"opened": true, "synchronized": true, "reopened": true}
+
+func (giteaProvider) name() string { return types.ProviderGitea }
+
+// Forgejo sends its own headers besides Gitea's, or instead of them in
+// later versions
+func (giteaProvider) eventType(header http.Header) string {
+	return firstHeader(header, "X-Gitea-Event", "X-Forgejo-Event")
+}
+
+func (giteaProvider) deliveryID(header http.Header) string {
+	return firstHeader(header, "X-Gitea-Delivery", "X-Forgejo-Delivery")
+}
+
+func (giteaProvider) repoName(payload []byte) (string, error) {
+	var envelope struct {
+		Repository Repository `json:"repository"`
+	}
+	if err := json.Unmarshal(payload, &envelope); err != nil {
+		return "", fmt.Errorf("failed to parse payload: %w", err)
+	}
+	if envelope.Repository.HTMLURL == "" {
+		return "", nil
+	}
+	return hostedRepoName(envelope.Repository.HTMLURL)
+}
+
+func (giteaProvider) verify(header http.Header, payload []byte, secret string) error {
+	signature := firstHeader(header, "X-Gitea-Signature", "X-Forgejo-Signature")
+	if signature == "" {
+		return fmt.Errorf("missing X-Gitea-Signature header")
+	}
+	return verifyHMAC(payload, secret, signature)
+}
+
+func (giteaProvider) parse(eventType string, payload []byte) (*webhookEvent, string, error) {
+	switch eventType {
+	case "push":
+		var pushEvent struct {
+			PushEvent
+			TotalCommits int `json:"total_commits"` // Commits lists only the most recent ones
+		}
+		if err := json.Unmarshal(payload, &pushEvent); err != nil {
+			return nil, "", fmt.Errorf("failed to parse push event: %w", err)
+		}
+		repoName, err := hostedRepoName(pushEvent.Repository.HTMLURL)
+		if err != nil {
+			return nil, "", err
+		}
+		event := &webhookEvent{
+			Name:          eventType,
+			RepoName:      repoName,
+			CloneURL:      pushEvent.Repository.CloneURL,
+			DefaultBranch: pushEvent.Repository.DefaultBranch,
+			Ref:           pushEvent.Ref,
+			Deleted:       isZeroSHA(pushEvent.After),
+			Sender:        pushEvent.Sender.Login,
+			CommitSHA:     pushEvent.After,
+		}
+		if pushEvent.HeadCommit != nil {
+			event.CommitMsg = pushEvent.HeadCommit.Message
+			event.CommitAuthor = pushEvent.HeadCommit.Author.Name
+		}
+		if pushEvent.TotalCommits <= len(pushEvent.Commits) {
+			event.ChangedFiles = changedFiles(pushEvent.Commits)
+		}
+		return event, "", nil
+	case "pull_request":
+		var prEvent PullRequestEvent
+		if err := json.Unmarshal(payload, &prEvent); err != nil {
+			return nil, "", fmt.Errorf("failed to parse pull_request event: %w", err)
+		}
+		if !giteaPullRequestActions[prEvent.Action] {
+			return nil, fmt.Sprintf("pull request action '%s' does not start runs", prEvent.Action), nil
+		}
+		repoName, err := hostedRepoName(prEvent.Repository.HTMLURL)
+		if err != nil {
+			return nil, "", err
+		}
+		pr := prEvent.PullRequest
+		headRepo := ""
+		if pr.Head.Repo != nil && pr.Head.Repo.HTMLURL != "" {
+			headRepo, _ = hostedRepoName(pr.Head.Repo.HTMLURL)
+		}
+		return &webhookEvent{
+			Name:          eventType,
+			Action:        prEvent.Action,
+			RepoName:      repoName,
+			CloneURL:      prEvent.Repository.CloneURL,
+			DefaultBranch: prEvent.Repository.DefaultBranch,
+			Ref:           fmt.Sprintf("refs/pull/%d/head", pr.Number), // Gitea keeps no merge ref
+			Sender:        prEvent.Sender.Login,
+			CommitSHA:     pr.Head.SHA,
+			PRNumber:      pr.Number,
+			HeadBranch:    pr.Head.Ref,
+			BaseBranch:    pr.Base.Ref,
+			HeadRepo:      headRepo,
+			HeadSHA:       pr.Head.SHA,
+			FromFork:      headRepo != repoName, // Including PRs whose head repository was deleted
+		}, "", nil
+	}
+	return nil, fmt.Sprintf("unhandled event '%s'", eventType), nil
+}
+
+func firstHeader(header http.Header, names ...string) string {
+	for _, name := range names {
+		if value := header.Get(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,106 @@
+package git
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"snap-ci/types"
+)
+
+// githubProvider handles deliveries of GitHub webhooks, signed with
+// X-Hub-Signature-256.
+type githubProvider struct{}
+
+func (githubProvider) name() string { return types.ProviderGitHub }
+
+func (githubProvider) eventType(header http.Header) string {
+	return header.Get("X-GitHub-Event")
+}
+
+// GitHub redelivers with the same delivery ID
+func (githubProvider) deliveryID(header http.Header) string {
+	return header.Get("X-GitHub-Delivery")
+}
+
+func (githubProvider) repoName(payload []byte) (string, error) {
+	var envelope struct {
+		Repository struct {
+			FullName string `json:"full_name"`
+		} `json:"repository"`
+	}
+	if err := json.Unmarshal(payload, &envelope); err != nil {
+		return "", fmt.Errorf("failed to parse payload: %w", err)
+	}
+	return envelope.Repository.FullName, nil
+}
+
+func (githubProvider) verify(header http.Header, payload []byte, secret string) error {
+	signature := header.Get("X-Hub-Signature-256")
+	if signature == "" {
+		return fmt.Errorf("missing X-Hub-Signature-256 header")
+	}
+	if !strings.HasPrefix(signature, "sha256=") {
+		return fmt.Errorf("malformed X-Hub-Signature-256 header")
+	}
+	return verifyHMAC(payload, secret, strings.TrimPrefix(signature, "sha256="))
+}
+
+func (githubProvider) parse(eventType string, payload []byte) (*webhookEvent, string, error) {
+	switch eventType {
+	case "push":
+		var pushEvent PushEvent
+		if err := json.Unmarshal(payload, &pushEvent); err != nil {
+			return nil, "", fmt.Errorf("failed to parse push event: %w", err)
+		}
+		event := &webhookEvent{
+			Name:          eventType,
+			RepoName:      pushEvent.Repository.FullName,
+			CloneURL:      pushEvent.Repository.CloneURL, // The most reliable URL for git operations
+			DefaultBranch: pushEvent.Repository.DefaultBranch,
+			Ref:           pushEvent.Ref,
+			Deleted:       pushEvent.Deleted,
+			Sender:        pushEvent.Sender.Login,
+			ChangedFiles:  changedFiles(pushEvent.Commits),
+		}
+		if pushEvent.HeadCommit != nil {
+			event.CommitSHA = pushEvent.HeadCommit.ID
+			event.CommitMsg = pushEvent.HeadCommit.Message
+			event.CommitAuthor = pushEvent.HeadCommit.Author.Name
+		}
+		return event, "", nil
+	case "pull_request":
+		var prEvent PullRequestEvent
+		if err := json.Unmarshal(payload, &prEvent); err != nil {
+			return nil, "", fmt.Errorf("failed to parse pull_request event: %w", err)
+		}
+		if !pullRequestActions[prEvent.Action] {
+			return nil, fmt.Sprintf("pull request action '%s' does not start runs", prEvent.Action), nil
+		}
+		pr := prEvent.PullRequest
+		headRepo := ""
+		if pr.Head.Repo != nil {
+			headRepo = pr.Head.Repo.FullName
+		}
+		repoName := prEvent.Repository.FullName
+		return &webhookEvent{
+			Name:          eventType,
+			Action:        prEvent.Action,
+			RepoName:      repoName,
+			CloneURL:      prEvent.Repository.CloneURL, // The merge ref lives in the base repository, also for PRs from forks
+			DefaultBranch: prEvent.Repository.DefaultBranch,
+			Ref:           fmt.Sprintf("refs/pull/%d/merge", pr.Number), // The PR merged into its base branch
+			Sender:        prEvent.Sender.Login,
+			PRNumber:      pr.Number,
+			HeadBranch:    pr.Head.Ref,
+			BaseBranch:    pr.Base.Ref,
+			HeadRepo:      headRepo,
+			HeadSHA:       pr.Head.SHA,
+			FromFork:      headRepo != repoName, // Including PRs whose head repository was deleted
+		}, "", nil
+	case "ping":
+		return nil, "ping", nil
+	}
+	return nil, fmt.Sprintf("unhandled event '%s'", eventType), nil
+}
@@ -0,0 +1,168 @@
+package git
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"snap-ci/types"
+)
+
+// gitlabProvider handles deliveries of GitLab webhooks, which carry the
+// webhook's secret token in X-Gitlab-Token instead of a signature.
+type gitlabProvider struct{}
+
+// GitLabProject is the project of a GitLab webhook payload.
+type GitLabProject struct {
+	ID                int64  `json:"id"`
+	PathWithNamespace string `json:"path_with_namespace"`
+	WebURL            string `json:"web_url"`
+	GitHTTPURL        string `json:"git_http_url"`
+	DefaultBranch     string `json:"default_branch"`
+}
+
+// GitLabPushEvent holds the fields of a GitLab push or tag push event that snapci uses.
+type GitLabPushEvent struct {
+	Ref               string        `json:"ref"`
+	After             string        `json:"after"`
+	CheckoutSHA       *string       `json:"checkout_sha"` // The commit a tag points to; null for deleted refs
+	UserUsername      string        `json:"user_username"`
+	Project           GitLabProject `json:"project"`
+	Commits           []Commit      `json:"commits"` // At most 20, the most recent ones
+	TotalCommitsCount int           `json:"total_commits_count"`
+}
+
+// GitLabMergeRequestEvent holds the fields of a GitLab merge request event that snapci uses.
+type GitLabMergeRequestEvent struct {
+	User struct {
+		Username string `json:"username"`
+	} `json:"user"`
+	Project          GitLabProject `json:"project"` // The target project
+	ObjectAttributes struct {
+		IID             int           `json:"iid"`
+		Action          string        `json:"action"` // e.g. "open", "update", "merge"
+		OldRev          string        `json:"oldrev"` // Set on updates that pushed commits
+		SourceBranch    string        `json:"source_branch"`
+		TargetBranch    string        `json:"target_branch"`
+		SourceProjectID int64         `json:"source_project_id"`
+		TargetProjectID int64         `json:"target_project_id"`
+		Source          GitLabProject `json:"source"`
+		LastCommit      Commit        `json:"last_commit"`
+	} `json:"object_attributes"`
+}
+
+// gitlabMergeRequestActions are the merge request actions that may start a
+// run; "update" only does if it pushed commits.
+var gitlabMergeRequestActions = map[string]bool{"open": true, "reopen": true, "update": true}
+
+func (gitlabProvider) name() string { return types.ProviderGitLab }
+
+func (gitlabProvider) eventType(header http.Header) string {
+	return header.Get("X-Gitlab-Event")
+}
+
+// GitLab sends the same Idempotency-Key when it retries a delivery; older
+// versions only identify each attempt with X-Gitlab-Event-UUID
+func (gitlabProvider) deliveryID(header http.Header) string {
+	if key := header.Get("Idempotency-Key"); key != "" {
+		return key
+	}
+	return header.Get("X-Gitlab-Event-UUID")
+}
+
+func (gitlabProvider) repoName(payload []byte) (string, error) {
+	var envelope struct {
+		Project GitLabProject `json:"project"`
+	}
+	if err := json.Unmarshal(payload, &envelope); err != nil {
+		return "", fmt.Errorf("failed to parse payload: %w", err)
+	}
+	if envelope.Project.WebURL == "" {
+		return "", nil
+	}
+	return hostedRepoName(envelope.Project.WebURL)
+}
+
+func (gitlabProvider) verify(header http.Header, payload []byte, secret string) error {
+	token := header.Get("X-Gitlab-Token")
+	if token == "" {
+		return fmt.Errorf("missing X-Gitlab-Token header")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+		return fmt.Errorf("secret token mismatch")
+	}
+	return nil
+}
+
+func (gitlabProvider) parse(eventType string, payload []byte) (*webhookEvent, string, error) {
+	switch eventType {
+	case "Push Hook", "Tag Push Hook":
+		var pushEvent GitLabPushEvent
+		if err := json.Unmarshal(payload, &pushEvent); err != nil {
+			return nil, "", fmt.Errorf("failed to parse push event: %w", err)
+		}
+		repoName, err := hostedRepoName(pushEvent.Project.WebURL)
+		if err != nil {
+			return nil, "", err
+		}
+		event := &webhookEvent{
+			Name:          "push",
+			RepoName:      repoName,
+			CloneURL:      pushEvent.Project.GitHTTPURL,
+			DefaultBranch: pushEvent.Project.DefaultBranch,
+			Ref:           pushEvent.Ref,
+			Deleted:       isZeroSHA(pushEvent.After),
+			Sender:        pushEvent.UserUsername,
+			CommitSHA:     pushEvent.After,
+		}
+		if pushEvent.CheckoutSHA != nil {
+			event.CommitSHA = *pushEvent.CheckoutSHA // Not the tag object of an annotated tag
+		}
+		for _, commit := range pushEvent.Commits {
+			if commit.ID == event.CommitSHA {
+				event.CommitMsg, event.CommitAuthor = commit.Message, commit.Author.Name
+			}
+		}
+		if pushEvent.TotalCommitsCount <= len(pushEvent.Commits) {
+			event.ChangedFiles = changedFiles(pushEvent.Commits)
+		}
+		return event, "", nil
+	case "Merge Request Hook":
+		var mrEvent GitLabMergeRequestEvent
+		if err := json.Unmarshal(payload, &mrEvent); err != nil {
+			return nil, "", fmt.Errorf("failed to parse merge request event: %w", err)
+		}
+		mr := mrEvent.ObjectAttributes
+		if !gitlabMergeRequestActions[mr.Action] || (mr.Action == "update" && mr.OldRev == "") {
+			return nil, fmt.Sprintf("merge request action '%s' does not start runs", mr.Action), nil
+		}
+		repoName, err := hostedRepoName(mrEvent.Project.WebURL)
+		if err != nil {
+			return nil, "", err
+		}
+		headRepo := ""
+		if mr.Source.WebURL != "" {
+			headRepo, _ = hostedRepoName(mr.Source.WebURL)
+		}
+		return &webhookEvent{
+			Name:          "pull_request",
+			Action:        mr.Action,
+			RepoName:      repoName,
+			CloneURL:      mrEvent.Project.GitHTTPURL, // The target project also has the refs of merge requests from forks
+			DefaultBranch: mrEvent.Project.DefaultBranch,
+			Ref:           fmt.Sprintf("refs/merge-requests/%d/head", mr.IID),
+			Sender:        mrEvent.User.Username,
+			CommitSHA:     mr.LastCommit.ID,
+			CommitMsg:     mr.LastCommit.Message,
+			CommitAuthor:  mr.LastCommit.Author.Name,
+			PRNumber:      mr.IID,
+			HeadBranch:    mr.SourceBranch,
+			BaseBranch:    mr.TargetBranch,
+			HeadRepo:      headRepo,
+			HeadSHA:       mr.LastCommit.ID,
+			FromFork:      mr.SourceProjectID != mr.TargetProjectID,
+		}, "", nil
+	}
+	return nil, fmt.Sprintf("unhandled event '%s'", eventType), nil
+}
@@ -0,0 +1,260 @@
+package git
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"snap-ci/hook"
+	"snap-ci/storage"
+	"snap-ci/types"
+)
+
+// DefaultHookSocket is the Unix socket on which servers accept pushes from
+// post-receive hooks when not configured.
+const DefaultHookSocket = "snapci.sock"
+
+// hookDialTimeout bounds how long a post-receive hook waits for the server,
+// so a push never hangs on a server that is stuck.
+const hookDialTimeout = 10 * time.Second
+
+var (
+	hookSocketMu sync.Mutex
+	hookSocket   = DefaultHookSocket
+)
+
+// ConfigureHookSocket sets the path of the Unix socket for post-receive hooks.
+func ConfigureHookSocket(path string) {
+	if path == "" {
+		path = DefaultHookSocket
+	}
+	hookSocketMu.Lock()
+	defer hookSocketMu.Unlock()
+	hookSocket = path
+}
+
+func hookSocketPath() string {
+	hookSocketMu.Lock()
+	defer hookSocketMu.Unlock()
+	return hookSocket
+}
+
+// HookUpdate is a ref updated by a push to a local bare repository, as git
+// passes it to post-receive.
+type HookUpdate struct {
+	Path   string `json:"path"` // The bare repository
+	OldSHA string `json:"old_sha"`
+	NewSHA string `json:"new_sha"`
+	Ref    string `json:"ref"`
+	Pusher string `json:"pusher,omitempty"`
+}
+
+// hookResponse is the server's answer to a HookUpdate.
+type hookResponse struct {
+	RunID   string `json:"run_id,omitempty"`
+	Ignored string `json:"ignored,omitempty"` // Why the update does not start a run
+	Error   string `json:"error,omitempty"`
+}
+
+// ParseHookUpdates reads the input of a post-receive hook: one
+// "<old-sha> <new-sha> <ref>" line per updated ref.
+func ParseHookUpdates(r io.Reader, repoPath, pusher string) ([]HookUpdate, error) {
+	var updates []HookUpdate
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("unexpected post-receive input line: %q", scanner.Text())
+		}
+		updates = append(updates, HookUpdate{Path: repoPath, OldSHA: fields[0], NewSHA: fields[1], Ref: fields[2], Pusher: pusher})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read post-receive input: %w", err)
+	}
+	return updates, nil
+}
+
+// hookRun creates the run of an update to a repository with an installed
+// hook, or returns nil and the reason if the update does not start one.
+// Everything but the update itself is read from the repository, so a caller
+// of the hook socket cannot make up changed files or builds elsewhere.
+func hookRun(update HookUpdate) (*types.PipelineRun, string, error) {
+	repo, err := hook.Lookup(update.Path)
+	if err != nil {
+		return nil, "", err
+	}
+	if isZeroSHA(update.NewSHA) {
+		return nil, fmt.Sprintf("%s was deleted", update.Ref), nil
+	}
+	if !strings.HasPrefix(update.Ref, "refs/heads/") && !strings.HasPrefix(update.Ref, "refs/tags/") {
+		return nil, fmt.Sprintf("%s is neither a branch nor a tag", update.Ref), nil
+	}
+
+	// The commit an annotated tag points to, rather than the tag object
+	commitSHA, err := bareGit(repo.Path, "rev-parse", "--verify", "--end-of-options", update.NewSHA+"^{commit}")
+	if err != nil {
+		return nil, "", fmt.Errorf("unknown commit %s in %s: %w", update.NewSHA, repo.Path, err)
+	}
+	defaultBranch, err := bareGit(repo.Path, "symbolic-ref", "--short", "HEAD")
+	if err != nil {
+		log.Printf("Warning: Could not determine the default branch of %s: %v", repo.Path, err)
+	}
+	var files []string
+	if !isZeroSHA(update.OldSHA) && strings.HasPrefix(update.Ref, "refs/heads/") {
+		// New branches and tags list no changed files, like their webhook pushes
+		if diff, err := bareGit(repo.Path, "diff", "--name-only", "--end-of-options", update.OldSHA, commitSHA); err != nil {
+			log.Printf("Warning: Could not list the files changed by %s..%s in %s: %v", update.OldSHA, commitSHA, repo.Path, err)
+		} else if diff != "" {
+			files = strings.Split(diff, "\n")
+		}
+	}
+
+	pusher := update.Pusher
+	if pusher == "" {
+		pusher = "post-receive"
+	}
+	return &types.PipelineRun{
+		ID:            storage.NewRunID(),
+		RepoName:      repo.Name,
+		Branch:        refName(update.Ref),
+		CommitSHA:     commitSHA,
+		TriggeredBy:   pusher,
+		TriggerType:   "hook",
+		CloneURL:      repo.Path, // Cloned straight from the local repository
+		Ref:           update.Ref,
+		DefaultBranch: defaultBranch,
+		Event:         "push",
+		ChangedFiles:  files,
+		Results:       make(map[string]types.JobResult),
+	}, "", nil
+}
+
+// bareGit runs a git command against a bare repository and returns its
+// trimmed output.
+func bareGit(repoPath string, args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"--git-dir", repoPath}, args...)...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// RunHookUpdate builds an update in this process, like TriggerManualRun, for
+// hooks installed with --inline. The output goes to the pusher's terminal.
+func RunHookUpdate(update HookUpdate) error {
+	run, ignored, err := hookRun(update)
+	if err != nil {
+		return err
+	}
+	if run == nil {
+		log.Printf("Not building %s: %s", update.Ref, ignored)
+		return nil
+	}
+	return runInline(run)
+}
+
+// SendHookUpdate hands an update to the server listening on the hook socket
+// and returns the ID of the run it queued, or "" and the reason it did not
+// queue one.
+func SendHookUpdate(update HookUpdate) (string, string, error) {
+	socket := hookSocketPath()
+	conn, err := net.DialTimeout("unix", socket, hookDialTimeout)
+	if err != nil {
+		return "", "", fmt.Errorf("no snapci server is listening on %s: %w", socket, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(hookDialTimeout))
+
+	if err := json.NewEncoder(conn).Encode(update); err != nil {
+		return "", "", fmt.Errorf("failed to send update to %s: %w", socket, err)
+	}
+	var response hookResponse
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		return "", "", fmt.Errorf("failed to read the response of %s: %w", socket, err)
+	}
+	if response.Error != "" {
+		return "", "", errors.New(response.Error)
+	}
+	return response.RunID, response.Ignored, nil
+}
+
+// startHookSocket listens for updates from post-receive hooks and queues
+// their runs. A socket left behind by a server that exited is replaced; if
+// another server is listening, this one does without.
+func startHookSocket() {
+	socket := hookSocketPath()
+	if conn, err := net.DialTimeout("unix", socket, time.Second); err == nil {
+		conn.Close()
+		log.Printf("Warning: Another snapci server already listens for post-receive hooks on %s", socket)
+		return
+	}
+	if info, err := os.Lstat(socket); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			log.Printf("Warning: Not listening for post-receive hooks: %s exists and is not a socket", socket)
+			return
+		}
+		os.Remove(socket)
+	}
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		log.Printf("Warning: Not listening for post-receive hooks: %v", err)
+		return
+	}
+	// Hooks run as the pushing user, who needs write access, typically
+	// through a group shared with the snapci user
+	if err := os.Chmod(socket, 0660); err != nil {
+		log.Printf("Warning: Failed to set the permissions of %s: %v", socket, err)
+	}
+	log.Printf("Listening for post-receive hooks on %s", socket)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				log.Printf("Hook socket: %v", err)
+				return
+			}
+			go serveHookConn(conn)
+		}
+	}()
+}
+
+func serveHookConn(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(hookDialTimeout))
+
+	var update HookUpdate
+	var response hookResponse
+	if err := json.NewDecoder(conn).Decode(&update); err != nil {
+		response.Error = fmt.Sprintf("invalid update: %v", err)
+	} else if run, ignored, err := hookRun(update); err != nil {
+		response.Error = err.Error()
+	} else if run == nil {
+		response.Ignored = ignored
+	} else {
+		if err := enqueueRun(run); err != nil {
+			response.Error = fmt.Sprintf("failed to queue run: %v", err)
+		} else {
+			response.RunID = run.ID
+		}
+	}
+	if response.Error != "" {
+		log.Printf("Rejecting post-receive update of %s in %s: %s", update.Ref, update.Path, response.Error)
+	}
+	json.NewEncoder(conn).Encode(response)
+}
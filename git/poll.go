@@ -0,0 +1,166 @@
+package git
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"snap-ci/config"
+	"snap-ci/schedule"
+	"snap-ci/storage"
+	"snap-ci/types"
+	"snap-ci/watch"
+)
+
+// DefaultPollInterval is how often watched repositories are polled when not configured.
+const DefaultPollInterval = time.Minute
+
+// lsRemoteTimeout bounds a single `git ls-remote`, so one unreachable
+// repository cannot stall the polling of the others.
+const lsRemoteTimeout = time.Minute
+
+// StartWatcher starts the run queue with the given number of workers, the
+// scheduler and the socket for post-receive hooks, then polls the watched
+// repositories every interval until the process exits. It is the webhook
+// listener's counterpart for repositories that cannot send webhooks.
+func StartWatcher(workers int, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("poll interval must be positive, got %s", interval)
+	}
+	StartRunQueue(workers)
+	schedule.Start(queueScheduledRun)
+	startHookSocket()
+
+	fmt.Printf("Polling watched repositories every %s...\n", interval)
+	for {
+		repos, err := watch.List()
+		if err != nil {
+			log.Printf("Watcher: %v", err)
+		}
+		for _, repo := range repos {
+			pollRepo(repo)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// pollRepo queues a run for each watched branch of a repository whose head
+// changed since the last poll, including branches that were created. The
+// first poll of a repository only records its heads. A head is stored once
+// its run is queued, so a run that could not be queued is retried on the
+// next poll.
+func pollRepo(repo watch.Repo) {
+	heads, defaultBranch, err := lsRemote(repo.URL, repo.Name)
+	if err != nil {
+		log.Printf("Watcher: failed to poll %s: %v", repo.Name, err)
+		return
+	}
+	if defaultBranch == "" {
+		defaultBranch = "main"
+	}
+	patterns := repo.Branches
+	if len(patterns) == 0 {
+		patterns = []string{defaultBranch}
+	}
+
+	firstPoll := repo.Polled.IsZero()
+	for branch, sha := range heads {
+		if !config.MatchAnyGlob(patterns, branch) || repo.Heads[branch] == sha {
+			continue
+		}
+		if firstPoll {
+			log.Printf("Watcher: %s branch '%s' is at %s", repo.Name, branch, sha)
+		} else if err := queuePolledRun(repo, branch, sha, defaultBranch); err != nil {
+			log.Printf("Watcher: error queueing run for %s branch '%s': %v", repo.Name, branch, err)
+			continue
+		}
+		if err := watch.SetHead(repo.Name, branch, sha); err != nil {
+			log.Printf("Watcher: %v", err)
+		}
+	}
+	for branch := range repo.Heads {
+		if _, ok := heads[branch]; !ok || !config.MatchAnyGlob(patterns, branch) {
+			if err := watch.SetHead(repo.Name, branch, ""); err != nil { // Deleted, or no longer watched
+				log.Printf("Watcher: %v", err)
+			}
+		}
+	}
+	if err := watch.MarkPolled(repo.Name, time.Now()); err != nil {
+		log.Printf("Watcher: %v", err)
+	}
+}
+
+// queuePolledRun queues a run of a new branch head. Polled runs are push
+// events, so `on.push` filters apply, except for paths: the changed files
+// of a polled change are not known.
+func queuePolledRun(repo watch.Repo, branch, sha, defaultBranch string) error {
+	log.Printf("Watcher: %s branch '%s' moved from %s to %s", repo.Name, branch, shortSHA(repo.Heads[branch]), shortSHA(sha))
+	return enqueueRun(&types.PipelineRun{
+		ID:            storage.NewRunID(),
+		RepoName:      repo.Name,
+		Branch:        branch,
+		CommitSHA:     sha,
+		TriggeredBy:   "watcher",
+		TriggerType:   "poll",
+		CloneURL:      repo.URL,
+		Ref:           "refs/heads/" + branch,
+		DefaultBranch: defaultBranch,
+		Event:         "push",
+		Results:       make(map[string]types.JobResult),
+	})
+}
+
+// lsRemote returns the branch heads of a remote repository, and its default
+// branch if the remote reports it. The stored PAT of repoName is used for
+// HTTPS URLs.
+func lsRemote(repoURL, repoName string) (map[string]string, string, error) {
+	token := storedToken(repoURL, repoName)
+
+	ctx, cancel := context.WithTimeout(context.Background(), lsRemoteTimeout)
+	defer cancel()
+	cmd := gitCommand(ctx, repoURL, token, "ls-remote", "--symref", repoURL, "HEAD", "refs/heads/*")
+	if cmd.Env == nil {
+		cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0") // Fail instead of asking for credentials
+	}
+	output, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			err = fmt.Errorf("%w: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, "", fmt.Errorf("git ls-remote %s failed: %s", redact(repoURL, repoURL, ""), redact(err.Error(), repoURL, token))
+	}
+
+	heads := make(map[string]string)
+	var defaultBranch string
+	scanner := bufio.NewScanner(strings.NewReader(string(output)))
+	for scanner.Scan() {
+		// "ref: refs/heads/main\tHEAD" names the default branch; other lines are "<sha>\t<ref>"
+		value, ref, ok := strings.Cut(scanner.Text(), "\t")
+		if !ok {
+			continue
+		}
+		if target, isSymref := strings.CutPrefix(value, "ref: "); isSymref {
+			if ref == "HEAD" {
+				defaultBranch = strings.TrimPrefix(target, "refs/heads/")
+			}
+		} else if branch, isBranch := strings.CutPrefix(ref, "refs/heads/"); isBranch {
+			heads[branch] = value
+		}
+	}
+	return heads, defaultBranch, nil
+}
+
+func shortSHA(sha string) string {
+	if sha == "" {
+		return "(new branch)"
+	}
+	if len(sha) > 7 {
+		return sha[:7]
+	}
+	return sha
+}
@@ -0,0 +1,126 @@
+package git
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"snap-ci/storage"
+	"snap-ci/types"
+)
+
+// webhookEvent is a push or pull request delivered by any provider, in the
+// form runs are created from. GitLab merge requests are pull requests too.
+type webhookEvent struct {
+	Name          string // "push" or "pull_request", as matched against `on:`
+	Action        string // What happened to a pull request, in the provider's words
+	RepoName      string
+	CloneURL      string
+	DefaultBranch string
+	Ref           string // Full ref to build
+	Deleted       bool   // The pushed ref was deleted
+	Sender        string
+	CommitSHA     string
+	CommitMsg     string
+	CommitAuthor  string
+	ChangedFiles  []string // nil if unknown
+
+	// Pull requests only
+	PRNumber   int
+	HeadBranch string
+	BaseBranch string
+	HeadRepo   string
+	HeadSHA    string
+	FromFork   bool
+}
+
+// webhookProvider parses and authenticates the webhook deliveries of one
+// Git hosting provider.
+type webhookProvider interface {
+	name() string
+	// eventType returns the delivery's event type header, "" if the
+	// delivery does not come from this provider.
+	eventType(header http.Header) string
+	deliveryID(header http.Header) string
+	// repoName returns the name of the repository the payload is about,
+	// under which its webhook secret, token and secrets are stored.
+	repoName(payload []byte) (string, error)
+	// verify checks that the delivery was sent with the repository's secret.
+	verify(header http.Header, payload []byte, secret string) error
+	// parse returns the push or pull request of a delivery, or nil and the
+	// reason if the delivery does not start a run.
+	parse(eventType string, payload []byte) (*webhookEvent, string, error)
+}
+
+// webhookProviders are tried in order. Gitea and Forgejo also send GitHub's
+// event header, so they must be recognized first.
+var webhookProviders = []webhookProvider{giteaProvider{}, gitlabProvider{}, githubProvider{}}
+
+// providerFor returns the provider that sent a delivery and its event type.
+func providerFor(header http.Header) (webhookProvider, string) {
+	for _, p := range webhookProviders {
+		if eventType := p.eventType(header); eventType != "" {
+			return p, eventType
+		}
+	}
+	return nil, ""
+}
+
+// newRun creates the pending run of an event.
+func (e *webhookEvent) newRun(provider, deliveryID string) *types.PipelineRun {
+	run := &types.PipelineRun{
+		ID:            storage.NewRunID(),
+		RepoName:      e.RepoName,
+		Branch:        refName(e.Ref), // "refs/heads/main" -> "main", or the tag name for tags
+		CommitSHA:     e.CommitSHA,
+		CommitMsg:     e.CommitMsg,
+		CommitAuthor:  e.CommitAuthor,
+		TriggeredBy:   e.Sender,
+		TriggerType:   "webhook",
+		Provider:      provider,
+		CloneURL:      e.CloneURL,
+		Ref:           e.Ref,
+		DefaultBranch: e.DefaultBranch,
+		Event:         e.Name,
+		DeliveryID:    deliveryID,
+		ChangedFiles:  e.ChangedFiles,
+		Results:       make(map[string]types.JobResult),
+	}
+	if e.PRNumber != 0 {
+		run.Branch = e.HeadBranch
+		run.PRNumber = e.PRNumber
+		run.BaseBranch = e.BaseBranch
+		run.HeadRepo = e.HeadRepo
+		run.HeadSHA = e.HeadSHA
+		run.FromFork = e.FromFork
+	}
+	return run
+}
+
+// hostedRepoName names a repository hosted outside of GitHub by the host and
+// path of its web URL, e.g. "gitlab.example.com/group/project", so it cannot
+// be mistaken for a GitHub repository or one on another server.
+func hostedRepoName(webURL string) (string, error) {
+	u, err := url.Parse(webURL)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("invalid repository URL '%s'", webURL)
+	}
+	return u.Host + strings.TrimSuffix(u.Path, "/"), nil
+}
+
+// defaultCloneURL returns the HTTPS clone URL of a repository by name:
+// "host/path" names of repositories hosted outside of GitHub, see
+// hostedRepoName, or "owner/repo" names on GitHub.
+func defaultCloneURL(repoName string) string {
+	if host, _, ok := strings.Cut(repoName, "/"); ok && strings.Contains(host, ".") {
+		return fmt.Sprintf("https://%s.git", repoName)
+	}
+	return fmt.Sprintf("https://github.com/%s.git", repoName)
+}
+
+// isZeroSHA reports whether sha is the all-zero SHA that providers send as
+// the new head of a deleted ref.
+func isZeroSHA(sha string) bool {
+	return sha != "" && strings.Trim(sha, "0") == ""
+}
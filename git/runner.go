@@ -0,0 +1,338 @@
+package git
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"snap-ci/config"
+	"snap-ci/pipeline"
+	"snap-ci/queue"
+	"snap-ci/schedule"
+	"snap-ci/secrets"
+	"snap-ci/storage"
+	"snap-ci/types"
+	"snap-ci/workspace"
+)
+
+var (
+	runQueueMu sync.Mutex
+	runQueue   *queue.Queue
+)
+
+// StartRunQueue starts the worker pool that executes queued runs.
+// Calling it again after the queue is running has no effect.
+func StartRunQueue(workers int) {
+	runQueueMu.Lock()
+	defer runQueueMu.Unlock()
+	if runQueue != nil {
+		return
+	}
+	runQueue = queue.New(workers, queue.DefaultCapacity, processRun)
+	runQueue.Start()
+}
+
+// StopRunQueue stops accepting new runs and waits for queued runs to finish.
+func StopRunQueue() {
+	runQueueMu.Lock()
+	q := runQueue
+	runQueue = nil
+	runQueueMu.Unlock()
+	if q != nil {
+		q.Shutdown()
+	}
+}
+
+// enqueueRun records a run as pending and hands it to the worker pool.
+func enqueueRun(run *types.PipelineRun) error {
+	runQueueMu.Lock()
+	q := runQueue
+	runQueueMu.Unlock()
+	if q == nil {
+		return fmt.Errorf("run queue is not started")
+	}
+
+	run.Status = types.RunPending
+	run.QueuedAt = time.Now()
+	if err := storage.StoreRun(nil, run); err != nil {
+		return fmt.Errorf("failed to record pending run %s: %w", run.ID, err)
+	}
+
+	if err := q.Enqueue(run); err != nil {
+		failRun(run, nil, fmt.Errorf("could not be queued: %w", err))
+		return err
+	}
+	log.Printf("Run %s queued for %s (%s)", run.ID, run.RepoName, run.Ref)
+	return nil
+}
+
+// processRun executes a queued run: it clones the repository into the run's
+// workspace, loads .ci.yaml, executes the pipeline and records the outcome.
+func processRun(run *types.PipelineRun) {
+	defer storage.ClearCancelRequest(run.ID)
+	if request, err := storage.GetCancelRequest(run.ID); err != nil {
+		log.Printf("Warning: Failed to check run %s for a cancel request: %v", run.ID, err)
+	} else if request != nil {
+		cancelRun(run, nil, request) // Cancelled while still queued
+		return
+	}
+
+	run.Status = types.RunRunning
+	run.StartTime = time.Now()
+	if err := storage.StoreRun(nil, run); err != nil {
+		log.Printf("Warning: Failed to record run %s as running: %v", run.ID, err)
+	}
+
+	runLog, err := storage.OpenRunLog(run.ID)
+	if err != nil {
+		failRun(run, nil, err)
+		return
+	}
+	defer runLog.Close()
+
+	workDir, err := workspace.Create(run.ID)
+	if err != nil {
+		failRun(run, nil, err)
+		return
+	}
+	succeeded := false
+	defer func() { workspace.Cleanup(run.ID, succeeded) }()
+
+	if err := cloneRepo(run.CloneURL, run.RepoName, run.Ref, workDir, !run.FromFork); err != nil {
+		failRun(run, nil, fmt.Errorf("failed to clone repository: %w", err))
+		return
+	}
+	if err := resolveCommit(run, workDir); err != nil {
+		failRun(run, nil, err)
+		return
+	}
+
+	cfg, err := config.LoadConfig(filepath.Join(workDir, ".ci.yaml"))
+	if err != nil {
+		failRun(run, nil, fmt.Errorf("failed to load .ci.yaml: %w", err))
+		return
+	}
+	if err := schedule.Validate(cfg.On.Schedule); err != nil {
+		failRun(run, cfg, fmt.Errorf("invalid on.schedule in .ci.yaml: %w", err))
+		return
+	}
+	updateSchedules(run, cfg)
+
+	// Runs created by an event only go ahead if the pipeline's `on:` triggers match it
+	if run.Event != "" {
+		event := config.Event{Name: run.Event, Ref: run.Ref, Files: run.ChangedFiles}
+		if run.PRNumber != 0 {
+			event.Ref = "refs/heads/" + run.BaseBranch // Pull requests are filtered by the branch they target
+		}
+		if ok, reason := cfg.On.Match(event); !ok {
+			succeeded = true // Nothing in the workspace is worth keeping
+			skipRun(run, cfg, reason)
+			return
+		}
+	}
+	reportRunStatus(run, statePending, "Running")
+
+	// Code from a fork could print or send the secrets anywhere
+	var repoSecrets map[string]string
+	if run.FromFork {
+		log.Printf("Run %s builds a pull request from fork '%s'; not passing secrets", run.ID, run.HeadRepo)
+	} else if repoSecrets, err = secrets.Load(run.RepoName); err != nil {
+		failRun(run, cfg, fmt.Errorf("failed to load secrets: %w", err))
+		return
+	}
+
+	jobResults, request, err := ExecuteRun(context.Background(), cfg, pipeline.Options{
+		WorkDir: workDir,
+		Output:  runLog, // Tailed live by the dashboard and `snapci logs --follow`
+		Run:     run,
+		Secrets: repoSecrets,
+		OnJobDone: func(name string, result types.JobResult) {
+			reportJobStatus(run, name, result)
+		},
+	})
+	if request != nil {
+		run.Results = jobResults
+		cancelRun(run, cfg, request)
+		return
+	}
+	if err != nil {
+		failRun(run, cfg, fmt.Errorf("pipeline execution failed: %w", err))
+		return
+	}
+
+	succeeded = pipeline.Succeeded(jobResults)
+	run.Results = jobResults
+	run.Status = types.RunFailure
+	if succeeded {
+		run.Status = types.RunSuccess
+	}
+	run.EndTime = time.Now()
+	if err := storage.StoreRun(cfg, run); err != nil {
+		log.Printf("Error storing run results for %s: %v", run.ID, err)
+	}
+
+	reportFinishedRun(run)
+	log.Printf("Run %s finished with status: %s", run.ID, run.Status)
+	storage.DisplayRunResults(jobResults) // Display in CLI output
+}
+
+// resolveCommit pins the workspace to the run's commit, so the run builds
+// exactly the commit it was created for even if the branch has moved on since.
+// A run created without a commit builds the head of its branch, which is
+// recorded along with its author and message. For a pull request's merge
+// ref, the head of the pull request that got merged is recorded as well, so
+// that commit statuses end up on the commit that was built.
+func resolveCommit(run *types.PipelineRun, workDir string) error {
+	if run.CommitSHA != "" {
+		if err := CheckoutCommit(workDir, run.CommitSHA); err != nil {
+			return fmt.Errorf("failed to check out commit %s: %w", run.CommitSHA, err)
+		}
+	} else {
+		sha, err := GetCurrentCommit(workDir)
+		if err != nil {
+			return fmt.Errorf("failed to determine the commit to build: %w", err)
+		}
+		run.CommitSHA = sha
+
+		if isMergeRef(run.Ref) {
+			head, err := GetMergeHead(workDir)
+			if err != nil {
+				return fmt.Errorf("failed to determine the head of pull request #%d: %w", run.PRNumber, err)
+			}
+			if run.HeadSHA != "" && head != run.HeadSHA {
+				log.Printf("Pull request #%d of %s has moved on from %s to %s", run.PRNumber, run.RepoName, run.HeadSHA, head)
+			}
+			run.HeadSHA = head
+		}
+	}
+
+	if run.CommitAuthor == "" && run.CommitMsg == "" {
+		author, message, err := GetCommitDetails(workDir, run.CommitSHA)
+		if err != nil {
+			log.Printf("Warning: Could not get commit details for %s: %v", run.CommitSHA, err)
+		} else {
+			run.CommitAuthor, run.CommitMsg = author, message
+		}
+	}
+	return nil
+}
+
+// failRun marks a run as failed for a reason outside of its jobs and stores it.
+func failRun(run *types.PipelineRun, cfg *config.Config, reason error) {
+	log.Printf("Run %s failed: %v", run.ID, reason)
+	run.Status = types.RunFailure
+	run.Error = reason.Error()
+	run.EndTime = time.Now()
+	if err := storage.StoreRun(cfg, run); err != nil {
+		log.Printf("Error storing failed run %s: %v", run.ID, err)
+	}
+	reportFinishedRun(run)
+}
+
+// updateSchedules takes the schedules of a repository from the .ci.yaml of
+// runs on its default branch, "main" if the run does not know it.
+func updateSchedules(run *types.PipelineRun, cfg *config.Config) {
+	defaultBranch := run.DefaultBranch
+	if defaultBranch == "" {
+		defaultBranch = "main"
+	}
+	if run.Ref != "refs/heads/"+defaultBranch {
+		return
+	}
+	if err := schedule.Update(run.RepoName, defaultBranch, run.CloneURL, cfg.On.Schedule); err != nil {
+		log.Printf("Warning: Failed to update schedules of %s: %v", run.RepoName, err)
+	}
+}
+
+// queueScheduledRun queues a run of the default branch for a due schedule.
+func queueScheduledRun(entry schedule.Entry) {
+	run := &types.PipelineRun{
+		ID:            storage.NewRunID(),
+		RepoName:      entry.RepoName,
+		Branch:        entry.Branch,
+		TriggeredBy:   "scheduler",
+		TriggerType:   "scheduled",
+		CloneURL:      entry.CloneURL,
+		Ref:           "refs/heads/" + entry.Branch,
+		DefaultBranch: entry.Branch,
+		Event:         "schedule", // Skipped if the schedule was removed meanwhile
+		Results:       make(map[string]types.JobResult),
+	}
+	log.Printf("Schedule '%s' of %s is due", entry.Cron, entry.RepoName)
+	if err := enqueueRun(run); err != nil {
+		log.Printf("Error queueing scheduled run for %s: %v", entry.RepoName, err)
+	}
+}
+
+// skipRun records a run whose event does not match the pipeline's triggers.
+func skipRun(run *types.PipelineRun, cfg *config.Config, reason string) {
+	log.Printf("Run %s skipped: %s", run.ID, reason)
+	run.Status = types.RunSkipped
+	run.SkipReason = reason
+	run.EndTime = time.Now()
+	if err := storage.StoreRun(cfg, run); err != nil {
+		log.Printf("Error storing skipped run %s: %v", run.ID, err)
+	}
+}
+
+// cancelPollInterval is how often a running run checks for a cancel request.
+const cancelPollInterval = time.Second
+
+// ExecuteRun executes the pipeline of opts.Run until it finishes, ctx is
+// done or a cancel request for the run is made with `snapci cancel`, the
+// dashboard or the API. It returns the cancel request if there was one.
+func ExecuteRun(ctx context.Context, cfg *config.Config, opts pipeline.Options) (map[string]types.JobResult, *storage.CancelRequest, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	cancelRequests := make(chan *storage.CancelRequest, 1)
+	go watchForCancel(ctx, opts.Run.ID, cancel, cancelRequests)
+
+	jobResults, err := pipeline.ExecutePipeline(ctx, *cfg, opts)
+	cancel()
+	return jobResults, <-cancelRequests, err
+}
+
+// watchForCancel polls for a cancel request of a run, recorded by
+// `snapci cancel` or the dashboard, and cancels the run's context when one
+// appears. It sends exactly one value on found: the request, or nil if ctx
+// ended without one.
+func watchForCancel(ctx context.Context, runID string, cancel context.CancelFunc, found chan<- *storage.CancelRequest) {
+	ticker := time.NewTicker(cancelPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			found <- nil
+			return
+		case <-ticker.C:
+		}
+
+		request, err := storage.GetCancelRequest(runID)
+		if err != nil {
+			log.Printf("Warning: Failed to check run %s for a cancel request: %v", runID, err)
+			continue
+		}
+		if request != nil {
+			log.Printf("Cancelling run %s as requested by %s", runID, request.RequestedBy)
+			found <- request
+			cancel()
+			return
+		}
+	}
+}
+
+// cancelRun marks a run as cancelled on behalf of the request and stores it.
+func cancelRun(run *types.PipelineRun, cfg *config.Config, request *storage.CancelRequest) {
+	log.Printf("Run %s cancelled by %s", run.ID, request.RequestedBy)
+	run.Status = types.RunCancelled
+	run.CancelledBy = request.RequestedBy
+	run.CancelledAt = request.RequestedAt
+	run.EndTime = time.Now()
+	if err := storage.StoreRun(cfg, run); err != nil {
+		log.Printf("Error storing cancelled run %s: %v", run.ID, err)
+	}
+	reportFinishedRun(run)
+}
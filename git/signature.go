@@ -0,0 +1,67 @@
+package git
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+
+	"snap-ci/storage"
+)
+
+// webhookSecretEnv names a fallback secret used for repositories whose webhook
+// was configured by hand rather than through RegisterGithubWebhook.
+const webhookSecretEnv = "SNAPCI_WEBHOOK_SECRET"
+
+// WebhookSecretFor returns the stored webhook secret of a repository,
+// generating and storing a new one if none exists yet.
+func WebhookSecretFor(repoFullName string) (string, error) {
+	if auth, err := storage.GetRepoAuth(repoFullName); err == nil && auth.WebhookSecret != "" {
+		return auth.WebhookSecret, nil
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate webhook secret: %w", err)
+	}
+	secret := hex.EncodeToString(buf)
+
+	if err := storage.StoreWebhookSecret(repoFullName, secret); err != nil {
+		return "", fmt.Errorf("failed to store webhook secret: %w", err)
+	}
+	return secret, nil
+}
+
+// webhookSecret returns the webhook secret stored for a repository, or the
+// fallback secret of SNAPCI_WEBHOOK_SECRET.
+func webhookSecret(repoName string) (string, error) {
+	secret := ""
+	if repoName != "" {
+		if auth, err := storage.GetRepoAuth(repoName); err == nil {
+			secret = auth.WebhookSecret
+		}
+	}
+	if secret == "" {
+		secret = os.Getenv(webhookSecretEnv)
+	}
+	if secret == "" {
+		return "", fmt.Errorf("no webhook secret configured for repository '%s'", repoName)
+	}
+	return secret, nil
+}
+
+// verifyHMAC checks a hex-encoded HMAC-SHA256 signature of a payload.
+func verifyHMAC(payload []byte, secret, hexSignature string) error {
+	signature, err := hex.DecodeString(hexSignature)
+	if err != nil {
+		return fmt.Errorf("malformed signature")
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	if !hmac.Equal(signature, mac.Sum(nil)) { // Constant-time comparison
+		return fmt.Errorf("signature mismatch")
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package git
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func sign(payload []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyHMAC(t *testing.T) {
+	payload := []byte(`{"ref":"refs/heads/main"}`)
+	valid := sign(payload, "s3cr3t")
+
+	tests := []struct {
+		name      string
+		payload   []byte
+		secret    string
+		signature string
+		wantErr   string
+	}{
+		{name: "valid", payload: payload, secret: "s3cr3t", signature: valid},
+		{name: "upper-case hex", payload: payload, secret: "s3cr3t", signature: strings.ToUpper(valid)},
+		{name: "empty payload", payload: nil, secret: "s3cr3t", signature: sign(nil, "s3cr3t")},
+		{name: "wrong secret", payload: payload, secret: "other", signature: valid, wantErr: "signature mismatch"},
+		{name: "tampered payload", payload: []byte(`{"ref":"refs/heads/evil"}`), secret: "s3cr3t", signature: valid, wantErr: "signature mismatch"},
+		{name: "truncated signature", payload: payload, secret: "s3cr3t", signature: valid[:32], wantErr: "signature mismatch"},
+		{name: "empty signature", payload: payload, secret: "s3cr3t", signature: "", wantErr: "signature mismatch"},
+		{name: "not hex", payload: payload, secret: "s3cr3t", signature: "zz" + valid[2:], wantErr: "malformed signature"},
+		{name: "odd length", payload: payload, secret: "s3cr3t", signature: valid[1:], wantErr: "malformed signature"},
+		{name: "algorithm prefix left on", payload: payload, secret: "s3cr3t", signature: "sha256=" + valid, wantErr: "malformed signature"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyHMAC(tt.payload, tt.secret, tt.signature)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("verifyHMAC() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("verifyHMAC() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestProviderVerify(t *testing.T) {
+	payload := []byte(`{"ref":"refs/heads/main"}`)
+	signature := sign(payload, "s3cr3t")
+
+	tests := []struct {
+		name     string
+		provider webhookProvider
+		header   map[string]string
+		wantErr  string
+	}{
+		{name: "github", provider: githubProvider{}, header: map[string]string{"X-Hub-Signature-256": "sha256=" + signature}},
+		{name: "github without prefix", provider: githubProvider{}, header: map[string]string{"X-Hub-Signature-256": signature}, wantErr: "malformed X-Hub-Signature-256"},
+		{name: "github sha1 signature only", provider: githubProvider{}, header: map[string]string{"X-Hub-Signature": "sha1=" + signature}, wantErr: "missing X-Hub-Signature-256"},
+		{name: "github wrong signature", provider: githubProvider{}, header: map[string]string{"X-Hub-Signature-256": "sha256=" + sign(payload, "other")}, wantErr: "signature mismatch"},
+		{name: "gitea", provider: giteaProvider{}, header: map[string]string{"X-Gitea-Signature": signature}},
+		{name: "forgejo", provider: giteaProvider{}, header: map[string]string{"X-Forgejo-Signature": signature}},
+		{name: "gitea missing signature", provider: giteaProvider{}, header: nil, wantErr: "missing X-Gitea-Signature"},
+		{name: "gitea wrong signature", provider: giteaProvider{}, header: map[string]string{"X-Gitea-Signature": sign(payload, "other")}, wantErr: "signature mismatch"},
+		{name: "gitlab", provider: gitlabProvider{}, header: map[string]string{"X-Gitlab-Token": "s3cr3t"}},
+		{name: "gitlab missing token", provider: gitlabProvider{}, header: nil, wantErr: "missing X-Gitlab-Token"},
+		{name: "gitlab wrong token", provider: gitlabProvider{}, header: map[string]string{"X-Gitlab-Token": "s3cr3"}, wantErr: "secret token mismatch"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			for key, value := range tt.header {
+				header.Set(key, value)
+			}
+			err := tt.provider.verify(header, payload, "s3cr3t")
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("verify() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("verify() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
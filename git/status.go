@@ -0,0 +1,168 @@
+package git
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"snap-ci/storage"
+	"snap-ci/types"
+)
+
+// DefaultGitHubAPIURL is the GitHub REST API used when not configured.
+const DefaultGitHubAPIURL = "https://api.github.com"
+
+// DefaultDashboardURL is where commit statuses link to when not configured.
+const DefaultDashboardURL = "http://localhost:8081"
+
+// Commit status states of the GitHub Statuses API
+const (
+	statePending = "pending"
+	stateSuccess = "success"
+	stateFailure = "failure"
+	stateError   = "error"
+)
+
+// statusContext is the context of the status for a whole run; each job's
+// status is reported under statusContext + "/" + job name.
+const statusContext = "snapci"
+
+var (
+	githubMu     sync.Mutex
+	githubAPIURL = DefaultGitHubAPIURL
+	dashboardURL = DefaultDashboardURL
+)
+
+// ConfigureGitHub sets the base URL of the GitHub REST API, e.g. a GitHub
+// Enterprise server or a local fake for testing, and the public URL of the
+// dashboard that commit statuses link to. Empty values keep the defaults.
+func ConfigureGitHub(apiURL, dashboard string) {
+	githubMu.Lock()
+	defer githubMu.Unlock()
+	if apiURL == "" {
+		apiURL = DefaultGitHubAPIURL
+	}
+	if dashboard == "" {
+		dashboard = DefaultDashboardURL
+	}
+	githubAPIURL = strings.TrimSuffix(apiURL, "/")
+	dashboardURL = strings.TrimSuffix(dashboard, "/")
+}
+
+func githubURLs() (string, string) {
+	githubMu.Lock()
+	defer githubMu.Unlock()
+	return githubAPIURL, dashboardURL
+}
+
+// reportRunStatus posts the status of a whole run to its commit.
+func reportRunStatus(run *types.PipelineRun, state, description string) {
+	postCommitStatus(run, statusContext, state, description)
+}
+
+// reportJobStatus posts the status of a finished job to its run's commit.
+func reportJobStatus(run *types.PipelineRun, jobName string, result types.JobResult) {
+	var state, description string
+	switch result.Status {
+	case types.StatusSuccess:
+		state, description = stateSuccess, "Succeeded in "+result.Duration.Round(time.Second).String()
+	case types.StatusFailure:
+		state, description = stateFailure, "Failed after "+result.Duration.Round(time.Second).String()
+	case types.StatusTimedOut:
+		state, description = stateFailure, "Timed out"
+	case types.StatusSkipped:
+		state, description = stateError, "Skipped: an upstream job did not succeed"
+	default:
+		state, description = stateError, "Cancelled"
+	}
+	postCommitStatus(run, statusContext+"/"+jobName, state, description)
+}
+
+// reportFinishedRun posts the final status of a run that has finished.
+func reportFinishedRun(run *types.PipelineRun) {
+	switch run.Status {
+	case types.RunSuccess:
+		reportRunStatus(run, stateSuccess, "All jobs succeeded")
+	case types.RunFailure:
+		if run.Error != "" {
+			reportRunStatus(run, stateError, run.Error)
+		} else {
+			reportRunStatus(run, stateFailure, "One or more jobs failed")
+		}
+	case types.RunCancelled:
+		reportRunStatus(run, stateError, "Cancelled by "+run.CancelledBy)
+	}
+}
+
+// postCommitStatus posts a commit status for the commit a run builds, using
+// the repository's stored PAT. Reporting is best effort: runs without a
+// commit or a PAT, and runs of repositories outside of GitHub, are not
+// reported, and errors are only logged.
+func postCommitStatus(run *types.PipelineRun, context, state, description string) {
+	sha := run.HeadSHA // Statuses of a pull request belong on its head commit, not the merge commit
+	if sha == "" {
+		sha = run.CommitSHA
+	}
+	if sha == "" || sha == "unknown" || !strings.Contains(run.RepoName, "/") {
+		return
+	}
+	if run.Provider != "" && run.Provider != types.ProviderGitHub {
+		return // Only GitHub commit statuses are supported
+	}
+	auth, err := storage.GetRepoAuth(run.RepoName)
+	if err != nil || !auth.HasToken() || auth.ProviderName() != types.ProviderGitHub {
+		return // Nowhere to report to without a PAT
+	}
+	token, err := auth.AccessToken()
+	if err != nil {
+		log.Printf("Warning: Not reporting commit status for run %s: %v", run.ID, err)
+		return
+	}
+
+	description, _, _ = strings.Cut(description, "\n")
+	if runes := []rune(description); len(runes) > 140 { // GitHub's limit
+		description = string(runes[:137]) + "..."
+	}
+	apiURL, dashboard := githubURLs()
+	body, err := json.Marshal(map[string]string{
+		"state":       state,
+		"target_url":  fmt.Sprintf("%s/runs/%s", dashboard, run.ID),
+		"description": description,
+		"context":     context,
+	})
+	if err != nil {
+		log.Printf("Warning: Failed to encode commit status for run %s: %v", run.ID, err)
+		return
+	}
+
+	statusURL := fmt.Sprintf("%s/repos/%s/statuses/%s", apiURL, run.RepoName, sha)
+	req, err := http.NewRequest(http.MethodPost, statusURL, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Warning: Failed to create commit status request for run %s: %v", run.ID, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", fmt.Sprintf("token %s", token))
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("Warning: Failed to post commit status '%s' for run %s: %v", context, run.ID, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		log.Printf("Warning: GitHub API returned status %d for commit status '%s' of run %s: %s", resp.StatusCode, context, run.ID, string(respBody))
+		return
+	}
+	log.Printf("Reported %s status '%s' for %s@%s", state, context, run.RepoName, sha)
+}
@@ -1,55 +1,78 @@
 package git
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"log"
+	"os"
 	"path/filepath" // Still useful for joining paths like .ci.yaml
-	"strings"
 	"time"
 
 	"snap-ci/config"
 	"snap-ci/pipeline"
+	"snap-ci/secrets"
 	"snap-ci/storage" // This package contains storage.GetRepoAuth, storage.StoreRun etc.
 	"snap-ci/types"   // This package contains types.JobResult, types.StepResult
+	"snap-ci/workspace"
 )
 
+// TriggerManualRun clones a branch (main if empty) and, optionally, a specific
+// commit of a repository and executes its pipeline in this process.
 func TriggerManualRun(repoName, branch, commitSHA string) error {
-	runID := fmt.Sprintf("manual-%s-%d", strings.ReplaceAll(repoName, "/", "-"), time.Now().UnixNano())
-
-	// 1. Determine Repository URL and Authentication
-	repoURL := fmt.Sprintf("https://github.com/%s.git", repoName) // Default to public HTTPS
-	// storage.GetRepoAuth is exported, so it can be called directly.
-	if patAuth, err := storage.GetRepoAuth(repoName); err == nil && patAuth != nil && patAuth.GithubToken != "" {
-		repoURL = fmt.Sprintf("https://oauth2:%s@github.com/%s.git", patAuth.GithubToken, repoName)
-		log.Printf("Using stored GitHub PAT for cloning %s.", repoName)
-	} else if err != nil {
-		log.Printf("No stored authentication found for %s (%v). Cloning might fail for private repos.", repoName, err)
-	} else {
-		log.Printf("No stored authentication found for %s. Cloning might fail for private repos.", repoName)
+	if branch == "" {
+		branch = "main" // Default to main if no branch provided
 	}
+	return runInline(&types.PipelineRun{
+		RepoName:    repoName,
+		Branch:      branch,
+		CommitSHA:   commitSHA,
+		TriggeredBy: "CLI User",
+		TriggerType: "manual",
+		CloneURL:    defaultCloneURL(repoName), // cloneRepo adds the stored token, if any
+		Ref:         "refs/heads/" + branch,    // git.cloneRepo expects "refs/heads/branch-name"
+	})
+}
+
+// runInline executes a run in this process instead of the run queue, with
+// the step output shown live in the terminal. Runs created by an event only
+// go ahead if the pipeline's `on:` triggers match it. The run is recorded
+// from the start, and recorded as failed if it cannot be executed.
+func runInline(pipelineRun *types.PipelineRun) error {
+	pipelineRun.ID = storage.NewRunID()
+	pipelineRun.StartTime = time.Now()
+	pipelineRun.Results = make(map[string]types.JobResult)
+	repoName, branch, commitSHA := pipelineRun.RepoName, pipelineRun.Branch, pipelineRun.CommitSHA
 
-	// 2. Determine the ref to clone (branch or default)
-	cloneRef := branch
-	if cloneRef == "" {
-		cloneRef = "main" // Default to main if no branch provided
+	pipelineRun.Status = types.RunRunning
+	if err := storage.StoreRun(nil, pipelineRun); err != nil {
+		log.Printf("Warning: Failed to record run %s as running: %v", pipelineRun.ID, err)
+	}
+	var cfg *config.Config
+	fail := func(err error) error {
+		failRun(pipelineRun, cfg, err)
+		return err
 	}
-	fullRef := fmt.Sprintf("refs/heads/%s", cloneRef) // git.cloneRepo expects "refs/heads/branch-name"
 
-	// 3. Clone the Repository
-	log.Printf("Cloning %s (ref: %s) into 'temp_repo'...", repoName, cloneRef)
-	if err := cloneRepo(repoURL, fullRef); err != nil {
-		return fmt.Errorf("failed to clone repository %s (ref: %s): %w", repoName, cloneRef, err)
+	// 1. Clone the Repository into this run's own workspace
+	currentRepoWorkingDir, err := workspace.Create(pipelineRun.ID)
+	if err != nil {
+		return fail(fmt.Errorf("failed to create workspace for run %s: %w", pipelineRun.ID, err))
 	}
+	succeeded := false
+	defer func() { workspace.Cleanup(pipelineRun.ID, succeeded) }()
 
-	// The `repoDir` for subsequent operations is implicitly "temp_repo"
-	const currentRepoWorkingDir = "temp_repo"
+	log.Printf("Cloning %s (ref: %s) into '%s'...", repoName, pipelineRun.Ref, currentRepoWorkingDir)
+	if err := cloneRepo(pipelineRun.CloneURL, repoName, pipelineRun.Ref, currentRepoWorkingDir, true); err != nil {
+		return fail(fmt.Errorf("failed to clone repository %s (ref: %s): %w", repoName, pipelineRun.Ref, err))
+	}
 
-	// 4. If a specific commit SHA is provided, check it out after cloning the branch
+	// 2. If a specific commit SHA is provided, check it out after cloning the branch
 	if commitSHA != "" {
 		log.Printf("Checking out specific commit '%s' in %s...", commitSHA, currentRepoWorkingDir)
 		// git.CheckoutCommit is exported.
 		if err := CheckoutCommit(currentRepoWorkingDir, commitSHA); err != nil {
-			return fmt.Errorf("failed to checkout commit '%s' in %s: %w", commitSHA, currentRepoWorkingDir, err)
+			return fail(fmt.Errorf("failed to checkout commit '%s' in %s: %w", commitSHA, currentRepoWorkingDir, err))
 		}
 	} else {
 		// Ensure the branch derived from `branch` input is checked out if no commit SHA
@@ -58,125 +81,190 @@ func TriggerManualRun(repoName, branch, commitSHA string) error {
 		if branch != "" && branch != "main" && branch != "master" { // Avoid redundant checkout for common default branches
 			log.Printf("Ensuring branch '%s' is checked out in %s...", branch, currentRepoWorkingDir)
 			if err := CheckoutBranch(currentRepoWorkingDir, branch); err != nil {
-				return fmt.Errorf("failed to checkout branch '%s' in %s: %w", branch, currentRepoWorkingDir, err)
+				return fail(fmt.Errorf("failed to checkout branch '%s' in %s: %w", branch, currentRepoWorkingDir, err))
 			}
 		}
 	}
 
 	// Get the actual commit SHA and branch name after all checkout operations
 	// git.GetCurrentCommit and git.GetCurrentBranch are exported.
-	effectiveCommitSHA := commitSHA // Start with provided SHA, or update from HEAD
 	if currentCommit, err := GetCurrentCommit(currentRepoWorkingDir); err != nil {
 		log.Printf("Warning: Could not get current commit SHA from %s: %v", currentRepoWorkingDir, err)
-		effectiveCommitSHA = "unknown"
+		pipelineRun.CommitSHA = "unknown"
 	} else {
-		effectiveCommitSHA = currentCommit
+		pipelineRun.CommitSHA = currentCommit
 	}
 
-	effectiveBranch := branch // Start with provided branch, or update from HEAD
-	if currentBranch, err := GetCurrentBranch(currentRepoWorkingDir); err == nil {
-		effectiveBranch = currentBranch
-	} else {
+	if currentBranch, err := GetCurrentBranch(currentRepoWorkingDir); err != nil {
 		log.Printf("Warning: Could not get current branch name from %s: %v", currentRepoWorkingDir, err)
-		if effectiveBranch == "" {
-			effectiveBranch = "unknown"
+		if pipelineRun.Branch == "" {
+			pipelineRun.Branch = "unknown"
 		}
+	} else if currentBranch != "HEAD" { // A checked out commit or tag has no branch
+		pipelineRun.Branch = currentBranch
 	}
 
-	// 5. Load the .ci.yaml configuration
+	// 3. Load the .ci.yaml configuration
 	configPath := filepath.Join(currentRepoWorkingDir, ".ci.yaml")
 	// config.LoadConfig is expected to be exported.
-	cfg, err := config.LoadConfig(configPath)
-	if err != nil {
-		return fmt.Errorf("failed to load pipeline configuration from %s: %w", configPath, err)
+	if cfg, err = config.LoadConfig(configPath); err != nil {
+		return fail(fmt.Errorf("failed to load pipeline configuration from %s: %w", configPath, err))
+	}
+	if pipelineRun.Event != "" {
+		event := config.Event{Name: pipelineRun.Event, Ref: pipelineRun.Ref, Files: pipelineRun.ChangedFiles}
+		if ok, reason := cfg.On.Match(event); !ok {
+			succeeded = true // Nothing in the workspace is worth keeping
+			skipRun(pipelineRun, cfg, reason)
+			return nil
+		}
 	}
 
-	// 6. Get Commit Details for Run Metadata
-	var commitAuthor, commitMsg string
-	if effectiveCommitSHA != "unknown" && effectiveCommitSHA != "" {
+	// 4. Get Commit Details for Run Metadata
+	if pipelineRun.CommitSHA != "unknown" && pipelineRun.CommitSHA != "" {
 		// git.GetCommitDetails is exported.
-		commitAuthor, commitMsg, err = GetCommitDetails(currentRepoWorkingDir, effectiveCommitSHA)
+		pipelineRun.CommitAuthor, pipelineRun.CommitMsg, err = GetCommitDetails(currentRepoWorkingDir, pipelineRun.CommitSHA)
 		if err != nil {
-			log.Printf("Warning: Could not get commit details for SHA '%s': %v. Using defaults.", effectiveCommitSHA, err)
-			commitAuthor = "N/A"
-			commitMsg = "Manual trigger"
+			log.Printf("Warning: Could not get commit details for SHA '%s': %v. Using defaults.", pipelineRun.CommitSHA, err)
+			pipelineRun.CommitAuthor = "N/A"
+			pipelineRun.CommitMsg = "Manual trigger"
 		}
 	} else {
-		commitAuthor = "N/A"
-		commitMsg = "Manual trigger (no specific commit SHA determined)"
-	}
-
-	// 7. Initialize PipelineRun Object
-	pipelineRun := &types.PipelineRun{
-		ID:           runID,
-		RepoName:     repoName,
-		Branch:       effectiveBranch,
-		CommitSHA:    effectiveCommitSHA,
-		CommitMsg:    commitMsg,
-		CommitAuthor: commitAuthor,
-		TriggeredBy:  "CLI User",
-		TriggerType:  "manual",
-		Status:       "pending",
-		StartTime:    time.Now(),
-		Results:      make(map[string]types.JobResult),
-	}
-
-	log.Printf("Executing manually triggered pipeline run %s for commit '%s' on branch '%s'...",
-		pipelineRun.ID, pipelineRun.CommitSHA, pipelineRun.Branch)
-
-	// 8. Execute the Pipeline (calling pipeline.ExecutePipeline as it currently is)
-	jobResultsFromPipeline, err := pipeline.ExecutePipeline(*cfg)
+		pipelineRun.CommitAuthor = "N/A"
+		pipelineRun.CommitMsg = "Manual trigger (no specific commit SHA determined)"
+	}
+
+	// 5. Record the commit and jobs of the running run
+	if err := storage.StoreRun(cfg, pipelineRun); err != nil {
+		log.Printf("Warning: Failed to record run %s as running: %v", pipelineRun.ID, err)
+	}
+	reportRunStatus(pipelineRun, statePending, "Running")
+
+	log.Printf("Executing %s pipeline run %s for commit '%s' on branch '%s'...",
+		pipelineRun.TriggerType, pipelineRun.ID, pipelineRun.CommitSHA, pipelineRun.Branch)
+
+	repoSecrets, err := secrets.Load(repoName)
 	if err != nil {
-		log.Printf("Manually triggered pipeline run %s failed during pipeline execution: %v", pipelineRun.ID, err)
-		pipelineRun.Status = "failure"
-	} else {
-		// Copy results from types.JobResult (returned by pipeline.ExecutePipeline) to run.JobResult
-		// for the PipelineRun object.
-		for jobName, result := range jobResultsFromPipeline {
-			pipelineRun.Results[jobName] = types.JobResult{
-				Status: result.Status,
-				Steps:  make(map[string]types.StepResult),
-			}
-			for stepName, stepResult := range result.Steps {
-				pipelineRun.Results[jobName].Steps[stepName] = types.StepResult{
-					Status: stepResult.Status,
-					Logs:   stepResult.Logs,
-				}
-			}
-		}
+		return fail(fmt.Errorf("failed to load secrets for %s: %w", repoName, err))
+	}
 
-		// Determine overall pipeline status based on returned jobResults
-		allJobsSuccess := true
-		for _, jobResult := range jobResultsFromPipeline {
-			if jobResult.Status == "Failure" { // Use case-sensitive "Failure" as per pipeline.go and types.JobResult
-				allJobsSuccess = false
-				break
-			}
-		}
+	runLog, err := storage.OpenRunLog(pipelineRun.ID)
+	if err != nil {
+		return fail(fmt.Errorf("failed to open log of run %s: %w", pipelineRun.ID, err))
+	}
+	defer runLog.Close()
 
-		if allJobsSuccess {
-			pipelineRun.Status = "success"
-		} else {
-			pipelineRun.Status = "failure"
-		}
+	// 6. Execute the Pipeline
+	// Cancel requests from `snapci cancel`, the dashboard or the API stop the run like a queued one
+	defer storage.ClearCancelRequest(pipelineRun.ID)
+	jobResultsFromPipeline, request, err := ExecuteRun(context.Background(), cfg, pipeline.Options{
+		WorkDir: currentRepoWorkingDir,
+		Output:  io.MultiWriter(os.Stdout, runLog), // Show step output live in the terminal and keep it in the run log
+		Run:     pipelineRun,
+		Secrets: repoSecrets,
+		OnJobDone: func(name string, result types.JobResult) {
+			reportJobStatus(pipelineRun, name, result)
+		},
+	})
+	if request != nil {
+		pipelineRun.Results = jobResultsFromPipeline
+		cancelRun(pipelineRun, cfg, request)
+		return nil
+	}
+	if err != nil {
+		failRun(pipelineRun, cfg, fmt.Errorf("pipeline execution failed: %w", err))
+		return nil
+	}
+	pipelineRun.Results = jobResultsFromPipeline
+	succeeded = pipeline.Succeeded(jobResultsFromPipeline)
+	pipelineRun.Status = types.RunFailure
+	if succeeded {
+		pipelineRun.Status = types.RunSuccess
 	}
 	pipelineRun.EndTime = time.Now()
 
-	// 9. Store the PipelineRun Results
-	// storage.StoreRun is exported, so it can be called directly.
-	if err := storage.StoreRun(
-		cfg,
-		pipelineRun.Results, // Pass the results stored in pipelineRun
-		pipelineRun.RepoName,
-		pipelineRun.Branch,
-		pipelineRun.CommitSHA,
-		pipelineRun.CommitMsg,
-		pipelineRun.CommitAuthor,
-		pipelineRun.TriggeredBy,
-	); err != nil {
-		log.Printf("Warning: Failed to store manual run results for %s: %v", pipelineRun.ID, err)
-	}
-
-	log.Printf("Manually triggered pipeline run %s finished with status: %s", pipelineRun.ID, pipelineRun.Status)
+	// 7. Store the PipelineRun Results under its own ID and timestamps
+	if err := storage.StoreRun(cfg, pipelineRun); err != nil {
+		log.Printf("Warning: Failed to store run results for %s: %v", pipelineRun.ID, err)
+	}
+	reportFinishedRun(pipelineRun)
+
+	log.Printf("Pipeline run %s finished with status: %s", pipelineRun.ID, pipelineRun.Status)
 	return nil
 }
+
+// QueueManualRun is the non-blocking counterpart of TriggerManualRun used by
+// the API: it records a pending run for a branch (main if empty) and,
+// optionally, a specific commit of a repository, and hands it to the run
+// queue. The stored token of the repository is used when cloning.
+func QueueManualRun(repoName, branch, commitSHA, triggeredBy string) (*types.PipelineRun, error) {
+	if repoName == "" {
+		return nil, fmt.Errorf("repository is required")
+	}
+	if branch == "" {
+		branch = "main"
+	}
+	run := &types.PipelineRun{
+		ID:          storage.NewRunID(),
+		RepoName:    repoName,
+		Branch:      branch,
+		CommitSHA:   commitSHA,
+		TriggeredBy: triggeredBy,
+		TriggerType: "api",
+		CloneURL:    defaultCloneURL(repoName),
+		Ref:         "refs/heads/" + branch,
+		Results:     make(map[string]types.JobResult),
+	}
+	if err := enqueueRun(run); err != nil {
+		return nil, err
+	}
+	return run, nil
+}
+
+// Rerun queues a new run of the same repository, branch and commit as an
+// earlier run. A rerun of a pull request's merge ref builds the current merge
+// of the pull request instead, as the earlier merge commit is replaced
+// whenever the head or base branch moves.
+func Rerun(runID, triggeredBy string) (*types.PipelineRun, error) {
+	previous, err := storage.GetRun(runID)
+	if err != nil {
+		return nil, err
+	}
+	if previous.TriggerType == "cli" {
+		return nil, fmt.Errorf("run %s was started with `snapci run` from a local .ci.yaml and cannot be rerun", runID)
+	}
+
+	run := &types.PipelineRun{
+		ID:            storage.NewRunID(),
+		RepoName:      previous.RepoName,
+		Branch:        previous.Branch,
+		CommitSHA:     previous.CommitSHA,
+		CommitMsg:     previous.CommitMsg,
+		CommitAuthor:  previous.CommitAuthor,
+		TriggeredBy:   triggeredBy,
+		TriggerType:   "rerun",
+		CloneURL:      previous.CloneURL,
+		Ref:           previous.Ref,
+		DefaultBranch: previous.DefaultBranch,
+		PRNumber:      previous.PRNumber,
+		BaseBranch:    previous.BaseBranch,
+		HeadRepo:      previous.HeadRepo,
+		HeadSHA:       previous.HeadSHA,
+		FromFork:      previous.FromFork, // A rerun of a fork's code is just as untrusted
+		Provider:      previous.Provider,
+		Results:       make(map[string]types.JobResult),
+	}
+	if run.CommitSHA == "unknown" || isMergeRef(run.Ref) { // resolveCommit records what gets checked out
+		run.CommitSHA, run.CommitMsg, run.CommitAuthor = "", "", ""
+	}
+	// Runs recorded before the clone URL was stored came from GitHub
+	if run.CloneURL == "" {
+		run.CloneURL = fmt.Sprintf("https://github.com/%s.git", run.RepoName)
+	}
+	if run.Ref == "" {
+		run.Ref = "refs/heads/" + run.Branch
+	}
+	if err := enqueueRun(run); err != nil {
+		return nil, err
+	}
+	return run, nil
+}
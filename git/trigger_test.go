@@ -0,0 +1,128 @@
+package git
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"snap-ci/queue"
+	"snap-ci/storage"
+	"snap-ci/types"
+)
+
+// gitRun runs git in dir and returns its trimmed output.
+func gitRun(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v, output: %s", strings.Join(args, " "), err, output)
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// useRunQueue stores runs in a temporary directory and queues them without
+// executing them.
+func useRunQueue(t *testing.T) {
+	t.Helper()
+	if err := storage.Configure(storage.BackendJSON, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { storage.Configure(storage.BackendJSON, ".") })
+	startIdleRunQueue(t)
+}
+
+// startIdleRunQueue starts a run queue whose runs are never executed.
+func startIdleRunQueue(t *testing.T) {
+	t.Helper()
+	runQueueMu.Lock()
+	runQueue = queue.New(1, queue.DefaultCapacity, func(*types.PipelineRun) {})
+	runQueue.Start()
+	runQueueMu.Unlock()
+	t.Cleanup(StopRunQueue)
+}
+
+func TestRerunOfMergeRefBuildsTheCurrentMerge(t *testing.T) {
+	useRunQueue(t)
+
+	tests := []struct {
+		name          string
+		previous      types.PipelineRun
+		wantCommitSHA string
+	}{
+		{
+			name: "branch",
+			previous: types.PipelineRun{
+				Ref: "refs/heads/main", CommitSHA: "abc123", CommitMsg: "Fix", CommitAuthor: "dev",
+			},
+			wantCommitSHA: "abc123",
+		},
+		{
+			name: "github merge ref",
+			previous: types.PipelineRun{
+				Ref: "refs/pull/7/merge", CommitSHA: "merge1", CommitMsg: "Merge", CommitAuthor: "GitHub",
+				PRNumber: 7, HeadSHA: "head1",
+			},
+		},
+		{
+			name: "gitlab merge request head",
+			previous: types.PipelineRun{
+				Ref: "refs/merge-requests/3/head", CommitSHA: "head3", CommitMsg: "Feature", CommitAuthor: "dev",
+				PRNumber: 3, HeadSHA: "head3",
+			},
+			wantCommitSHA: "head3",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previous := tt.previous
+			previous.ID = storage.NewRunID()
+			previous.RepoName = "owner/repo"
+			previous.TriggerType = "webhook"
+			previous.Status = types.RunFailure
+			if err := storage.StoreRun(nil, &previous); err != nil {
+				t.Fatal(err)
+			}
+
+			run, err := Rerun(previous.ID, "admin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if run.CommitSHA != tt.wantCommitSHA || run.Ref != previous.Ref || run.HeadSHA != previous.HeadSHA {
+				t.Errorf("Rerun() = commit %q, ref %q, head %q; want commit %q", run.CommitSHA, run.Ref, run.HeadSHA, tt.wantCommitSHA)
+			}
+			if tt.wantCommitSHA == "" && (run.CommitMsg != "" || run.CommitAuthor != "") {
+				t.Errorf("Rerun() kept the details of the earlier merge commit: %q by %q", run.CommitMsg, run.CommitAuthor)
+			}
+		})
+	}
+}
+
+func TestResolveCommitRecordsTheHeadOfAMergeRef(t *testing.T) {
+	t.Setenv("GIT_AUTHOR_NAME", "dev")
+	t.Setenv("GIT_AUTHOR_EMAIL", "dev@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "dev")
+	t.Setenv("GIT_COMMITTER_EMAIL", "dev@example.com")
+
+	dir := filepath.Join(t.TempDir(), "repo")
+	gitRun(t, filepath.Dir(dir), "init", "-q", "-b", "main", dir)
+	gitRun(t, dir, "commit", "-q", "--allow-empty", "-m", "Base")
+	gitRun(t, dir, "checkout", "-q", "-b", "feature")
+	gitRun(t, dir, "commit", "-q", "--allow-empty", "-m", "Feature")
+	head := gitRun(t, dir, "rev-parse", "HEAD")
+	gitRun(t, dir, "checkout", "-q", "main")
+	gitRun(t, dir, "commit", "-q", "--allow-empty", "-m", "Base moved on")
+	gitRun(t, dir, "merge", "-q", "--no-ff", "-m", "Merge feature into main", "feature")
+	merge := gitRun(t, dir, "rev-parse", "HEAD")
+
+	// As queued by Rerun after the pull request got a new head
+	run := &types.PipelineRun{Ref: "refs/pull/7/merge", PRNumber: 7, HeadSHA: "0ld"}
+	if err := resolveCommit(run, dir); err != nil {
+		t.Fatal(err)
+	}
+	if run.CommitSHA != merge || run.HeadSHA != head || run.CommitMsg != "Merge feature into main" {
+		t.Errorf("resolveCommit() = commit %s (%q), head %s; want commit %s, head %s", run.CommitSHA, run.CommitMsg, run.HeadSHA, merge, head)
+	}
+}
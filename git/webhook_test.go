@@ -0,0 +1,92 @@
+package git
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"snap-ci/storage"
+)
+
+const pushPayload = `{"ref":"refs/heads/main","after":"abc123",` +
+	`"repository":{"full_name":"owner/repo","clone_url":"https://github.com/owner/repo.git","default_branch":"main"},` +
+	`"sender":{"login":"dev"},"head_commit":{"id":"abc123","message":"Fix","author":{"name":"dev"}}}`
+
+// deliver sends a signed GitHub push event to WebhookHandler.
+func deliver(t *testing.T, deliveryID, payload string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(payload))
+	req.Header.Set("X-GitHub-Event", "push")
+	req.Header.Set("X-GitHub-Delivery", deliveryID)
+	req.Header.Set("X-Hub-Signature-256", "sha256="+sign([]byte(payload), "s3cr3t"))
+	rec := httptest.NewRecorder()
+	WebhookHandler(rec, req)
+	return rec
+}
+
+func countRuns(t *testing.T) int {
+	t.Helper()
+	runs, err := storage.ListRuns(storage.RunFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(runs)
+}
+
+func TestWebhookHandlerRunsADeliveryOnce(t *testing.T) {
+	t.Setenv(webhookSecretEnv, "s3cr3t")
+	useRunQueue(t)
+
+	if rec := deliver(t, "delivery-1", pushPayload); rec.Code != http.StatusAccepted {
+		t.Fatalf("first delivery: status = %d (%s), want 202", rec.Code, rec.Body)
+	}
+	if rec := deliver(t, "delivery-1", pushPayload); rec.Code != http.StatusOK {
+		t.Errorf("redelivery: status = %d (%s), want 200", rec.Code, rec.Body)
+	}
+	if rec := deliver(t, "delivery-2", pushPayload); rec.Code != http.StatusAccepted {
+		t.Errorf("another delivery: status = %d (%s), want 202", rec.Code, rec.Body)
+	}
+	if n := countRuns(t); n != 2 {
+		t.Errorf("%d runs recorded, want 2", n)
+	}
+
+	if rec := deliver(t, "../escape", pushPayload); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid delivery ID: status = %d, want 400", rec.Code)
+	}
+}
+
+func TestWebhookHandlerRetriesDeliveriesThatWereNotQueued(t *testing.T) {
+	t.Setenv(webhookSecretEnv, "s3cr3t")
+	useRunQueue(t)
+	StopRunQueue()
+
+	if rec := deliver(t, "delivery-1", pushPayload); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("delivery without a run queue: status = %d (%s), want 503", rec.Code, rec.Body)
+	}
+	startIdleRunQueue(t)
+	if rec := deliver(t, "delivery-1", pushPayload); rec.Code != http.StatusAccepted {
+		t.Errorf("redelivery: status = %d (%s), want 202", rec.Code, rec.Body)
+	}
+}
+
+func TestWebhookHandlerRejectsOversizedPayloads(t *testing.T) {
+	t.Setenv(webhookSecretEnv, "s3cr3t")
+	useRunQueue(t)
+
+	payload := `{"padding":"` + strings.Repeat("x", maxWebhookPayload) + `"}`
+	if rec := deliver(t, "delivery-1", payload); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want 413", rec.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/webhook", bytes.NewReader(nil))
+	rec := httptest.NewRecorder()
+	WebhookHandler(rec, req)
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: status = %d, want 405", rec.Code)
+	}
+	if n := countRuns(t); n != 0 {
+		t.Errorf("%d runs recorded, want none", n)
+	}
+}
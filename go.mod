@@ -5,7 +5,9 @@ go 1.23.0
 toolchain go1.23.9
 
 require (
+	github.com/mattn/go-sqlite3 v1.14.24
 	github.com/urfave/cli/v2 v2.27.6
+	golang.org/x/crypto v0.36.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
@@ -0,0 +1,166 @@
+// hook/hook.go
+
+package hook
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"snap-ci/storage"
+)
+
+// DefaultFile is where the repositories with an installed post-receive hook
+// are stored when not configured.
+const DefaultFile = "hooks.json"
+
+// marker is the second line of every hook snapci writes, so a reinstall can
+// tell its own hooks from hooks it must not overwrite.
+const marker = "# Installed by `snapci hook install`"
+
+// Repo is a local bare repository whose post-receive hook hands pushes to
+// snapci. Only pushes to registered repositories are built, so that nobody
+// can get a build of an arbitrary directory by talking to the hook socket.
+type Repo struct {
+	Name        string    `json:"name"`   // Runs, stored tokens and secrets use this name
+	Path        string    `json:"path"`   // Absolute path of the bare repository
+	Inline      bool      `json:"inline"` // Built by the hook itself rather than a running server
+	InstalledAt time.Time `json:"installed_at"`
+}
+
+// File holds the registered repositories. Its lock serializes access.
+var File = storage.NewJSONFile(DefaultFile, "hooks")
+
+// CanonicalPath returns the absolute path of a repository with symlinks
+// resolved, as it is registered.
+func CanonicalPath(repoPath string) (string, error) {
+	abs, err := filepath.Abs(repoPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve repository path %s: %w", repoPath, err)
+	}
+	resolved, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve repository path %s: %w", repoPath, err)
+	}
+	return resolved, nil
+}
+
+// Install writes a post-receive hook into the bare repository at repoPath
+// that runs command, and registers the repository under name. An existing
+// post-receive hook that snapci did not write is only replaced if force is
+// set. command is run from dir, with Git's hook environment removed.
+func Install(name, repoPath string, inline, force bool, dir string, command []string) (*Repo, error) {
+	repoPath, err := CanonicalPath(repoPath)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(filepath.Join(repoPath, "objects")); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a bare git repository", repoPath)
+	}
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(repoPath), ".git")
+	}
+
+	File.Lock()
+	defer File.Unlock()
+
+	repos, err := readRepos()
+	if err != nil {
+		return nil, err
+	}
+	for _, repo := range repos {
+		if repo.Name == name && repo.Path != repoPath {
+			return nil, fmt.Errorf("the name '%s' is already used by %s; choose another with --name", name, repo.Path)
+		}
+	}
+
+	hookPath := filepath.Join(repoPath, "hooks", "post-receive")
+	if existing, err := os.ReadFile(hookPath); err == nil && !bytes.Contains(existing, []byte(marker)) && !force {
+		return nil, fmt.Errorf("%s already exists and was not written by snapci; use --force to replace it", hookPath)
+	}
+	if err := os.MkdirAll(filepath.Dir(hookPath), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create hooks directory: %w", err)
+	}
+	if err := os.WriteFile(hookPath, script(dir, command), 0755); err != nil {
+		return nil, fmt.Errorf("failed to write %s: %w", hookPath, err)
+	}
+	if err := os.Chmod(hookPath, 0755); err != nil { // WriteFile keeps the mode of an existing file
+		return nil, fmt.Errorf("failed to make %s executable: %w", hookPath, err)
+	}
+
+	installed := Repo{Name: name, Path: repoPath, Inline: inline, InstalledAt: time.Now()}
+	kept := []Repo{installed}
+	for _, repo := range repos {
+		if repo.Path != repoPath {
+			kept = append(kept, repo)
+		}
+	}
+	if err := File.Write(kept); err != nil {
+		return nil, err
+	}
+	return &installed, nil
+}
+
+// script returns a post-receive hook that runs command from dir.
+func script(dir string, command []string) []byte {
+	var b strings.Builder
+	b.WriteString("#!/bin/sh\n")
+	b.WriteString(marker + "; it hands the refs updated by each push to snapci.\n")
+	b.WriteString("# Git points GIT_DIR at this repository, which would confuse the git commands snapci runs\n")
+	b.WriteString("unset GIT_DIR GIT_WORK_TREE GIT_INDEX_FILE GIT_OBJECT_DIRECTORY GIT_ALTERNATE_OBJECT_DIRECTORIES GIT_QUARANTINE_PATH\n")
+	fmt.Fprintf(&b, "cd %s || exit 0\n", shellQuote(dir))
+	quoted := make([]string, len(command))
+	for i, arg := range command {
+		quoted[i] = shellQuote(arg)
+	}
+	fmt.Fprintf(&b, "exec %s\n", strings.Join(quoted, " "))
+	return []byte(b.String())
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Lookup returns the registered repository at repoPath.
+func Lookup(repoPath string) (*Repo, error) {
+	repoPath, err := CanonicalPath(repoPath)
+	if err != nil {
+		return nil, err
+	}
+	File.Lock()
+	defer File.Unlock()
+
+	repos, err := readRepos()
+	if err != nil {
+		return nil, err
+	}
+	for _, repo := range repos {
+		if repo.Path == repoPath {
+			return &repo, nil
+		}
+	}
+	return nil, fmt.Errorf("no snapci hook is installed in %s", repoPath)
+}
+
+// List returns the registered repositories, sorted by name.
+func List() ([]Repo, error) {
+	File.Lock()
+	defer File.Unlock()
+
+	repos, err := readRepos()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(repos, func(i, j int) bool { return repos[i].Name < repos[j].Name })
+	return repos, nil
+}
+
+func readRepos() ([]Repo, error) {
+	var repos []Repo
+	err := File.Read(&repos)
+	return repos, err
+}
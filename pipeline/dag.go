@@ -0,0 +1,69 @@
+package pipeline
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"snap-ci/config"
+)
+
+// resolveJobOrder validates the `needs` graph of the pipeline and returns the
+// job names in a topological order (dependencies before dependents).
+// Unknown job names and dependency cycles are reported as errors.
+func resolveJobOrder(jobs map[string]config.Job) ([]string, error) {
+	names := make([]string, 0, len(jobs))
+	for name := range jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names) // Deterministic order for jobs at the same depth
+
+	inDegree := make(map[string]int, len(jobs))
+	dependents := make(map[string][]string, len(jobs))
+	for _, name := range names {
+		for _, need := range jobs[name].Needs {
+			if _, ok := jobs[need]; !ok {
+				return nil, fmt.Errorf("job '%s' needs unknown job '%s'", name, need)
+			}
+			if need == name {
+				return nil, fmt.Errorf("job '%s' cannot need itself", name)
+			}
+			inDegree[name]++
+			dependents[need] = append(dependents[need], name)
+		}
+	}
+
+	var ready []string
+	for _, name := range names {
+		if inDegree[name] == 0 {
+			ready = append(ready, name)
+		}
+	}
+
+	order := make([]string, 0, len(jobs))
+	for len(ready) > 0 {
+		name := ready[0]
+		ready = ready[1:]
+		order = append(order, name)
+
+		for _, dependent := range dependents[name] {
+			inDegree[dependent]--
+			if inDegree[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+		sort.Strings(ready)
+	}
+
+	if len(order) != len(jobs) {
+		var cyclic []string
+		for _, name := range names {
+			if inDegree[name] > 0 {
+				cyclic = append(cyclic, name)
+			}
+		}
+		return nil, fmt.Errorf("dependency cycle detected between jobs: %s", strings.Join(cyclic, ", "))
+	}
+
+	return order, nil
+}
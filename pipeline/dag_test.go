@@ -0,0 +1,87 @@
+package pipeline
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"snap-ci/config"
+)
+
+func TestResolveJobOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		needs   map[string][]string // Job name -> needs
+		want    []string
+		wantErr string
+	}{
+		{
+			name:  "no dependencies are sorted by name",
+			needs: map[string][]string{"lint": nil, "build": nil, "test": nil},
+			want:  []string{"build", "lint", "test"},
+		},
+		{
+			name:  "chain",
+			needs: map[string][]string{"deploy": {"test"}, "test": {"build"}, "build": nil},
+			want:  []string{"build", "test", "deploy"},
+		},
+		{
+			name:  "diamond",
+			needs: map[string][]string{"a": nil, "b": {"a"}, "c": {"a"}, "d": {"b", "c"}},
+			want:  []string{"a", "b", "c", "d"},
+		},
+		{
+			name:  "ready jobs are taken in name order",
+			needs: map[string][]string{"z": nil, "b": {"z"}, "y": nil},
+			want:  []string{"y", "z", "b"},
+		},
+		{
+			name:    "unknown job",
+			needs:   map[string][]string{"test": {"build"}},
+			wantErr: "job 'test' needs unknown job 'build'",
+		},
+		{
+			name:    "self dependency",
+			needs:   map[string][]string{"build": {"build"}},
+			wantErr: "job 'build' cannot need itself",
+		},
+		{
+			name:    "two-job cycle",
+			needs:   map[string][]string{"a": {"b"}, "b": {"a"}},
+			wantErr: "dependency cycle detected between jobs: a, b",
+		},
+		{
+			name:    "cycle behind a valid job",
+			needs:   map[string][]string{"build": nil, "a": {"build", "c"}, "b": {"a"}, "c": {"b"}, "docs": {"build"}},
+			wantErr: "dependency cycle detected between jobs: a, b, c",
+		},
+		{
+			name:  "empty pipeline",
+			needs: map[string][]string{},
+			want:  []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jobs := make(map[string]config.Job, len(tt.needs))
+			for name, needs := range tt.needs {
+				jobs[name] = config.Job{Needs: needs}
+			}
+
+			got, err := resolveJobOrder(jobs)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("resolveJobOrder() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveJobOrder() error = %v", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("resolveJobOrder() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package pipeline
+
+import (
+	"log"
+	"sort"
+
+	"snap-ci/types"
+)
+
+// builtinEnvNames are the variables set by snapci itself; env blocks in
+// .ci.yaml cannot override them.
+var builtinEnvNames = map[string]bool{
+	"CI":                true,
+	"SNAPCI_RUN_ID":     true,
+	"SNAPCI_COMMIT_SHA": true,
+	"SNAPCI_BRANCH":     true,
+	"SNAPCI_REPO":       true,
+	"SNAPCI_WORKSPACE":  true,
+}
+
+// builtinEnv returns the variables every step of a run gets.
+func builtinEnv(run *types.PipelineRun, workDir string) map[string]string {
+	env := map[string]string{
+		"CI":               "true",
+		"SNAPCI_WORKSPACE": workDir,
+	}
+	if run != nil {
+		env["SNAPCI_RUN_ID"] = run.ID
+		env["SNAPCI_COMMIT_SHA"] = run.CommitSHA
+		env["SNAPCI_BRANCH"] = run.Branch
+		env["SNAPCI_REPO"] = run.RepoName
+	}
+	return env
+}
+
+// runVars returns the `${{ run.x }}` interpolation variables of a run.
+func runVars(run *types.PipelineRun, workDir string) map[string]string {
+	vars := map[string]string{"run.workspace": workDir}
+	if run != nil {
+		vars["run.id"] = run.ID
+		vars["run.commit_sha"] = run.CommitSHA
+		vars["run.branch"] = run.Branch
+		vars["run.repo"] = run.RepoName
+	}
+	return vars
+}
+
+// mergeEnv copies layer into env, interpolating each value with vars, and
+// exposes the result as `${{ env.X }}` to the layers merged after it.
+// Values can reference variables of earlier layers but not of their own.
+func mergeEnv(env, vars, layer map[string]string) {
+	resolved := make(map[string]string, len(layer))
+	for key, value := range layer {
+		if builtinEnvNames[key] {
+			log.Printf("Warning: Ignoring env '%s', it is set by snapci", key)
+			continue
+		}
+		resolved[key] = interpolate(value, vars)
+	}
+	for key, value := range resolved {
+		env[key] = value
+		vars["env."+key] = value
+	}
+}
+
+// copyVars returns a copy of an env or vars map, so each job and step can add
+// its own layer without affecting its siblings.
+func copyVars(m map[string]string) map[string]string {
+	c := make(map[string]string, len(m))
+	for key, value := range m {
+		c[key] = value
+	}
+	return c
+}
+
+// envList turns an env map into sorted KEY=VALUE pairs for the executor.
+func envList(env map[string]string) []string {
+	list := make([]string, 0, len(env))
+	for key, value := range env {
+		list = append(list, key+"="+value)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// secretValues returns the values of a run's secrets, to be masked in logs.
+func secretValues(secrets map[string]string) []string {
+	values := make([]string, 0, len(secrets))
+	for _, value := range secrets {
+		values = append(values, value)
+	}
+	return values
+}
@@ -0,0 +1,27 @@
+package pipeline
+
+import (
+	"regexp"
+)
+
+// exprPattern matches `${{ namespace.key }}` expressions in .ci.yaml values.
+var exprPattern = regexp.MustCompile(`\$\{\{\s*([A-Za-z0-9_.-]+)\s*\}\}`)
+
+// interpolate replaces every `${{ namespace.key }}` expression in s with the
+// matching entry of vars (keyed as "namespace.key"). Unknown expressions
+// expand to an empty string.
+func interpolate(s string, vars map[string]string) string {
+	return exprPattern.ReplaceAllStringFunc(s, func(expr string) string {
+		name := exprPattern.FindStringSubmatch(expr)[1]
+		return vars[name]
+	})
+}
+
+// matrixVars returns the interpolation variables for a matrix variant.
+func matrixVars(values map[string]string) map[string]string {
+	vars := make(map[string]string, len(values))
+	for key, value := range values {
+		vars["matrix."+key] = value
+	}
+	return vars
+}
@@ -0,0 +1,224 @@
+package pipeline
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"snap-ci/config"
+)
+
+// jobNode is a schedulable unit of the pipeline: either a plain job or one
+// variant of a matrix job.
+type jobNode struct {
+	Name   string            // Result key, e.g. "test (go=1.22, os=linux)"
+	Group  string            // Job name as written in .ci.yaml
+	Job    config.Job        // Needs are rewritten to node names
+	Matrix map[string]string // Matrix values for this variant, nil for plain jobs
+	Keys   []string          // Matrix keys in display order
+}
+
+// expandJobs expands every matrix job into its variants and rewrites `needs`
+// so that depending on a matrix job means depending on all of its variants.
+// A matrix without any combination and two jobs or variants with the same
+// name are reported as errors.
+func expandJobs(jobs map[string]config.Job) (map[string]jobNode, error) {
+	jobNames := make([]string, 0, len(jobs))
+	for jobName := range jobs {
+		jobNames = append(jobNames, jobName)
+	}
+	sort.Strings(jobNames) // Deterministic errors
+
+	groups := make(map[string][]jobNode, len(jobs))
+	for _, jobName := range jobNames {
+		job := jobs[jobName]
+		if job.Strategy.Matrix.IsEmpty() {
+			groups[jobName] = []jobNode{{Name: jobName, Group: jobName, Job: job}}
+			continue
+		}
+
+		keys, combinations := expandMatrix(job.Strategy.Matrix)
+		if len(combinations) == 0 {
+			return nil, fmt.Errorf("matrix of job '%s' has no combinations left after exclude", jobName)
+		}
+		for _, values := range combinations {
+			groups[jobName] = append(groups[jobName], jobNode{
+				Name:   variantName(jobName, keys, values),
+				Group:  jobName,
+				Job:    job,
+				Matrix: values,
+				Keys:   keys,
+			})
+		}
+	}
+
+	nodes := make(map[string]jobNode)
+	for _, jobName := range jobNames {
+		for _, node := range groups[jobName] {
+			if existing, ok := nodes[node.Name]; ok {
+				if existing.Group == node.Group {
+					return nil, fmt.Errorf("matrix of job '%s' has the variant '%s' more than once", jobName, node.Name)
+				}
+				return nil, fmt.Errorf("job '%s' has the same name as a variant of job '%s'", node.Name, existing.Group)
+			}
+			var needs config.StringList
+			for _, need := range node.Job.Needs {
+				upstream, ok := groups[need]
+				if !ok {
+					needs = append(needs, need) // Left for resolveJobOrder to report
+					continue
+				}
+				for _, variant := range upstream {
+					needs = append(needs, variant.Name)
+				}
+			}
+			node.Job.Needs = needs
+			nodes[node.Name] = node
+		}
+	}
+	return nodes, nil
+}
+
+// expandMatrix computes the cartesian product of the matrix axes, drops the
+// combinations matched by `exclude` and applies `include` entries. An include
+// entry extends every original combination it does not contradict; if it
+// extends none, it is added as a combination of its own, which later include
+// entries leave alone. A matrix with only include entries thus has one
+// combination per entry.
+func expandMatrix(matrix config.Matrix) ([]string, []map[string]string) {
+	keys := append([]string(nil), matrix.Keys...)
+
+	var combinations []map[string]string
+	if len(matrix.Keys) > 0 {
+		combinations = []map[string]string{{}}
+		for _, key := range matrix.Keys {
+			var next []map[string]string
+			for _, combination := range combinations {
+				for _, value := range matrix.Axes[key] {
+					extended := copyValues(combination)
+					extended[key] = value
+					next = append(next, extended)
+				}
+			}
+			combinations = next
+		}
+	}
+
+	kept := combinations[:0]
+	for _, combination := range combinations {
+		excluded := false
+		for _, exclude := range matrix.Exclude {
+			if matchesValues(combination, exclude) {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			kept = append(kept, combination)
+		}
+	}
+	combinations = kept
+	original := len(combinations)
+
+	for _, include := range matrix.Include {
+		extendedAny := false
+		for _, combination := range combinations[:original] {
+			if contradicts(combination, include, matrix.Axes) {
+				continue
+			}
+			for key, value := range include {
+				combination[key] = value
+			}
+			extendedAny = true
+		}
+		if !extendedAny {
+			combinations = append(combinations, copyValues(include))
+		}
+
+		// Keys that only appear in include entries are shown after the axes
+		extra := make([]string, 0, len(include))
+		for key := range include {
+			if !containsString(keys, key) {
+				extra = append(extra, key)
+			}
+		}
+		sort.Strings(extra)
+		keys = append(keys, extra...)
+	}
+
+	return keys, combinations
+}
+
+// contradicts reports whether applying include to combination would overwrite
+// one of the original matrix values.
+func contradicts(combination, include map[string]string, axes map[string][]string) bool {
+	for key, value := range include {
+		if _, isAxis := axes[key]; !isAxis {
+			continue
+		}
+		if existing, ok := combination[key]; ok && existing != value {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesValues(combination, pattern map[string]string) bool {
+	for key, value := range pattern {
+		if combination[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+func copyValues(values map[string]string) map[string]string {
+	copied := make(map[string]string, len(values))
+	for key, value := range values {
+		copied[key] = value
+	}
+	return copied
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// variantName builds the display name of a matrix variant, e.g. "test (go=1.22, os=linux)".
+func variantName(jobName string, keys []string, values map[string]string) string {
+	parts := make([]string, 0, len(values))
+	for _, key := range keys {
+		if value, ok := values[key]; ok {
+			parts = append(parts, fmt.Sprintf("%s=%s", key, value))
+		}
+	}
+	return fmt.Sprintf("%s (%s)", jobName, strings.Join(parts, ", "))
+}
+
+// matrixEnv exposes matrix values to steps as MATRIX_<KEY> environment variables.
+func matrixEnv(values map[string]string) map[string]string {
+	env := make(map[string]string, len(values))
+	for key, value := range values {
+		env["MATRIX_"+envName(key)] = value
+	}
+	return env
+}
+
+// envName turns an arbitrary key into a valid environment variable name.
+func envName(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, key)
+}
@@ -0,0 +1,258 @@
+package pipeline
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+
+	"snap-ci/config"
+)
+
+func TestExpandMatrix(t *testing.T) {
+	tests := []struct {
+		name       string
+		matrix     config.Matrix
+		wantKeys   []string
+		wantValues []map[string]string
+	}{
+		{
+			name: "cartesian product in declaration order",
+			matrix: config.Matrix{
+				Keys: []string{"os", "go"},
+				Axes: map[string][]string{"os": {"linux", "mac"}, "go": {"1.22", "1.23"}},
+			},
+			wantKeys: []string{"os", "go"},
+			wantValues: []map[string]string{
+				{"os": "linux", "go": "1.22"},
+				{"os": "linux", "go": "1.23"},
+				{"os": "mac", "go": "1.22"},
+				{"os": "mac", "go": "1.23"},
+			},
+		},
+		{
+			name: "exclude drops matching combinations",
+			matrix: config.Matrix{
+				Keys:    []string{"os", "go"},
+				Axes:    map[string][]string{"os": {"linux", "mac"}, "go": {"1.22", "1.23"}},
+				Exclude: []map[string]string{{"os": "mac", "go": "1.22"}},
+			},
+			wantKeys: []string{"os", "go"},
+			wantValues: []map[string]string{
+				{"os": "linux", "go": "1.22"},
+				{"os": "linux", "go": "1.23"},
+				{"os": "mac", "go": "1.23"},
+			},
+		},
+		{
+			name: "partial exclude drops every combination it matches",
+			matrix: config.Matrix{
+				Keys:    []string{"os", "go"},
+				Axes:    map[string][]string{"os": {"linux", "mac"}, "go": {"1.22", "1.23"}},
+				Exclude: []map[string]string{{"os": "mac"}},
+			},
+			wantKeys: []string{"os", "go"},
+			wantValues: []map[string]string{
+				{"os": "linux", "go": "1.22"},
+				{"os": "linux", "go": "1.23"},
+			},
+		},
+		{
+			name: "include extends the combinations it does not contradict",
+			matrix: config.Matrix{
+				Keys:    []string{"go"},
+				Axes:    map[string][]string{"go": {"1.22", "1.23"}},
+				Include: []map[string]string{{"go": "1.23", "experimental": "true"}},
+			},
+			wantKeys: []string{"go", "experimental"},
+			wantValues: []map[string]string{
+				{"go": "1.22"},
+				{"go": "1.23", "experimental": "true"},
+			},
+		},
+		{
+			name: "include with only new keys extends every combination",
+			matrix: config.Matrix{
+				Keys:    []string{"go"},
+				Axes:    map[string][]string{"go": {"1.22", "1.23"}},
+				Include: []map[string]string{{"cache": "on"}},
+			},
+			wantKeys: []string{"go", "cache"},
+			wantValues: []map[string]string{
+				{"go": "1.22", "cache": "on"},
+				{"go": "1.23", "cache": "on"},
+			},
+		},
+		{
+			name: "include contradicting every combination is added on its own",
+			matrix: config.Matrix{
+				Keys:    []string{"go"},
+				Axes:    map[string][]string{"go": {"1.22", "1.23"}},
+				Include: []map[string]string{{"go": "1.24", "os": "windows"}},
+			},
+			wantKeys: []string{"go", "os"},
+			wantValues: []map[string]string{
+				{"go": "1.22"},
+				{"go": "1.23"},
+				{"go": "1.24", "os": "windows"},
+			},
+		},
+		{
+			name: "later include overwrites values added by an earlier one",
+			matrix: config.Matrix{
+				Keys:    []string{"go"},
+				Axes:    map[string][]string{"go": {"1.22", "1.23"}},
+				Include: []map[string]string{{"go": "1.22", "flags": "-race"}, {"flags": "-v"}},
+			},
+			wantKeys: []string{"go", "flags"},
+			wantValues: []map[string]string{
+				{"go": "1.22", "flags": "-v"},
+				{"go": "1.23", "flags": "-v"},
+			},
+		},
+		{
+			name: "include-only matrix",
+			matrix: config.Matrix{
+				Include: []map[string]string{{"os": "linux", "arch": "amd64"}, {"os": "mac", "arch": "arm64"}},
+			},
+			wantKeys: []string{"arch", "os"},
+			wantValues: []map[string]string{
+				{"os": "linux", "arch": "amd64"},
+				{"os": "mac", "arch": "arm64"},
+			},
+		},
+		{
+			name: "exclude everything",
+			matrix: config.Matrix{
+				Keys:    []string{"go"},
+				Axes:    map[string][]string{"go": {"1.22"}},
+				Exclude: []map[string]string{{"go": "1.22"}},
+			},
+			wantKeys:   []string{"go"},
+			wantValues: []map[string]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, values := expandMatrix(tt.matrix)
+			if !slices.Equal(keys, tt.wantKeys) {
+				t.Errorf("expandMatrix() keys = %v, want %v", keys, tt.wantKeys)
+			}
+			if len(values) != len(tt.wantValues) || (len(values) > 0 && !reflect.DeepEqual(values, tt.wantValues)) {
+				t.Errorf("expandMatrix() combinations = %v, want %v", values, tt.wantValues)
+			}
+		})
+	}
+}
+
+func TestExpandJobsRewritesNeeds(t *testing.T) {
+	jobs := map[string]config.Job{
+		"test": {Strategy: config.Strategy{Matrix: config.Matrix{
+			Keys: []string{"go"},
+			Axes: map[string][]string{"go": {"1.22", "1.23"}},
+		}}},
+		"deploy": {Needs: config.StringList{"test", "missing"}},
+	}
+
+	nodes, err := expandJobs(jobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for name := range nodes {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	if want := []string{"deploy", "test (go=1.22)", "test (go=1.23)"}; !slices.Equal(names, want) {
+		t.Fatalf("expandJobs() nodes = %v, want %v", names, want)
+	}
+
+	// Unknown needs are kept for resolveJobOrder to report
+	if got, want := []string(nodes["deploy"].Job.Needs), []string{"test (go=1.22)", "test (go=1.23)", "missing"}; !slices.Equal(got, want) {
+		t.Errorf("deploy needs = %v, want %v", got, want)
+	}
+	if node := nodes["test (go=1.23)"]; node.Group != "test" || node.Matrix["go"] != "1.23" {
+		t.Errorf("variant = %+v, want group test with go=1.23", node)
+	}
+}
+
+func TestExpandJobsErrors(t *testing.T) {
+	matrixJob := func(matrix config.Matrix) config.Job {
+		return config.Job{Strategy: config.Strategy{Matrix: matrix}}
+	}
+
+	tests := []struct {
+		name    string
+		jobs    map[string]config.Job
+		wantErr string
+	}{
+		{
+			name: "everything excluded",
+			jobs: map[string]config.Job{
+				"test": matrixJob(config.Matrix{
+					Keys:    []string{"go"},
+					Axes:    map[string][]string{"go": {"1.22"}},
+					Exclude: []map[string]string{{"go": "1.22"}},
+				}),
+				"deploy": {Needs: config.StringList{"test"}},
+			},
+			wantErr: "matrix of job 'test' has no combinations left after exclude",
+		},
+		{
+			name: "duplicate axis value",
+			jobs: map[string]config.Job{
+				"test": matrixJob(config.Matrix{
+					Keys: []string{"go"},
+					Axes: map[string][]string{"go": {"1.22", "1.22"}},
+				}),
+			},
+			wantErr: "matrix of job 'test' has the variant 'test (go=1.22)' more than once",
+		},
+		{
+			name: "duplicate include entry",
+			jobs: map[string]config.Job{
+				"test": matrixJob(config.Matrix{
+					Include: []map[string]string{{"go": "1.22"}, {"go": "1.22"}},
+				}),
+			},
+			wantErr: "matrix of job 'test' has the variant 'test (go=1.22)' more than once",
+		},
+		{
+			name: "job named like a variant",
+			jobs: map[string]config.Job{
+				"test": matrixJob(config.Matrix{
+					Keys: []string{"go"},
+					Axes: map[string][]string{"go": {"1.22", "1.23"}},
+				}),
+				"test (go=1.23)": {},
+			},
+			wantErr: "job 'test (go=1.23)' has the same name as a variant of job 'test'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes, err := expandJobs(tt.jobs)
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("expandJobs() = %v, %v; want error %q", nodes, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVariantName(t *testing.T) {
+	tests := []struct {
+		keys   []string
+		values map[string]string
+		want   string
+	}{
+		{[]string{"go"}, map[string]string{"go": "1.22"}, "test (go=1.22)"},
+		{[]string{"os", "go"}, map[string]string{"go": "1.22", "os": "linux"}, "test (os=linux, go=1.22)"},
+		{[]string{"os", "go", "extra"}, map[string]string{"os": "mac", "extra": "x"}, "test (os=mac, extra=x)"},
+	}
+	for _, tt := range tests {
+		if got := variantName("test", tt.keys, tt.values); got != tt.want {
+			t.Errorf("variantName(%v, %v) = %q, want %q", tt.keys, tt.values, got, tt.want)
+		}
+	}
+}
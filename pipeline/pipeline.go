@@ -1,44 +1,300 @@
 package pipeline
 
 import (
+	"context"
+	"errors"
+	"io"
 	"log"
 	"snap-ci/config"
 	"snap-ci/executor"
 	"snap-ci/types"
+	"sync"
+	"time"
 )
 
-// ExecutePipeline executes the pipeline defined in the config
-func ExecutePipeline(cfg config.Config) (map[string]types.JobResult, error) {
+// DefaultJobTimeout bounds jobs that don't set timeout-minutes; 0 disables the limit.
+var DefaultJobTimeout = 60 * time.Minute
+
+// DefaultStepTimeout bounds steps that don't set timeout-minutes; 0 leaves
+// them bounded by their job's timeout only. A step never outlives its job.
+var DefaultStepTimeout time.Duration
+
+// Options configures a single pipeline execution.
+type Options struct {
+	WorkDir string             // The run's checked-out workspace; steps run inside it
+	Output  io.Writer          // Receives step output live, line by line; may be nil
+	Run     *types.PipelineRun // Source of the SNAPCI_* variables and `${{ run.x }}`; may be nil
+	Secrets map[string]string  // The repository's decrypted secrets, available as `${{ secrets.NAME }}`
+
+	// OnJobDone, if set, is called with the result of each job as soon as it
+	// has finished, been skipped or been cancelled. Jobs finish concurrently,
+	// so it must be safe to call from several goroutines.
+	OnJobDone func(name string, result types.JobResult)
+}
+
+// ExecutePipeline executes the pipeline defined in the config inside
+// opts.WorkDir, the run's checked-out workspace. Matrix jobs are expanded
+// into one job per variant, then jobs are scheduled in dependency order
+// according to their `needs`, and independent jobs run in parallel up to the
+// pipeline's max-parallel limit. A job whose upstream job did not succeed is
+// marked as skipped. When a variant of a fail-fast matrix fails, its running
+// siblings are cancelled and those yet to start are skipped. Jobs and steps
+// are bounded by their timeout-minutes.
+// Cancelling ctx terminates the running steps and marks every step that
+// did not get to finish as cancelled. Steps see the pipeline, job and step
+// env blocks merged in that order, on top of the built-in SNAPCI_* variables.
+// Secret values are masked in step names, output and logs.
+func ExecutePipeline(ctx context.Context, cfg config.Config, opts Options) (map[string]types.JobResult, error) {
+	nodes, err := expandJobs(cfg.Jobs)
+	if err != nil {
+		return nil, err
+	}
+
+	graph := make(map[string]config.Job, len(nodes))
+	for name, node := range nodes {
+		graph[name] = node.Job
+	}
+	order, err := resolveJobOrder(graph)
+	if err != nil {
+		return nil, err
+	}
+
+	maxParallel := cfg.MaxParallel
+	if maxParallel <= 0 {
+		maxParallel = config.DefaultMaxParallel
+	}
+
+	// Built-in variables first, then the pipeline-level env block
+	env := builtinEnv(opts.Run, opts.WorkDir)
+	vars := runVars(opts.Run, opts.WorkDir)
+	for key, value := range env {
+		vars["env."+key] = value
+	}
+	for name, value := range opts.Secrets {
+		vars["secrets."+name] = value
+	}
+	mergeEnv(env, vars, cfg.Env)
+	redactor := executor.NewRedactor(secretValues(opts.Secrets))
+
 	jobResults := make(map[string]types.JobResult)
+	failedGroups := make(map[string]bool) // Matrix jobs stopped by fail-fast
+	var mu sync.Mutex                     // Guards jobResults and failedGroups
 
-	// startTime := time.Now() // If you add timestamps
-	for jobName, job := range cfg.Jobs {
-		// jobStartTime := time.Now() // If you add timestamps
-		jobResult := types.JobResult{
-			Status: "Success",
-			Steps:  make(map[string]types.StepResult),
+	// A fail-fast matrix shares a context, cancelled when one of its variants
+	// fails, so that the variants still running end as cancelled
+	groupCtx := make(map[string]context.Context)
+	groupCancel := make(map[string]context.CancelFunc)
+	for _, node := range nodes {
+		if node.Matrix != nil && node.Job.Strategy.IsFailFast() && groupCtx[node.Group] == nil {
+			groupCtx[node.Group], groupCancel[node.Group] = context.WithCancel(ctx)
+			defer groupCancel[node.Group]()
 		}
+	}
 
-		for _, step := range job.Steps {
-			// stepStartTime := time.Now() // If you add timestamps
-			stepResult, err := executor.ExecuteStep(executor.Step(step), "temp_repo") // Assuming "temp_repo" is the working dir
-			// stepEndTime := time.Now()
+	done := make(map[string]chan struct{}, len(order))
+	for _, jobName := range order {
+		done[jobName] = make(chan struct{})
+	}
+	slots := make(chan struct{}, maxParallel)
 
-			jobResult.Steps[step.Name] = stepResult // Store the StepResult
+	var wg sync.WaitGroup
+	for _, jobName := range order {
+		wg.Add(1)
+		go func(node jobNode) {
+			defer wg.Done()
+			defer close(done[node.Name])
 
-			if err != nil {
-				jobResult.Status = "Failure"
-				log.Printf("Job '%s', Step '%s' failed: %v", jobName, step.Name, err)
-				break // Stop executing steps in this job
+			// Wait for every upstream job to finish before deciding whether to run
+			for _, need := range node.Job.Needs {
+				<-done[need]
 			}
-			// Optionally log step success
-			log.Printf("Job '%s', Step '%s' succeeded", jobName, step.Name)
 
-		}
-		// jobEndTime := time.Now()
-		jobResults[jobName] = jobResult
+			mu.Lock()
+			failedNeed := ""
+			for _, need := range node.Job.Needs {
+				if jobResults[need].Status != types.StatusSuccess {
+					failedNeed = need
+					break
+				}
+			}
+			mu.Unlock()
+
+			var jobResult types.JobResult
+			if ctx.Err() != nil {
+				log.Printf("Job '%s' cancelled before it started", node.Name)
+				jobResult = cancelledJob(node, env, vars, redactor)
+			} else if failedNeed != "" {
+				log.Printf("Job '%s' skipped: upstream job '%s' did not succeed", node.Name, failedNeed)
+				jobResult = skippedJob()
+			} else {
+				slots <- struct{}{}
+				mu.Lock()
+				stopped := failedGroups[node.Group]
+				mu.Unlock()
+				if ctx.Err() != nil {
+					log.Printf("Job '%s' cancelled before it started", node.Name)
+					jobResult = cancelledJob(node, env, vars, redactor)
+				} else if stopped {
+					log.Printf("Job '%s' skipped: another variant of '%s' failed (fail-fast)", node.Name, node.Group)
+					jobResult = skippedJob()
+				} else if jobCtx := groupCtx[node.Group]; jobCtx != nil {
+					jobResult = executeJob(jobCtx, node, opts, env, vars)
+				} else {
+					jobResult = executeJob(ctx, node, opts, env, vars)
+				}
+				<-slots
+			}
+
+			mu.Lock()
+			jobResults[node.Name] = jobResult
+			if jobResult.Status == types.StatusFailure && groupCancel[node.Group] != nil {
+				if !failedGroups[node.Group] {
+					log.Printf("Job '%s' failed; cancelling the other variants of '%s' (fail-fast)", node.Name, node.Group)
+				}
+				failedGroups[node.Group] = true
+				groupCancel[node.Group]()
+			}
+			mu.Unlock()
+			if opts.OnJobDone != nil {
+				opts.OnJobDone(node.Name, jobResult)
+			}
+		}(nodes[jobName])
 	}
-	// endTime := time.Now()
+	wg.Wait()
 
 	return jobResults, nil
 }
+
+// Succeeded reports whether every job of a run finished successfully.
+func Succeeded(results map[string]types.JobResult) bool {
+	for _, result := range results {
+		if result.Status != types.StatusSuccess {
+			return false
+		}
+	}
+	return true
+}
+
+func skippedJob() types.JobResult {
+	return types.JobResult{
+		Status: types.StatusSkipped,
+		Steps:  []types.StepResult{},
+	}
+}
+
+// cancelledJob is the result of a job that never started because the run was cancelled.
+func cancelledJob(node jobNode, env, vars map[string]string, redactor *executor.Redactor) types.JobResult {
+	jobResult := types.JobResult{
+		Status: types.StatusCancelled,
+		Steps:  []types.StepResult{},
+	}
+	_, jobVars := jobScope(node, env, vars)
+	cancelSteps(&jobResult, node.Job.Steps, jobVars, redactor)
+	return jobResult
+}
+
+// cancelSteps appends the steps that will not run because the run was cancelled.
+func cancelSteps(jobResult *types.JobResult, steps []config.Step, vars map[string]string, redactor *executor.Redactor) {
+	for _, step := range steps {
+		jobResult.Steps = append(jobResult.Steps, types.StepResult{
+			Index:    len(jobResult.Steps),
+			Name:     redactor.Redact(interpolate(step.Name, vars)),
+			Status:   types.StatusCancelled,
+			ExitCode: types.NoExitCode,
+		})
+	}
+}
+
+// jobScope layers a job's matrix values and env block on top of the
+// pipeline-level env and interpolation variables.
+func jobScope(node jobNode, env, vars map[string]string) (map[string]string, map[string]string) {
+	env, vars = copyVars(env), copyVars(vars)
+	for key, value := range matrixVars(node.Matrix) {
+		vars[key] = value
+	}
+	for key, value := range matrixEnv(node.Matrix) {
+		env[key] = value
+		vars["env."+key] = value
+	}
+	mergeEnv(env, vars, node.Job.Env)
+	return env, vars
+}
+
+// executeJob runs the steps of a single job in order, stopping at the first failure.
+// `${{ env.X }}`, `${{ run.x }}`, `${{ secrets.NAME }}` and, for matrix variants, `${{ matrix.x }}`
+// expressions are substituted in step names and commands; matrix values are
+// also exported as MATRIX_X variables.
+func executeJob(ctx context.Context, node jobNode, opts Options, env, vars map[string]string) types.JobResult {
+	jobResult := types.JobResult{
+		Status:    types.StatusSuccess,
+		Steps:     []types.StepResult{},
+		StartTime: time.Now(),
+	}
+
+	jobTimeout := DefaultJobTimeout
+	if node.Job.TimeoutMinutes > 0 {
+		jobTimeout = time.Duration(node.Job.TimeoutMinutes) * time.Minute
+	}
+	if jobTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, jobTimeout)
+		defer cancel()
+	}
+
+	env, vars = jobScope(node, env, vars)
+	secrets := secretValues(opts.Secrets)
+	redactor := executor.NewRedactor(secrets)
+
+	for i, step := range node.Job.Steps {
+		if errors.Is(ctx.Err(), context.Canceled) {
+			jobResult.Status = types.StatusCancelled
+			cancelSteps(&jobResult, node.Job.Steps[i:], vars, redactor)
+			log.Printf("Job '%s' cancelled", node.Name)
+			break
+		}
+
+		stepEnv, stepVars := copyVars(env), copyVars(vars)
+		mergeEnv(stepEnv, stepVars, step.Env)
+
+		execStep := executor.Step{
+			Name:    redactor.Redact(interpolate(step.Name, stepVars)),
+			Run:     interpolate(step.Run, stepVars),
+			Env:     envList(stepEnv),
+			Job:     node.Name,
+			Secrets: secrets,
+		}
+
+		// The step's context derives from the job's, so whichever of the two
+		// timeouts expires first terminates the step
+		stepTimeout := DefaultStepTimeout
+		if step.TimeoutMinutes > 0 {
+			stepTimeout = time.Duration(step.TimeoutMinutes) * time.Minute
+		}
+		stepCtx, cancel := ctx, context.CancelFunc(func() {})
+		if stepTimeout > 0 {
+			stepCtx, cancel = context.WithTimeout(ctx, stepTimeout)
+		}
+
+		stepResult, err := executor.ExecuteStep(stepCtx, execStep, opts.WorkDir, opts.Output)
+		cancel()
+
+		stepResult.Index = i
+		jobResult.Steps = append(jobResult.Steps, stepResult) // Store the StepResult
+
+		if err != nil {
+			jobResult.Status = types.StatusFailure
+			if stepResult.Status == types.StatusCancelled {
+				jobResult.Status = types.StatusCancelled
+				cancelSteps(&jobResult, node.Job.Steps[i+1:], vars, redactor)
+			}
+			log.Printf("Job '%s', Step '%s' failed: %v", node.Name, execStep.Name, err)
+			break // Stop executing steps in this job
+		}
+		// Optionally log step success
+		log.Printf("Job '%s', Step '%s' succeeded", node.Name, execStep.Name)
+	}
+	jobResult.EndTime = time.Now()
+	jobResult.Duration = jobResult.EndTime.Sub(jobResult.StartTime)
+
+	return jobResult
+}
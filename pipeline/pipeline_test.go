@@ -0,0 +1,64 @@
+package pipeline
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"snap-ci/config"
+	"snap-ci/executor"
+	"snap-ci/types"
+)
+
+// useTimeouts sets the global job and step timeouts for the test.
+func useTimeouts(t *testing.T, job, step time.Duration) {
+	t.Helper()
+	previousJob, previousStep, previousGrace := DefaultJobTimeout, DefaultStepTimeout, executor.TerminationGracePeriod
+	DefaultJobTimeout, DefaultStepTimeout, executor.TerminationGracePeriod = job, step, time.Second
+	t.Cleanup(func() {
+		DefaultJobTimeout, DefaultStepTimeout, executor.TerminationGracePeriod = previousJob, previousStep, previousGrace
+	})
+}
+
+func TestStepTimeouts(t *testing.T) {
+	tests := []struct {
+		name        string
+		jobTimeout  time.Duration
+		stepTimeout time.Duration
+		wantSlow    string // Status of the step that sleeps for a second
+		wantJob     string
+	}{
+		{"no limits", 0, 0, types.StatusSuccess, types.StatusSuccess},
+		{"default step timeout", 0, 200 * time.Millisecond, types.StatusTimedOut, types.StatusFailure},
+		{"step bounded by the job", 300 * time.Millisecond, 0, types.StatusTimedOut, types.StatusFailure},
+		{"job shorter than the step default", 300 * time.Millisecond, time.Minute, types.StatusTimedOut, types.StatusFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTimeouts(t, tt.jobTimeout, tt.stepTimeout)
+			cfg := config.Config{Jobs: map[string]config.Job{
+				"build": {Steps: []config.Step{
+					{Name: "quick", Run: "true"},
+					{Name: "slow", Run: "sleep 1"},
+				}},
+			}}
+
+			start := time.Now()
+			results, err := ExecutePipeline(context.Background(), cfg, Options{WorkDir: t.TempDir()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("the pipeline took %s", elapsed)
+			}
+
+			result := results["build"]
+			if len(result.Steps) != 2 || result.Steps[0].Status != types.StatusSuccess || result.Steps[1].Status != tt.wantSlow {
+				t.Errorf("steps = %+v, want the slow step %s", result.Steps, tt.wantSlow)
+			}
+			if result.Status != tt.wantJob {
+				t.Errorf("job status = %s, want %s", result.Status, tt.wantJob)
+			}
+		})
+	}
+}
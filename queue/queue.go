@@ -0,0 +1,92 @@
+// queue/queue.go
+
+package queue
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"snap-ci/types"
+)
+
+// DefaultWorkers is the number of runs executed concurrently when not configured.
+const DefaultWorkers = 2
+
+// DefaultCapacity is how many runs may wait in the queue before new ones are rejected.
+const DefaultCapacity = 100
+
+// Handler executes a single queued run.
+type Handler func(run *types.PipelineRun)
+
+// Queue is a bounded FIFO of pipeline runs drained by a pool of workers.
+type Queue struct {
+	runs    chan *types.PipelineRun
+	handler Handler
+	workers int
+	wg      sync.WaitGroup
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// New creates a queue that runs handler on up to `workers` runs at a time.
+// Call Start to launch the workers.
+func New(workers, capacity int, handler Handler) *Queue {
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	if capacity <= 0 {
+		capacity = DefaultCapacity
+	}
+	return &Queue{
+		runs:    make(chan *types.PipelineRun, capacity),
+		handler: handler,
+		workers: workers,
+	}
+}
+
+// Start launches the worker pool.
+func (q *Queue) Start() {
+	for i := 0; i < q.workers; i++ {
+		q.wg.Add(1)
+		go q.work(i + 1)
+	}
+	log.Printf("Run queue started with %d worker(s)", q.workers)
+}
+
+func (q *Queue) work(id int) {
+	defer q.wg.Done()
+	for run := range q.runs {
+		log.Printf("Worker %d picked up run %s", id, run.ID)
+		q.handler(run)
+	}
+}
+
+// Enqueue adds a run to the queue without blocking. It fails when the queue
+// is full or has been shut down.
+func (q *Queue) Enqueue(run *types.PipelineRun) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return fmt.Errorf("run queue is shut down")
+	}
+
+	select {
+	case q.runs <- run:
+		return nil
+	default:
+		return fmt.Errorf("run queue is full (%d runs waiting)", cap(q.runs))
+	}
+}
+
+// Shutdown stops accepting runs and waits for the queued ones to finish.
+func (q *Queue) Shutdown() {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.runs)
+	}
+	q.mu.Unlock()
+	q.wg.Wait()
+}
@@ -0,0 +1,72 @@
+package queue
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"snap-ci/types"
+)
+
+func TestQueueRunsEveryRunWithBoundedConcurrency(t *testing.T) {
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	done := make(map[string]bool)
+
+	q := New(2, 10, func(run *types.PipelineRun) {
+		mu.Lock()
+		running++
+		maxRunning = max(maxRunning, running)
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		done[run.ID] = true
+		mu.Unlock()
+	})
+	q.Start()
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		if err := q.Enqueue(&types.PipelineRun{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q.Shutdown() // Waits for the queued runs
+
+	if len(done) != 5 {
+		t.Errorf("%d of 5 runs handled before Shutdown returned", len(done))
+	}
+	if maxRunning != 2 {
+		t.Errorf("%d runs ran at once, want 2", maxRunning)
+	}
+}
+
+func TestEnqueueFailsWhenFullOrShutDown(t *testing.T) {
+	release := make(chan struct{})
+	q := New(1, 1, func(run *types.PipelineRun) { <-release })
+	q.Start()
+
+	if err := q.Enqueue(&types.PipelineRun{ID: "running"}); err != nil {
+		t.Fatal(err)
+	}
+	// Wait for the worker to take the first run, which frees the only slot
+	deadline := time.Now().Add(2 * time.Second)
+	for len(q.runs) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if err := q.Enqueue(&types.PipelineRun{ID: "waiting"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Enqueue(&types.PipelineRun{ID: "rejected"}); err == nil || !strings.Contains(err.Error(), "full") {
+		t.Errorf("Enqueue() on a full queue: error = %v", err)
+	}
+
+	close(release)
+	q.Shutdown()
+	if err := q.Enqueue(&types.PipelineRun{ID: "late"}); err == nil || !strings.Contains(err.Error(), "shut down") {
+		t.Errorf("Enqueue() after Shutdown: error = %v", err)
+	}
+	q.Shutdown() // A second Shutdown has no effect
+}
@@ -0,0 +1,141 @@
+package schedule
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCronErrors(t *testing.T) {
+	tests := []struct {
+		expr    string
+		wantErr string
+	}{
+		{"* * * *", "expected 5 fields"},
+		{"* * * * * *", "expected 5 fields"},
+		{"", "expected 5 fields"},
+		{"@every 5m", "expected 5 fields"},
+		{"60 * * * *", "invalid minute"},
+		{"* 24 * * *", "invalid hour"},
+		{"* * 0 * *", "invalid day of month"},
+		{"* * 32 * *", "invalid day of month"},
+		{"* * * 13 *", "invalid month"},
+		{"* * * foo *", "invalid month"},
+		{"* * * * 8", "invalid day of week"},
+		{"* * * * SUNDAY", "invalid day of week"},
+		{"*/0 * * * *", "invalid step '0'"},
+		{"*/x * * * *", "invalid step 'x'"},
+		{"30-10 * * * *", "ends before it starts"},
+		{"1,,2 * * * *", "invalid value ''"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			_, err := ParseCron(tt.expr)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ParseCron(%q) error = %v, want %q", tt.expr, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	utc := func(s string) time.Time {
+		t.Helper()
+		parsed, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			if parsed, err = time.Parse("2006-01-02 15:04:05", s); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return parsed
+	}
+
+	// 2026-01-01 is a Thursday
+	tests := []struct {
+		name  string
+		expr  string
+		after string
+		want  string // Empty if the expression never matches
+	}{
+		{"every minute", "* * * * *", "2026-01-01 00:00", "2026-01-01 00:01"},
+		{"seconds are dropped", "* * * * *", "2026-01-01 00:00:42", "2026-01-01 00:01"},
+		{"step", "*/15 * * * *", "2026-01-01 00:15", "2026-01-01 00:30"},
+		{"step from a start value", "5/20 * * * *", "2026-01-01 00:30", "2026-01-01 00:45"},
+		{"range with step", "0 1-10/3 * * *", "2026-01-01 04:00", "2026-01-01 07:00"},
+		{"list", "0 8,20 * * *", "2026-01-01 09:00", "2026-01-01 20:00"},
+		{"next day", "30 6 * * *", "2026-01-01 07:00", "2026-01-02 06:30"},
+		{"weekdays by name", "0 9 * * MON-FRI", "2026-01-02 10:00", "2026-01-05 09:00"},
+		{"7 is Sunday", "0 0 * * 7", "2026-01-01 00:00", "2026-01-04 00:00"},
+		{"0 is Sunday", "0 0 * * 0", "2026-01-01 00:00", "2026-01-04 00:00"},
+		{"month names", "0 12 1 jan,JUL *", "2026-02-01 00:00", "2026-07-01 12:00"},
+		{"day of month or day of week", "0 0 1 * MON", "2026-01-01 00:00", "2026-01-05 00:00"},
+		{"day of month or day of week, 1st first", "0 0 1 * MON", "2026-01-26 00:00", "2026-02-01 00:00"},
+		{"starred day of week must match too", "0 0 */2 * 1", "2026-01-01 00:00", "2026-01-05 00:00"},
+		{"macro", "@monthly", "2026-01-15 00:00", "2026-02-01 00:00"},
+		{"macro is case insensitive", "@Weekly", "2026-01-01 00:00", "2026-01-04 00:00"},
+		{"leap day", "0 0 29 2 *", "2026-01-01 00:00", "2028-02-29 00:00"},
+		{"year end", "0 0 1 1 *", "2026-12-31 23:59", "2027-01-01 00:00"},
+		{"never", "0 0 30 2 *", "2026-01-01 00:00", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cron, err := ParseCron(tt.expr)
+			if err != nil {
+				t.Fatalf("ParseCron(%q) error = %v", tt.expr, err)
+			}
+			got := cron.Next(utc(tt.after))
+			if tt.want == "" {
+				if !got.IsZero() {
+					t.Errorf("Next(%s) = %s, want no match", tt.after, got)
+				}
+				return
+			}
+			if want := utc(tt.want); !got.Equal(want) {
+				t.Errorf("Next(%s) = %s, want %s", tt.after, got, want)
+			}
+		})
+	}
+}
+
+func TestCronNextInLocation(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("no time zone data: %v", err)
+	}
+	tests := []struct {
+		name  string
+		expr  string
+		after time.Time
+		want  time.Time
+	}{
+		{
+			name:  "wall clock time",
+			expr:  "0 9 * * *",
+			after: time.Date(2026, 1, 1, 10, 0, 0, 0, berlin),
+			want:  time.Date(2026, 1, 2, 9, 0, 0, 0, berlin),
+		},
+		{
+			name:  "wall clock time across the switch to summer time",
+			expr:  "0 9 * * *",
+			after: time.Date(2026, 3, 28, 10, 0, 0, 0, berlin),
+			want:  time.Date(2026, 3, 29, 9, 0, 0, 0, berlin),
+		},
+		{
+			name:  "time skipped by the switch to summer time waits a day",
+			expr:  "30 2 * * *",
+			after: time.Date(2026, 3, 29, 1, 0, 0, 0, berlin),
+			want:  time.Date(2026, 3, 30, 2, 30, 0, 0, berlin),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cron, err := ParseCron(tt.expr)
+			if err != nil {
+				t.Fatalf("ParseCron(%q) error = %v", tt.expr, err)
+			}
+			if got := cron.Next(tt.after); !got.Equal(tt.want) || got.Location() != berlin {
+				t.Errorf("Next(%s) = %s, want %s", tt.after, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+// schedule/schedule.go
+
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"snap-ci/config"
+	"snap-ci/storage"
+)
+
+// DefaultFile is where schedules and their last fire times are stored when not configured.
+const DefaultFile = "schedules.json"
+
+// tickInterval is how often the scheduler checks for due schedules.
+const tickInterval = 30 * time.Second
+
+// Entry is a schedule of a repository's pipeline, taken from `on.schedule`
+// of the .ci.yaml last built on its default branch.
+type Entry struct {
+	RepoName string    `json:"repo_name"`
+	Branch   string    `json:"branch"`    // The repository's default branch
+	CloneURL string    `json:"clone_url"` // Without credentials
+	Cron     string    `json:"cron"`
+	Timezone string    `json:"timezone,omitempty"`
+	Since    time.Time `json:"since"`     // When the schedule was added; it first fires after this
+	LastFire time.Time `json:"last_fire"` // The scheduled time of the last run it started
+}
+
+// Next returns when the entry fires next after its last run, or after it
+// was added if it has not fired yet.
+func (e Entry) Next() (time.Time, error) {
+	cron, loc, err := parse(e.Cron, e.Timezone)
+	if err != nil {
+		return time.Time{}, err
+	}
+	base := e.LastFire
+	if base.IsZero() {
+		base = e.Since
+	}
+	return cron.Next(base.In(loc)), nil
+}
+
+func (e Entry) sameSchedule(other Entry) bool {
+	return e.RepoName == other.RepoName && e.Cron == other.Cron && e.Timezone == other.Timezone
+}
+
+// File holds the schedules. Its lock serializes access within this process;
+// its lock file serializes it with other snapci processes, e.g. `snapci
+// webhooks` and `snapci watch start` running side by side, so that a due
+// schedule is taken by exactly one of them.
+var File = storage.NewJSONFile(DefaultFile, "schedules")
+
+var started bool // Guarded by File's lock
+
+// Validate checks the cron expressions and timezones of `on.schedule`.
+func Validate(schedules []config.Schedule) error {
+	var errs []error
+	for _, s := range schedules {
+		if _, _, err := parse(s.Cron, s.Timezone); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func parse(expr, timezone string) (*Cron, *time.Location, error) {
+	cron, err := ParseCron(expr)
+	if err != nil {
+		return nil, nil, err
+	}
+	loc := time.UTC
+	if timezone != "" {
+		if loc, err = time.LoadLocation(timezone); err != nil {
+			return nil, nil, fmt.Errorf("invalid timezone '%s' for cron '%s': %w", timezone, expr, err)
+		}
+	}
+	return cron, loc, nil
+}
+
+// Update replaces the schedules of a repository with those of its current
+// .ci.yaml. Schedules that did not change keep their last fire time, so
+// updating never makes a schedule fire twice or skip a run.
+func Update(repoName, branch, cloneURL string, schedules []config.Schedule) error {
+	File.Lock()
+	defer File.Unlock()
+	unlock, err := File.LockFile()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	entries, err := readEntries()
+	if err != nil {
+		return err
+	}
+	var kept, previous []Entry
+	for _, e := range entries {
+		if e.RepoName == repoName {
+			previous = append(previous, e)
+		} else {
+			kept = append(kept, e)
+		}
+	}
+
+	now := time.Now()
+	for _, s := range schedules {
+		entry := Entry{RepoName: repoName, Branch: branch, CloneURL: cloneURL, Cron: s.Cron, Timezone: s.Timezone, Since: now}
+		for _, old := range previous {
+			if old.sameSchedule(entry) {
+				entry.Since, entry.LastFire = old.Since, old.LastFire
+				break
+			}
+		}
+		kept = append(kept, entry)
+	}
+	if len(previous) == 0 && len(schedules) == 0 {
+		return nil // Nothing to write
+	}
+	return File.Write(kept)
+}
+
+// List returns all schedules, sorted by repository.
+func List() ([]Entry, error) {
+	File.Lock()
+	defer File.Unlock()
+	entries, err := readEntries()
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].RepoName < entries[j].RepoName })
+	return entries, nil
+}
+
+// Start runs the scheduler in the background: whenever a schedule is due,
+// its new last fire time is stored and fire is called with it. A schedule
+// that came due while no scheduler was running fires once when the
+// scheduler starts, however many times it should have fired meanwhile.
+// Calling Start again has no effect.
+func Start(fire func(Entry)) {
+	File.Lock()
+	defer File.Unlock()
+	if started {
+		return
+	}
+	started = true
+	path := File.Path()
+
+	go func() {
+		log.Printf("Scheduler started, checking %s every %s", path, tickInterval)
+		for {
+			for _, entry := range takeDue(time.Now()) {
+				fire(entry)
+			}
+			time.Sleep(tickInterval)
+		}
+	}()
+}
+
+// takeDue returns the entries due at now, with their last fire time moved
+// to their most recent due time, and stores those times before the runs
+// are started: a crash in between skips a run rather than repeating it.
+func takeDue(now time.Time) []Entry {
+	File.Lock()
+	defer File.Unlock()
+	unlock, err := File.LockFile()
+	if err != nil {
+		log.Printf("Scheduler: %v", err)
+		return nil
+	}
+	defer unlock()
+
+	entries, err := readEntries()
+	if err != nil {
+		log.Printf("Scheduler: %v", err)
+		return nil
+	}
+	var due []Entry
+	for i, e := range entries {
+		cron, loc, err := parse(e.Cron, e.Timezone)
+		if err != nil {
+			log.Printf("Scheduler: skipping schedule of %s: %v", e.RepoName, err)
+			continue
+		}
+		next, _ := e.Next()
+		if next.IsZero() || next.After(now) {
+			continue
+		}
+		missed := 0
+		for later := cron.Next(next.In(loc)); !later.IsZero() && !later.After(now); later = cron.Next(later) {
+			next = later
+			missed++
+		}
+		if missed > 0 {
+			log.Printf("Scheduler: '%s' of %s was due %d more times while the scheduler was not running; running it once", e.Cron, e.RepoName, missed)
+		}
+		entries[i].LastFire = next
+		due = append(due, entries[i])
+	}
+	if len(due) == 0 {
+		return nil
+	}
+	if err := File.Write(entries); err != nil {
+		log.Printf("Scheduler: not starting %d due runs: %v", len(due), err)
+		return nil
+	}
+	return due
+}
+
+func readEntries() ([]Entry, error) {
+	var entries []Entry
+	err := File.Read(&entries)
+	return entries, err
+}
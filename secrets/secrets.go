@@ -0,0 +1,331 @@
+// secrets/secrets.go
+
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// MasterKeyEnv holds the base64-encoded 32-byte master key. It takes
+	// precedence over the key file.
+	MasterKeyEnv = "SNAPCI_MASTER_KEY"
+	// DefaultKeyFile is where the master key is read from, and generated on
+	// first use, when MasterKeyEnv is not set.
+	DefaultKeyFile = "secrets.key"
+
+	secretsDir = "secrets"
+	keySize    = 32 // AES-256
+)
+
+// namePattern restricts secret names to what is valid in `${{ secrets.NAME }}`
+// and as an environment variable name.
+var namePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Info describes a stored secret without revealing its value.
+type Info struct {
+	Name      string    `json:"name"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// entry is a single encrypted secret as stored on disk.
+type entry struct {
+	Value     string    `json:"value"` // base64(nonce || AES-GCM ciphertext)
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+var (
+	mu      sync.Mutex // Serializes writers of the secrets files
+	keyFile = DefaultKeyFile
+)
+
+// Configure sets the path of the master key file.
+func Configure(path string) {
+	if path == "" {
+		path = DefaultKeyFile
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	keyFile = path
+}
+
+// Set encrypts and stores a secret for a repository, replacing any previous value.
+func Set(repoName, name, value string) error {
+	if err := validateName(name); err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	key, err := masterKey(true)
+	if err != nil {
+		return err
+	}
+	entries, err := readEntries(repoName)
+	if err != nil {
+		return err
+	}
+
+	sealed, err := encrypt(key, []byte(value), additionalData(repoName, name))
+	if err != nil {
+		return err
+	}
+	entries[name] = entry{Value: sealed, UpdatedAt: time.Now()}
+	return writeEntries(repoName, entries)
+}
+
+// Remove deletes a secret of a repository.
+func Remove(repoName, name string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	entries, err := readEntries(repoName)
+	if err != nil {
+		return err
+	}
+	if _, ok := entries[name]; !ok {
+		return fmt.Errorf("secret '%s' not found for repository '%s'", name, repoName)
+	}
+	delete(entries, name)
+	return writeEntries(repoName, entries)
+}
+
+// List returns the names of a repository's secrets, sorted by name.
+func List(repoName string) ([]Info, error) {
+	entries, err := readEntries(repoName)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]Info, 0, len(entries))
+	for name, e := range entries {
+		infos = append(infos, Info{Name: name, UpdatedAt: e.UpdatedAt})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+// Load decrypts all secrets of a repository, keyed by name.
+// A repository without secrets yields an empty map and no master key is needed.
+func Load(repoName string) (map[string]string, error) {
+	entries, err := readEntries(repoName)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(entries))
+	if len(entries) == 0 {
+		return values, nil
+	}
+
+	key, err := masterKey(false)
+	if err != nil {
+		return nil, err
+	}
+	for name, e := range entries {
+		plain, err := decrypt(key, e.Value, additionalData(repoName, name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt secret '%s' of repository '%s': %w", name, repoName, err)
+		}
+		values[name] = string(plain)
+	}
+	return values, nil
+}
+
+// Encrypt seals a value kept outside the secrets store, such as a
+// repository's access token, with the master key, generating the key on first
+// use. context binds the ciphertext to its use; Decrypt needs the same context.
+func Encrypt(value, context string) (string, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	key, err := masterKey(true)
+	if err != nil {
+		return "", err
+	}
+	return encrypt(key, []byte(value), externalData(context))
+}
+
+// Decrypt opens a value sealed by Encrypt with the same context.
+func Decrypt(sealed, context string) (string, error) {
+	key, err := masterKey(false)
+	if err != nil {
+		return "", err
+	}
+	plain, err := decrypt(key, sealed, externalData(context))
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+func validateName(name string) error {
+	if !namePattern.MatchString(name) {
+		return fmt.Errorf("invalid secret name '%s' (use letters, digits and underscores, not starting with a digit)", name)
+	}
+	return nil
+}
+
+// additionalData binds a ciphertext to its repository and name, so an
+// encrypted value copied to another secret fails to decrypt.
+func additionalData(repoName, name string) []byte {
+	return []byte(repoName + "\x00" + name)
+}
+
+// externalData is the additional data of values sealed by Encrypt. It starts
+// with a NUL byte, which no repository name does, so it never equals the
+// additional data of a secret.
+func externalData(context string) []byte {
+	return []byte("\x00" + context)
+}
+
+// masterKey returns the key from MasterKeyEnv or the key file. If neither
+// exists and generate is true, a new key file is created.
+func masterKey(generate bool) ([]byte, error) {
+	if encoded := os.Getenv(MasterKeyEnv); encoded != "" {
+		return decodeKey(encoded, MasterKeyEnv)
+	}
+
+	data, err := os.ReadFile(keyFile)
+	if err == nil {
+		return decodeKey(strings.TrimSpace(string(data)), keyFile)
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read master key file: %w", err)
+	}
+	if !generate {
+		return nil, fmt.Errorf("no master key: set %s or provide the key file %s", MasterKeyEnv, keyFile)
+	}
+
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, fmt.Errorf("failed to generate master key: %w", err)
+	}
+	if dir := filepath.Dir(keyFile); dir != "." {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create master key directory: %w", err)
+		}
+	}
+	encoded := base64.StdEncoding.EncodeToString(key)
+	if err := os.WriteFile(keyFile, []byte(encoded+"\n"), 0600); err != nil {
+		return nil, fmt.Errorf("failed to write master key file: %w", err)
+	}
+	log.Printf("Generated a new secrets master key in %s. Back it up: secrets cannot be decrypted without it.", keyFile)
+	return key, nil
+}
+
+func decodeKey(encoded, source string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid master key in %s: %w", source, err)
+	}
+	if len(key) != keySize {
+		return nil, fmt.Errorf("invalid master key in %s: expected %d bytes, got %d", source, keySize, len(key))
+	}
+	return key, nil
+}
+
+func encrypt(key, plain, ad []byte) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed := gcm.Seal(nonce, nonce, plain, ad)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decrypt(key []byte, encoded string, ad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, ad)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// secretsPath returns the file holding a repository's secrets, named by the
+// SHA-256 of the repository name so that no two repositories share a file.
+func secretsPath(repoName string) (string, error) {
+	if repoName == "" || strings.Contains(repoName, "..") || strings.ContainsAny(repoName, `\`) {
+		return "", fmt.Errorf("invalid repository name '%s'", repoName)
+	}
+	sum := sha256.Sum256([]byte(repoName))
+	return filepath.Join(secretsDir, hex.EncodeToString(sum[:])+".json"), nil
+}
+
+func readEntries(repoName string) (map[string]entry, error) {
+	filename, err := secretsPath(repoName)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]entry)
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entries, nil
+		}
+		return nil, fmt.Errorf("failed to read secrets file: %w", err)
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to decode secrets from JSON: %w", err)
+	}
+	return entries, nil
+}
+
+func writeEntries(repoName string, entries map[string]entry) error {
+	filename, err := secretsPath(repoName)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(secretsDir, 0700); err != nil {
+		return fmt.Errorf("failed to create secrets directory: %w", err)
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode secrets to JSON: %w", err)
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated file
+	tmpFilename := filename + ".tmp"
+	if err := os.WriteFile(tmpFilename, data, 0600); err != nil {
+		return fmt.Errorf("failed to write secrets file: %w", err)
+	}
+	if err := os.Rename(tmpFilename, filename); err != nil {
+		return fmt.Errorf("failed to move secrets file into place: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package secrets
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useTempDir runs the test in an empty directory with a fixed master key.
+func useTempDir(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	t.Setenv(MasterKeyEnv, base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", keySize))))
+}
+
+func TestSetAndLoad(t *testing.T) {
+	useTempDir(t)
+
+	if err := Set("owner/repo", "DEPLOY_TOKEN", "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Set("owner/repo", "API_KEY", "abc"); err != nil {
+		t.Fatal(err)
+	}
+	// Used to share a file with owner/repo
+	if err := Set("owner_repo", "DEPLOY_TOKEN", "other"); err != nil {
+		t.Fatal(err)
+	}
+
+	values, err := Load("owner/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2 || values["DEPLOY_TOKEN"] != "hunter2" || values["API_KEY"] != "abc" {
+		t.Errorf("Load(owner/repo) = %v", values)
+	}
+	values, err = Load("owner_repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 1 || values["DEPLOY_TOKEN"] != "other" {
+		t.Errorf("Load(owner_repo) = %v", values)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(secretsDir, "*.json"))
+	for _, file := range files {
+		data, _ := os.ReadFile(file)
+		if strings.Contains(string(data), "hunter2") {
+			t.Errorf("%s holds a secret value in plain text", file)
+		}
+	}
+
+	infos, err := List("owner/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 || infos[0].Name != "API_KEY" || infos[1].Name != "DEPLOY_TOKEN" {
+		t.Errorf("List() = %+v, want API_KEY and DEPLOY_TOKEN", infos)
+	}
+
+	if err := Remove("owner/repo", "API_KEY"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Remove("owner/repo", "API_KEY"); err == nil {
+		t.Error("removing a missing secret succeeded")
+	}
+	if values, _ := Load("owner/repo"); len(values) != 1 {
+		t.Errorf("Load() after Remove = %v", values)
+	}
+}
+
+func TestLoadWithoutSecretsNeedsNoKey(t *testing.T) {
+	useTempDir(t)
+	os.Unsetenv(MasterKeyEnv)
+	Configure(filepath.Join(t.TempDir(), "missing.key"))
+	t.Cleanup(func() { Configure("") })
+
+	values, err := Load("owner/repo")
+	if err != nil || len(values) != 0 {
+		t.Errorf("Load() = %v, %v; want no secrets and no error", values, err)
+	}
+}
+
+func TestLoadWithWrongKey(t *testing.T) {
+	useTempDir(t)
+	if err := Set("owner/repo", "TOKEN", "value"); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(MasterKeyEnv, base64.StdEncoding.EncodeToString([]byte(strings.Repeat("x", keySize))))
+
+	if _, err := Load("owner/repo"); err == nil || !strings.Contains(err.Error(), "failed to decrypt secret 'TOKEN'") {
+		t.Errorf("Load() with another key: error = %v", err)
+	}
+}
+
+func TestCopiedCiphertextDoesNotDecrypt(t *testing.T) {
+	useTempDir(t)
+	if err := Set("owner/repo", "A", "value"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := readEntries("owner/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries["B"] = entries["A"]
+	if err := writeEntries("owner/repo", entries); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load("owner/repo"); err == nil {
+		t.Error("a value copied to another secret name was decrypted")
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	useTempDir(t)
+
+	sealed, err := Encrypt("ghp_token", "access-token\x00owner/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(sealed, "ghp_token") {
+		t.Fatal("Encrypt() returned the value in plain text")
+	}
+	if got, err := Decrypt(sealed, "access-token\x00owner/repo"); err != nil || got != "ghp_token" {
+		t.Errorf("Decrypt() = %q, %v", got, err)
+	}
+	if _, err := Decrypt(sealed, "access-token\x00other/repo"); err == nil {
+		t.Error("Decrypt() with another context succeeded")
+	}
+
+	// A secret's ciphertext cannot be passed off as an external value
+	if err := Set("owner/repo", "TOKEN", "value"); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := readEntries("owner/repo")
+	if _, err := Decrypt(entries["TOKEN"].Value, "owner/repo\x00TOKEN"); err == nil {
+		t.Error("Decrypt() opened a secret's ciphertext")
+	}
+}
+
+func TestInvalidNames(t *testing.T) {
+	useTempDir(t)
+	for _, name := range []string{"", "1ABC", "WITH-DASH", "with space", "a.b"} {
+		if err := Set("owner/repo", name, "v"); err == nil {
+			t.Errorf("Set() accepted the name %q", name)
+		}
+	}
+	for _, repo := range []string{"", "../escape", `owner\repo`} {
+		if err := Set(repo, "NAME", "v"); err == nil {
+			t.Errorf("Set() accepted the repository %q", repo)
+		}
+	}
+}
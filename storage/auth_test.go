@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"snap-ci/secrets"
+)
+
+// useStore points the package-level functions at a fresh store of backend
+// and sets a fixed secrets master key.
+func useStore(t *testing.T, backend string) string {
+	t.Helper()
+	dir := t.TempDir()
+	path := dir
+	if backend == BackendSQLite {
+		path = filepath.Join(dir, "snapci.db")
+	}
+	if err := Configure(backend, path); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { Configure(BackendJSON, ".") })
+	t.Setenv(secrets.MasterKeyEnv, base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32))))
+	return dir
+}
+
+func TestRepoAuthTokenIsEncrypted(t *testing.T) {
+	for _, backend := range []string{BackendJSON, BackendSQLite} {
+		t.Run(backend, func(t *testing.T) {
+			dir := useStore(t, backend)
+
+			if err := StoreRepoAuth("owner/repo", "gitlab", "glpat-secret"); err != nil {
+				t.Fatal(err)
+			}
+			if err := StoreWebhookSecret("owner/repo", "hook-secret"); err != nil {
+				t.Fatal(err)
+			}
+
+			auth, err := GetRepoAuth("owner/repo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token, err := auth.AccessToken(); err != nil || token != "glpat-secret" {
+				t.Errorf("AccessToken() = %q, %v", token, err)
+			}
+			if auth.ProviderName() != "gitlab" || auth.WebhookSecret != "hook-secret" {
+				t.Errorf("GetRepoAuth() = %+v", auth)
+			}
+
+			filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+				if err == nil && !info.IsDir() {
+					if data, _ := os.ReadFile(path); strings.Contains(string(data), "glpat-secret") {
+						t.Errorf("%s holds the token in plain text", path)
+					}
+				}
+				return nil
+			})
+		})
+	}
+}
+
+func TestRepoAuthTokenIsBoundToItsRepository(t *testing.T) {
+	useStore(t, BackendJSON)
+	if err := StoreRepoAuth("owner/repo", "github", "ghp_token"); err != nil {
+		t.Fatal(err)
+	}
+	auth, err := GetRepoAuth("owner/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.RepoName = "other/repo" // e.g. a record copied to another repository
+	if _, err := auth.AccessToken(); err == nil {
+		t.Error("a token copied to another repository was decrypted")
+	}
+}
+
+func TestPlainGithubTokenIsSealedOnWrite(t *testing.T) {
+	dir := useStore(t, BackendJSON)
+	legacy := filepath.Join(dir, authDataDir, "owner_repo.json")
+	if err := os.MkdirAll(filepath.Dir(legacy), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(legacy, []byte(`{"repo_name":"owner/repo","github_token":"ghp_plain"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	auth, err := GetRepoAuth("owner/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token, _ := auth.AccessToken(); token != "ghp_plain" || !auth.HasToken() {
+		t.Fatalf("AccessToken() of a plain-text record = %q", token)
+	}
+
+	// Changing the webhook secret must neither drop nor expose the token
+	if err := StoreWebhookSecret("owner/repo", "s3cr3t"); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(legacy)
+	if strings.Contains(string(data), "ghp_plain") {
+		t.Errorf("the token is still stored in plain text: %s", data)
+	}
+	auth, _ = GetRepoAuth("owner/repo")
+	if token, err := auth.AccessToken(); err != nil || token != "ghp_plain" {
+		t.Errorf("AccessToken() after resealing = %q, %v", token, err)
+	}
+}
@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+)
+
+// CancelRequest records who asked for a run to be cancelled and when.
+// Requests are kept in the store so that `snapci cancel` works from any process.
+type CancelRequest struct {
+	RunID       string    `json:"run_id"`
+	RequestedBy string    `json:"requested_by"`
+	RequestedAt time.Time `json:"requested_at"`
+}
+
+// RequestCancel asks the worker executing a run to cancel it.
+func RequestCancel(runID, requestedBy string) error {
+	run, err := GetRun(runID)
+	if err != nil {
+		return err
+	}
+	if run.Finished() {
+		return fmt.Errorf("run '%s' already finished with status '%s'", runID, run.Status)
+	}
+	if err := validateRunID(runID); err != nil {
+		return err
+	}
+	// An existing request is kept, along with its requester
+	return activeStore().SaveCancelRequest(CancelRequest{
+		RunID:       runID,
+		RequestedBy: requestedBy,
+		RequestedAt: time.Now(),
+	})
+}
+
+// GetCancelRequest returns the cancel request of a run, or nil if there is none.
+func GetCancelRequest(runID string) (*CancelRequest, error) {
+	if err := validateRunID(runID); err != nil {
+		return nil, err
+	}
+	return activeStore().GetCancelRequest(runID)
+}
+
+// ClearCancelRequest removes the cancel request of a finished run.
+func ClearCancelRequest(runID string) error {
+	if err := validateRunID(runID); err != nil {
+		return err
+	}
+	return activeStore().DeleteCancelRequest(runID)
+}
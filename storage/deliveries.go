@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// validDeliveryID restricts delivery IDs to characters that are safe in file names.
+// GitHub sends GUIDs such as "72d3162e-cc78-11e3-81ab-4c9367dc0958".
+var validDeliveryID = regexp.MustCompile(`^[A-Za-z0-9_-]{1,128}$`)
+
+// ErrInvalidDeliveryID is returned for delivery IDs that cannot be recorded.
+var ErrInvalidDeliveryID = errors.New("invalid delivery ID")
+
+// DeliveryRecord stores when a webhook delivery was first received.
+type DeliveryRecord struct {
+	ID         string    `json:"id"`
+	Event      string    `json:"event"`
+	RepoName   string    `json:"repo_name"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// RecordDelivery records a webhook delivery ID. It returns false if the
+// delivery was already recorded, i.e. the request is a replay or a redelivery.
+func RecordDelivery(deliveryID, event, repoName string) (bool, error) {
+	if err := validateDeliveryID(deliveryID); err != nil {
+		return false, err
+	}
+	return activeStore().RecordDelivery(DeliveryRecord{
+		ID:         deliveryID,
+		Event:      event,
+		RepoName:   repoName,
+		ReceivedAt: time.Now(),
+	})
+}
+
+// ForgetDelivery removes the record of a delivery that could not start its
+// run, so that a redelivery is not taken for a duplicate.
+func ForgetDelivery(deliveryID string) error {
+	if err := validateDeliveryID(deliveryID); err != nil {
+		return err
+	}
+	return activeStore().ForgetDelivery(deliveryID)
+}
+
+func validateDeliveryID(deliveryID string) error {
+	if !validDeliveryID.MatchString(deliveryID) {
+		return fmt.Errorf("%w '%s'", ErrInvalidDeliveryID, deliveryID)
+	}
+	return nil
+}
@@ -0,0 +1,423 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	runMetadataDir    = "run_metadata"
+	authDataDir       = "auth_data"
+	runLogsDir        = "run_logs"
+	deliveriesDir     = "webhook_deliveries"
+	cancelRequestsDir = "cancel_requests"
+)
+
+// JSONStore keeps every run in its own JSON file under run_metadata/, the
+// authentication data of each repository under auth_data/ and run logs under
+// run_logs/. Webhook deliveries and cancel requests are one file each under
+// webhook_deliveries/ and cancel_requests/. Listing runs reads every run
+// file, so it gets slow with many runs.
+type JSONStore struct {
+	root string
+}
+
+// NewJSONStore returns a JSONStore rooted at dir.
+func NewJSONStore(dir string) *JSONStore {
+	return &JSONStore{root: dir}
+}
+
+func (s *JSONStore) SaveRun(metadata RunMetadata) error {
+	dir := filepath.Join(s.root, runMetadataDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create run metadata directory: %w", err)
+	}
+
+	// Write to a temporary file first so readers never see a half-written run
+	filename := filepath.Join(dir, fmt.Sprintf("run_%s.json", metadata.ID))
+	tmpFilename := filename + ".tmp"
+	file, err := os.Create(tmpFilename)
+	if err != nil {
+		return fmt.Errorf("failed to create metadata file: %w", err)
+	}
+
+	encoder := json.NewEncoder(file)
+	if err := encoder.Encode(metadata); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to encode metadata to JSON: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write metadata file: %w", err)
+	}
+	if err := os.Rename(tmpFilename, filename); err != nil {
+		return fmt.Errorf("failed to move metadata file into place: %w", err)
+	}
+	return nil
+}
+
+func (s *JSONStore) GetRun(runID string) (*RunMetadata, error) {
+	if err := validateRunID(runID); err != nil {
+		return nil, err
+	}
+	filename := filepath.Join(s.root, runMetadataDir, fmt.Sprintf("run_%s.json", runID))
+	file, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("run with ID '%s' not found", runID)
+		}
+		return nil, fmt.Errorf("failed to open metadata file: %w", err)
+	}
+	defer file.Close()
+
+	var metadata RunMetadata
+	decoder := json.NewDecoder(file)
+	err = decoder.Decode(&metadata)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode metadata from JSON: %w", err)
+	}
+
+	return &metadata, nil
+}
+
+func (s *JSONStore) ListRuns(filter RunFilter) ([]RunMetadata, error) {
+	files, err := os.ReadDir(filepath.Join(s.root, runMetadataDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []RunMetadata{}, nil // No runs yet
+		}
+		return nil, fmt.Errorf("failed to read run metadata directory: %w", err)
+	}
+
+	var runs []RunMetadata
+	for _, file := range files {
+		if !file.IsDir() && filepath.Ext(file.Name()) == ".json" && len(file.Name()) > 8 && file.Name()[:4] == "run_" {
+			runID := file.Name()[4 : len(file.Name())-5]
+			metadata, err := s.GetRun(runID)
+			if err != nil {
+				fmt.Printf("Error reading run %s: %v\n", runID, err)
+				continue
+			}
+			if filter.matches(*metadata) {
+				runs = append(runs, *metadata)
+			}
+		}
+	}
+
+	// Sort runs by start time in descending order (most recent first)
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].sortTime().After(runs[j].sortTime())
+	})
+
+	if filter.Offset > 0 {
+		if filter.Offset >= len(runs) {
+			return []RunMetadata{}, nil
+		}
+		runs = runs[filter.Offset:]
+	}
+	if filter.Limit > 0 && len(runs) > filter.Limit {
+		return runs[:filter.Limit], nil
+	}
+	return runs, nil
+}
+
+func (f RunFilter) matches(m RunMetadata) bool {
+	return (f.RepoName == "" || m.RepoName == f.RepoName) &&
+		(f.Branch == "" || m.Branch == f.Branch) &&
+		(f.Status == "" || m.Status == f.Status) &&
+		(f.TriggerType == "" || m.TriggerType == f.TriggerType) &&
+		(f.Since.IsZero() || !m.sortTime().Before(f.Since)) &&
+		(f.Until.IsZero() || m.sortTime().Before(f.Until))
+}
+
+func (s *JSONStore) SaveRepoAuth(authData RepoAuth) error {
+	dir := filepath.Join(s.root, authDataDir)
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create auth data directory: %w", err)
+	}
+
+	filename := s.repoAuthPath(authData.RepoName)
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create/open auth data file: %w", err)
+	}
+	defer file.Close()
+
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(authData); err != nil {
+		return fmt.Errorf("failed to encode auth data to JSON: %w", err)
+	}
+	return nil
+}
+
+func (s *JSONStore) GetRepoAuth(repoName string) (*RepoAuth, error) {
+	file, err := os.Open(s.repoAuthPath(repoName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("authentication data for repository '%s' not found", repoName)
+		}
+		return nil, fmt.Errorf("failed to open auth data file: %w", err)
+	}
+	defer file.Close()
+
+	var authData RepoAuth
+	decoder := json.NewDecoder(file)
+	if err := decoder.Decode(&authData); err != nil {
+		return nil, fmt.Errorf("failed to decode auth data from JSON: %w", err)
+	}
+
+	return &authData, nil
+}
+
+func (s *JSONStore) ListRepoAuth() ([]RepoAuth, error) {
+	files, err := os.ReadDir(filepath.Join(s.root, authDataDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []RepoAuth{}, nil
+		}
+		return nil, fmt.Errorf("failed to read auth data directory: %w", err)
+	}
+
+	var auths []RepoAuth
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.root, authDataDir, file.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read auth data file: %w", err)
+		}
+		var authData RepoAuth
+		if err := json.Unmarshal(data, &authData); err != nil {
+			return nil, fmt.Errorf("failed to decode auth data from %s: %w", file.Name(), err)
+		}
+		auths = append(auths, authData)
+	}
+	return auths, nil
+}
+
+func (s *JSONStore) repoAuthPath(repoName string) string {
+	authID := strings.ReplaceAll(repoName, "/", "_")
+	return filepath.Join(s.root, authDataDir, fmt.Sprintf("%s.json", authID))
+}
+
+func (s *JSONStore) OpenRunLog(runID string) (io.WriteCloser, error) {
+	filename, err := s.runLogPath(runID)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create run logs directory: %w", err)
+	}
+
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open run log: %w", err)
+	}
+	return file, nil
+}
+
+func (s *JSONStore) ReadRunLog(runID string, offset int64) ([]byte, int64, error) {
+	filename, err := s.runLogPath(runID)
+	if err != nil {
+		return nil, offset, err
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, offset, nil
+		}
+		return nil, offset, fmt.Errorf("failed to open run log: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, offset, fmt.Errorf("failed to seek run log: %w", err)
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, offset, fmt.Errorf("failed to read run log: %w", err)
+	}
+	return completeLines(data, offset)
+}
+
+func (s *JSONStore) runLogPath(runID string) (string, error) {
+	if err := validateRunID(runID); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.root, runLogsDir, fmt.Sprintf("run_%s.log", runID)), nil
+}
+
+func (s *JSONStore) RecordDelivery(record DeliveryRecord) (bool, error) {
+	filename, err := s.deliveryPath(record.ID)
+	if err != nil {
+		return false, err
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return false, fmt.Errorf("failed to create deliveries directory: %w", err)
+	}
+
+	// O_EXCL makes the check-and-record atomic, even for concurrent deliveries
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to create delivery record: %w", err)
+	}
+	defer file.Close()
+
+	if err := json.NewEncoder(file).Encode(record); err != nil {
+		return true, fmt.Errorf("failed to encode delivery record to JSON: %w", err)
+	}
+	return true, nil
+}
+
+func (s *JSONStore) ForgetDelivery(deliveryID string) error {
+	filename, err := s.deliveryPath(deliveryID)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove delivery record: %w", err)
+	}
+	return nil
+}
+
+func (s *JSONStore) ListDeliveries() ([]DeliveryRecord, error) {
+	var records []DeliveryRecord
+	err := readJSONDir(filepath.Join(s.root, deliveriesDir), func() any {
+		records = append(records, DeliveryRecord{})
+		return &records[len(records)-1]
+	})
+	return records, err
+}
+
+func (s *JSONStore) deliveryPath(deliveryID string) (string, error) {
+	if err := validateDeliveryID(deliveryID); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.root, deliveriesDir, fmt.Sprintf("%s.json", deliveryID)), nil
+}
+
+func (s *JSONStore) SaveCancelRequest(request CancelRequest) error {
+	filename, err := s.cancelRequestPath(request.RunID)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return fmt.Errorf("failed to create cancel requests directory: %w", err)
+	}
+
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return nil // Already requested, keep the first requester
+		}
+		return fmt.Errorf("failed to create cancel request: %w", err)
+	}
+	defer file.Close()
+
+	if err := json.NewEncoder(file).Encode(request); err != nil {
+		return fmt.Errorf("failed to encode cancel request to JSON: %w", err)
+	}
+	return nil
+}
+
+func (s *JSONStore) GetCancelRequest(runID string) (*CancelRequest, error) {
+	filename, err := s.cancelRequestPath(runID)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to open cancel request: %w", err)
+	}
+	defer file.Close()
+
+	var request CancelRequest
+	if err := json.NewDecoder(file).Decode(&request); err != nil {
+		return nil, fmt.Errorf("failed to decode cancel request from JSON: %w", err)
+	}
+	return &request, nil
+}
+
+func (s *JSONStore) DeleteCancelRequest(runID string) error {
+	filename, err := s.cancelRequestPath(runID)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove cancel request: %w", err)
+	}
+	return nil
+}
+
+func (s *JSONStore) ListCancelRequests() ([]CancelRequest, error) {
+	var requests []CancelRequest
+	err := readJSONDir(filepath.Join(s.root, cancelRequestsDir), func() any {
+		requests = append(requests, CancelRequest{})
+		return &requests[len(requests)-1]
+	})
+	return requests, err
+}
+
+func (s *JSONStore) cancelRequestPath(runID string) (string, error) {
+	if err := validateRunID(runID); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.root, cancelRequestsDir, fmt.Sprintf("%s.json", runID)), nil
+}
+
+// readJSONDir decodes every .json file in dir into a value returned by next.
+// A missing directory has no files.
+func readJSONDir(dir string, next func() any) error {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read directory %s: %w", dir, err)
+	}
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", file.Name(), err)
+		}
+		if err := json.Unmarshal(data, next()); err != nil {
+			return fmt.Errorf("failed to decode %s: %w", file.Name(), err)
+		}
+	}
+	return nil
+}
+
+// Close is a no-op: the JSON store keeps no files open.
+func (s *JSONStore) Close() error {
+	return nil
+}
+
+// completeLines holds back a trailing partial line of data read at offset
+// until it is complete.
+func completeLines(data []byte, offset int64) ([]byte, int64, error) {
+	end := bytes.LastIndexByte(data, '\n')
+	if end < 0 {
+		return nil, offset, nil
+	}
+	data = data[:end+1]
+	return data, offset + int64(len(data)), nil
+}
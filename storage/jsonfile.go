@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// JSONFile is a small JSON document kept in a file of its own, such as the
+// API tokens or the watched repositories. Writes replace the file atomically
+// and are readable only by the owner.
+//
+// The embedded mutex serializes read-modify-write cycles of the goroutines of
+// this process; callers hold it around Read and Write when they change the
+// file. Read and Write themselves do not lock. Files shared by several snapci
+// processes are additionally locked with LockFile.
+type JSONFile struct {
+	sync.Mutex
+	path        string
+	defaultPath string
+	what        string // Names the contents in errors, e.g. "API tokens"
+}
+
+// NewJSONFile returns a JSONFile at defaultPath until it is configured. what
+// names the contents in error messages.
+func NewJSONFile(defaultPath, what string) *JSONFile {
+	return &JSONFile{path: defaultPath, defaultPath: defaultPath, what: what}
+}
+
+// Configure sets the path of the file, or restores the default if path is empty.
+func (f *JSONFile) Configure(path string) {
+	if path == "" {
+		path = f.defaultPath
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.path = path
+}
+
+// Path returns the path of the file.
+func (f *JSONFile) Path() string {
+	return f.path
+}
+
+// Read decodes the file into v. v is left untouched if the file does not
+// exist yet.
+func (f *JSONFile) Read(v any) error {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read %s: %w", f.what, err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to decode %s from %s: %w", f.what, f.path, err)
+	}
+	return nil
+}
+
+// Write replaces the file with v atomically, creating its directory if needed.
+func (f *JSONFile) Write(v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", f.what, err)
+	}
+	if err := f.makeDir(); err != nil {
+		return err
+	}
+	tmp := f.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", f.what, err)
+	}
+	if err := os.Rename(tmp, f.path); err != nil {
+		return fmt.Errorf("failed to write %s: %w", f.what, err)
+	}
+	return nil
+}
+
+// LockFile takes an exclusive lock on path + ".lock" that is shared by every
+// process using the file, and returns the function releasing it. It blocks
+// until the lock is free.
+func (f *JSONFile) LockFile() (func(), error) {
+	if err := f.makeDir(); err != nil {
+		return nil, err
+	}
+	unlock, err := LockFile(f.path + ".lock")
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock %s: %w", f.what, err)
+	}
+	return unlock, nil
+}
+
+func (f *JSONFile) makeDir() error {
+	if dir := filepath.Dir(f.path); dir != "." {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("failed to create directory for %s: %w", f.what, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// ErrLocked is returned by TryLockFile when another process holds the lock.
+var ErrLocked = errors.New("locked by another process")
+
+// LockFile takes an exclusive lock on path, creating the file if needed, and
+// returns the function releasing it. The lock is shared by every process on
+// the host, and released when the process exits. It blocks until the lock is
+// free.
+func LockFile(path string) (func(), error) {
+	return lockFile(path, syscall.LOCK_EX)
+}
+
+// TryLockFile is LockFile without waiting: it returns ErrLocked if the lock is
+// held, by this process or another one.
+func TryLockFile(path string) (func(), error) {
+	return lockFile(path, syscall.LOCK_EX|syscall.LOCK_NB)
+}
+
+func lockFile(path string, how int) (func(), error) {
+	lock, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file %s: %w", path, err)
+	}
+	if err := syscall.Flock(int(lock.Fd()), how); err != nil {
+		lock.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrLocked
+		}
+		return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+	return func() { lock.Close() }, nil // Closing the file releases the lock
+}
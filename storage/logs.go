@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// RunLog is the append-only, line-oriented log of a run. Step output is
+// written to it while the run is in progress so it can be tailed live.
+// It is safe for concurrent use by parallel jobs.
+type RunLog struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+// OpenRunLog opens (or creates) the log of a run for appending.
+func OpenRunLog(runID string) (*RunLog, error) {
+	w, err := activeStore().OpenRunLog(runID)
+	if err != nil {
+		return nil, err
+	}
+	return &RunLog{w: w}, nil
+}
+
+// Write appends p to the log. Callers should write whole lines.
+func (l *RunLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+// Close closes the log.
+func (l *RunLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Close()
+}
+
+// ReadRunLog returns the complete lines of a run's log written after offset,
+// together with the offset to continue reading from. A run without a log yet
+// yields no data and no error.
+func ReadRunLog(runID string, offset int64) ([]byte, int64, error) {
+	return activeStore().ReadRunLog(runID, offset)
+}
+
+// validateRunID rejects run IDs that are unsafe in file names.
+func validateRunID(runID string) error {
+	if runID == "" || strings.ContainsAny(runID, `/\`) || strings.Contains(runID, "..") {
+		return fmt.Errorf("invalid run ID '%s'", runID)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+)
+
+// MigrationStats counts what Migrate copied.
+type MigrationStats struct {
+	Runs           int
+	Logs           int
+	RepoAuth       int
+	Deliveries     int
+	CancelRequests int
+}
+
+// Migrate copies every run, run log, repository authentication record,
+// webhook delivery and cancel request from one store to another. Runs and
+// auth data are upserted, logs are only copied for runs that have none in the
+// destination yet, and deliveries and cancel requests already in the
+// destination are kept, so the migration can be repeated safely.
+func Migrate(from, to Store) (MigrationStats, error) {
+	var stats MigrationStats
+
+	runs, err := from.ListRuns(RunFilter{})
+	if err != nil {
+		return stats, fmt.Errorf("failed to list runs to migrate: %w", err)
+	}
+	for _, run := range runs {
+		if err := to.SaveRun(run); err != nil {
+			return stats, err
+		}
+		stats.Runs++
+
+		copied, err := migrateRunLog(from, to, run.ID)
+		if err != nil {
+			return stats, err
+		}
+		if copied {
+			stats.Logs++
+		}
+	}
+
+	auths, err := from.ListRepoAuth()
+	if err != nil {
+		return stats, fmt.Errorf("failed to list auth data to migrate: %w", err)
+	}
+	for _, authData := range auths {
+		if err := authData.sealPlainToken(); err != nil {
+			return stats, err
+		}
+		if err := to.SaveRepoAuth(authData); err != nil {
+			return stats, err
+		}
+		stats.RepoAuth++
+	}
+
+	// Without the deliveries, a replayed delivery would start a second run
+	deliveries, err := from.ListDeliveries()
+	if err != nil {
+		return stats, fmt.Errorf("failed to list webhook deliveries to migrate: %w", err)
+	}
+	for _, record := range deliveries {
+		if _, err := to.RecordDelivery(record); err != nil {
+			return stats, err
+		}
+		stats.Deliveries++
+	}
+
+	requests, err := from.ListCancelRequests()
+	if err != nil {
+		return stats, fmt.Errorf("failed to list cancel requests to migrate: %w", err)
+	}
+	for _, request := range requests {
+		if err := to.SaveCancelRequest(request); err != nil {
+			return stats, err
+		}
+		stats.CancelRequests++
+	}
+	return stats, nil
+}
+
+func migrateRunLog(from, to Store, runID string) (bool, error) {
+	existing, _, err := to.ReadRunLog(runID, 0)
+	if err != nil {
+		return false, err
+	}
+	if len(existing) > 0 {
+		log.Printf("Log of run %s already migrated, skipping", runID)
+		return false, nil
+	}
+
+	data, _, err := from.ReadRunLog(runID, 0)
+	if err != nil {
+		return false, err
+	}
+	if len(data) == 0 {
+		return false, nil
+	}
+
+	w, err := to.OpenRunLog(runID)
+	if err != nil {
+		return false, err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return false, err
+	}
+	return true, w.Close()
+}
+
+// UpgradeRuns rewrites every run in the configured store in the current
+// format, e.g. turning the step maps of runs recorded before steps were kept
+// in order into ordered step lists. Old runs can be read without it; the
+// upgrade only makes the stored data match. Repeating it is harmless.
+func UpgradeRuns() (int, error) {
+	store := activeStore()
+	runs, err := store.ListRuns(RunFilter{})
+	if err != nil {
+		return 0, fmt.Errorf("failed to list runs to upgrade: %w", err)
+	}
+	for i, run := range runs {
+		if err := store.SaveRun(run); err != nil {
+			return i, err
+		}
+	}
+	return len(runs), nil
+}
@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"crypto/rand"
+	"sync"
+	"time"
+)
+
+// crockford is the Crockford base32 alphabet used by ULIDs.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+var (
+	runIDMu      sync.Mutex
+	runIDLastMs  int64
+	runIDEntropy [10]byte
+)
+
+// NewRunID returns a unique run ID in ULID format: a 48-bit millisecond
+// timestamp followed by 80 random bits, encoded as 26 Crockford base32
+// characters. IDs sort lexicographically in creation order, and IDs created
+// within the same millisecond by this process increase monotonically.
+func NewRunID() string {
+	runIDMu.Lock()
+	defer runIDMu.Unlock()
+
+	ms := time.Now().UnixMilli()
+	if ms <= runIDLastMs {
+		// Same millisecond (or the clock went back): increment the previous entropy
+		ms = runIDLastMs
+		for i := len(runIDEntropy) - 1; i >= 0; i-- {
+			runIDEntropy[i]++
+			if runIDEntropy[i] != 0 {
+				break
+			}
+		}
+	} else if _, err := rand.Read(runIDEntropy[:]); err != nil {
+		panic("failed to read random bytes for run ID: " + err.Error())
+	}
+	runIDLastMs = ms
+
+	var id [16]byte
+	for i := 0; i < 6; i++ {
+		id[i] = byte(ms >> (8 * (5 - i)))
+	}
+	copy(id[6:], runIDEntropy[:])
+	return encodeULID(id)
+}
+
+// encodeULID encodes 128 bits as 26 base32 characters, most significant first.
+func encodeULID(id [16]byte) string {
+	out := make([]byte, 26)
+	// 26 characters hold 130 bits; the 2 leading bits are always zero
+	for i := range out {
+		var v byte
+		for b := 0; b < 5; b++ {
+			bit := 5*i + b - 2 // Bit index within id, from the most significant bit
+			v <<= 1
+			if bit >= 0 && id[bit/8]&(0x80>>(bit%8)) != 0 {
+				v |= 1
+			}
+		}
+		out[i] = crockford[v]
+	}
+	return string(out)
+}
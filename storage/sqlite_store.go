@@ -0,0 +1,417 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3" // Registers the "sqlite3" database/sql driver
+)
+
+// sqliteSchema creates the tables of the SQLite backend. Runs are stored as
+// JSON documents, with the columns used for filtering and sorting pulled out
+// and indexed.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS runs (
+	id         TEXT PRIMARY KEY,
+	repo_name  TEXT NOT NULL,
+	branch     TEXT NOT NULL,
+	status     TEXT NOT NULL,
+	start_time INTEGER NOT NULL, -- Unix nanoseconds; the queue time until the run starts
+	data       TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_runs_start_time ON runs (start_time);
+CREATE INDEX IF NOT EXISTS idx_runs_repo_name ON runs (repo_name, start_time);
+CREATE INDEX IF NOT EXISTS idx_runs_branch ON runs (branch, start_time);
+CREATE INDEX IF NOT EXISTS idx_runs_status ON runs (status, start_time);
+
+CREATE TABLE IF NOT EXISTS repo_auth (
+	repo_name TEXT PRIMARY KEY,
+	data      TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS run_log_chunks (
+	run_id      TEXT NOT NULL,
+	byte_offset INTEGER NOT NULL, -- Offset of the chunk within the run's log
+	data        BLOB NOT NULL,
+	PRIMARY KEY (run_id, byte_offset)
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+	id          TEXT PRIMARY KEY,
+	event       TEXT NOT NULL,
+	repo_name   TEXT NOT NULL,
+	received_at INTEGER NOT NULL -- Unix nanoseconds
+);
+
+CREATE TABLE IF NOT EXISTS cancel_requests (
+	run_id       TEXT PRIMARY KEY,
+	requested_by TEXT NOT NULL,
+	requested_at INTEGER NOT NULL -- Unix nanoseconds
+);
+`
+
+// SQLiteStore keeps runs, authentication data, run logs, webhook deliveries
+// and cancel requests in a single embedded SQLite database, which several
+// snapci processes can share.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// OpenSQLiteStore opens (or creates) the SQLite database at path.
+func OpenSQLiteStore(path string) (*SQLiteStore, error) {
+	// WAL lets the dashboard read while a worker writes; the busy timeout
+	// covers concurrent writers from other processes.
+	dsn := fmt.Sprintf("file:%s?_journal_mode=WAL&_busy_timeout=5000", path)
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open SQLite database %s: %w", path, err)
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create SQLite schema in %s: %w", path, err)
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+func (s *SQLiteStore) SaveRun(metadata RunMetadata) error {
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata to JSON: %w", err)
+	}
+	_, err = s.db.Exec(`
+		INSERT INTO runs (id, repo_name, branch, status, start_time, data)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			repo_name = excluded.repo_name,
+			branch = excluded.branch,
+			status = excluded.status,
+			start_time = excluded.start_time,
+			data = excluded.data`,
+		metadata.ID, metadata.RepoName, metadata.Branch, metadata.Status, unixNano(metadata.sortTime()), string(data))
+	if err != nil {
+		return fmt.Errorf("failed to store run %s: %w", metadata.ID, err)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) GetRun(runID string) (*RunMetadata, error) {
+	var data string
+	err := s.db.QueryRow(`SELECT data FROM runs WHERE id = ?`, runID).Scan(&data)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("run with ID '%s' not found", runID)
+		}
+		return nil, fmt.Errorf("failed to load run %s: %w", runID, err)
+	}
+
+	var metadata RunMetadata
+	if err := json.Unmarshal([]byte(data), &metadata); err != nil {
+		return nil, fmt.Errorf("failed to decode metadata from JSON: %w", err)
+	}
+	return &metadata, nil
+}
+
+func (s *SQLiteStore) ListRuns(filter RunFilter) ([]RunMetadata, error) {
+	conditions, args := runConditions(filter)
+
+	query := `SELECT data FROM runs`
+	if len(conditions) > 0 {
+		query += ` WHERE ` + strings.Join(conditions, " AND ")
+	}
+	query += ` ORDER BY start_time DESC`
+	if filter.Limit > 0 || filter.Offset > 0 {
+		limit := filter.Limit
+		if limit <= 0 {
+			limit = -1 // No limit; SQLite only accepts OFFSET after LIMIT
+		}
+		query += ` LIMIT ? OFFSET ?`
+		args = append(args, limit, filter.Offset)
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list runs: %w", err)
+	}
+	defer rows.Close()
+
+	runs := []RunMetadata{}
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, fmt.Errorf("failed to list runs: %w", err)
+		}
+		var metadata RunMetadata
+		if err := json.Unmarshal([]byte(data), &metadata); err != nil {
+			return nil, fmt.Errorf("failed to decode metadata from JSON: %w", err)
+		}
+		runs = append(runs, metadata)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list runs: %w", err)
+	}
+	return runs, nil
+}
+
+// runConditions returns the WHERE conditions of a run filter and their
+// arguments, always in the same order so that equal filters make equal queries.
+func runConditions(filter RunFilter) ([]string, []any) {
+	var conditions []string
+	var args []any
+	for _, field := range []struct{ column, value string }{
+		{"repo_name", filter.RepoName},
+		{"branch", filter.Branch},
+		{"status", filter.Status},
+		// Rarely filtered on, so read from the document rather than indexed
+		{"json_extract(data, '$.trigger_type')", filter.TriggerType},
+	} {
+		if field.value != "" {
+			conditions = append(conditions, field.column+" = ?")
+			args = append(args, field.value)
+		}
+	}
+	if !filter.Since.IsZero() {
+		conditions = append(conditions, "start_time >= ?")
+		args = append(args, filter.Since.UnixNano())
+	}
+	if !filter.Until.IsZero() {
+		conditions = append(conditions, "start_time < ?")
+		args = append(args, filter.Until.UnixNano())
+	}
+	return conditions, args
+}
+
+func (s *SQLiteStore) SaveRepoAuth(authData RepoAuth) error {
+	data, err := json.Marshal(authData)
+	if err != nil {
+		return fmt.Errorf("failed to encode auth data to JSON: %w", err)
+	}
+	_, err = s.db.Exec(`
+		INSERT INTO repo_auth (repo_name, data) VALUES (?, ?)
+		ON CONFLICT (repo_name) DO UPDATE SET data = excluded.data`,
+		authData.RepoName, string(data))
+	if err != nil {
+		return fmt.Errorf("failed to store auth data for %s: %w", authData.RepoName, err)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) GetRepoAuth(repoName string) (*RepoAuth, error) {
+	var data string
+	err := s.db.QueryRow(`SELECT data FROM repo_auth WHERE repo_name = ?`, repoName).Scan(&data)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("authentication data for repository '%s' not found", repoName)
+		}
+		return nil, fmt.Errorf("failed to load auth data for %s: %w", repoName, err)
+	}
+
+	var authData RepoAuth
+	if err := json.Unmarshal([]byte(data), &authData); err != nil {
+		return nil, fmt.Errorf("failed to decode auth data from JSON: %w", err)
+	}
+	return &authData, nil
+}
+
+func (s *SQLiteStore) ListRepoAuth() ([]RepoAuth, error) {
+	rows, err := s.db.Query(`SELECT data FROM repo_auth ORDER BY repo_name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list auth data: %w", err)
+	}
+	defer rows.Close()
+
+	auths := []RepoAuth{}
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, fmt.Errorf("failed to list auth data: %w", err)
+		}
+		var authData RepoAuth
+		if err := json.Unmarshal([]byte(data), &authData); err != nil {
+			return nil, fmt.Errorf("failed to decode auth data from JSON: %w", err)
+		}
+		auths = append(auths, authData)
+	}
+	return auths, rows.Err()
+}
+
+// sqliteLogWriter appends each write to a run's log as one chunk row.
+type sqliteLogWriter struct {
+	db     *sql.DB
+	runID  string
+	offset int64
+}
+
+func (s *SQLiteStore) OpenRunLog(runID string) (io.WriteCloser, error) {
+	if err := validateRunID(runID); err != nil {
+		return nil, err
+	}
+	var size int64
+	err := s.db.QueryRow(`SELECT COALESCE(MAX(byte_offset + LENGTH(data)), 0) FROM run_log_chunks WHERE run_id = ?`, runID).Scan(&size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open run log: %w", err)
+	}
+	return &sqliteLogWriter{db: s.db, runID: runID, offset: size}, nil
+}
+
+func (w *sqliteLogWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	_, err := w.db.Exec(`INSERT INTO run_log_chunks (run_id, byte_offset, data) VALUES (?, ?, ?)`, w.runID, w.offset, p)
+	if err != nil {
+		return 0, fmt.Errorf("failed to append to run log: %w", err)
+	}
+	w.offset += int64(len(p))
+	return len(p), nil
+}
+
+func (w *sqliteLogWriter) Close() error {
+	return nil
+}
+
+func (s *SQLiteStore) ReadRunLog(runID string, offset int64) ([]byte, int64, error) {
+	rows, err := s.db.Query(`
+		SELECT byte_offset, data FROM run_log_chunks
+		WHERE run_id = ? AND byte_offset + LENGTH(data) > ?
+		ORDER BY byte_offset`, runID, offset)
+	if err != nil {
+		return nil, offset, fmt.Errorf("failed to read run log: %w", err)
+	}
+	defer rows.Close()
+
+	var data []byte
+	for rows.Next() {
+		var chunkOffset int64
+		var chunk []byte
+		if err := rows.Scan(&chunkOffset, &chunk); err != nil {
+			return nil, offset, fmt.Errorf("failed to read run log: %w", err)
+		}
+		if chunkOffset < offset { // The first chunk may start before offset
+			chunk = chunk[offset-chunkOffset:]
+		}
+		data = append(data, chunk...)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, offset, fmt.Errorf("failed to read run log: %w", err)
+	}
+	return completeLines(data, offset)
+}
+
+func (s *SQLiteStore) RecordDelivery(record DeliveryRecord) (bool, error) {
+	result, err := s.db.Exec(`
+		INSERT INTO webhook_deliveries (id, event, repo_name, received_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (id) DO NOTHING`,
+		record.ID, record.Event, record.RepoName, unixNano(record.ReceivedAt))
+	if err != nil {
+		return false, fmt.Errorf("failed to record delivery %s: %w", record.ID, err)
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to record delivery %s: %w", record.ID, err)
+	}
+	return inserted == 1, nil
+}
+
+func (s *SQLiteStore) ForgetDelivery(deliveryID string) error {
+	if _, err := s.db.Exec(`DELETE FROM webhook_deliveries WHERE id = ?`, deliveryID); err != nil {
+		return fmt.Errorf("failed to remove delivery record %s: %w", deliveryID, err)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) ListDeliveries() ([]DeliveryRecord, error) {
+	rows, err := s.db.Query(`SELECT id, event, repo_name, received_at FROM webhook_deliveries ORDER BY received_at`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	var records []DeliveryRecord
+	for rows.Next() {
+		var record DeliveryRecord
+		var receivedAt int64
+		if err := rows.Scan(&record.ID, &record.Event, &record.RepoName, &receivedAt); err != nil {
+			return nil, fmt.Errorf("failed to list deliveries: %w", err)
+		}
+		record.ReceivedAt = fromUnixNano(receivedAt)
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+func (s *SQLiteStore) SaveCancelRequest(request CancelRequest) error {
+	_, err := s.db.Exec(`
+		INSERT INTO cancel_requests (run_id, requested_by, requested_at) VALUES (?, ?, ?)
+		ON CONFLICT (run_id) DO NOTHING`, // Keep the first requester
+		request.RunID, request.RequestedBy, unixNano(request.RequestedAt))
+	if err != nil {
+		return fmt.Errorf("failed to store cancel request for run %s: %w", request.RunID, err)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) GetCancelRequest(runID string) (*CancelRequest, error) {
+	request := CancelRequest{RunID: runID}
+	var requestedAt int64
+	err := s.db.QueryRow(`SELECT requested_by, requested_at FROM cancel_requests WHERE run_id = ?`, runID).Scan(&request.RequestedBy, &requestedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to load cancel request for run %s: %w", runID, err)
+	}
+	request.RequestedAt = fromUnixNano(requestedAt)
+	return &request, nil
+}
+
+func (s *SQLiteStore) DeleteCancelRequest(runID string) error {
+	if _, err := s.db.Exec(`DELETE FROM cancel_requests WHERE run_id = ?`, runID); err != nil {
+		return fmt.Errorf("failed to remove cancel request for run %s: %w", runID, err)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) ListCancelRequests() ([]CancelRequest, error) {
+	rows, err := s.db.Query(`SELECT run_id, requested_by, requested_at FROM cancel_requests ORDER BY requested_at`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list cancel requests: %w", err)
+	}
+	defer rows.Close()
+
+	var requests []CancelRequest
+	for rows.Next() {
+		var request CancelRequest
+		var requestedAt int64
+		if err := rows.Scan(&request.RunID, &request.RequestedBy, &requestedAt); err != nil {
+			return nil, fmt.Errorf("failed to list cancel requests: %w", err)
+		}
+		request.RequestedAt = fromUnixNano(requestedAt)
+		requests = append(requests, request)
+	}
+	return requests, rows.Err()
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// unixNano converts t to Unix nanoseconds, mapping the zero time to 0.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// fromUnixNano is the inverse of unixNano.
+func fromUnixNano(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
@@ -3,153 +3,245 @@ package storage
 import (
 	"encoding/json"
 	"fmt"
-	"os"
-	"path/filepath"
-	"sort"
-	"strings"
 	"time"
 
 	"snap-ci/config"
+	"snap-ci/secrets"
 	"snap-ci/types"
 )
 
-const (
-	runMetadataDir = "run_metadata"
-)
-
 // RunMetadata stores metadata about a pipeline run
 type RunMetadata struct {
-	ID           string                     `json:"id"`
-	Config       config.Config              `json:"config"`
-	Results      map[string]types.JobResult `json:"results"`
-	StartTime    time.Time                  `json:"start_time"`
-	EndTime      time.Time                  `json:"end_time"`
-	Status       string                     `json:"status"`
-	TriggeredBy  string                     `json:"triggered_by"`
-	RepoName     string                     `json:"repo_name"`
-	Branch       string                     `json:"branch"`
-	CommitSHA    string                     `json:"commit_sha"`
-	CommitMsg    string                     `json:"commit_msg"`
-	CommitAuthor string                     `json:"commit_author"`
+	ID            string                     `json:"id"`
+	Config        config.Config              `json:"config"`
+	Results       map[string]types.JobResult `json:"results"`
+	QueuedAt      time.Time                  `json:"queued_at,omitempty"`
+	StartTime     time.Time                  `json:"start_time"`
+	EndTime       time.Time                  `json:"end_time"`
+	Status        string                     `json:"status"`
+	Error         string                     `json:"error,omitempty"`
+	CancelledBy   string                     `json:"cancelled_by,omitempty"`
+	CancelledAt   time.Time                  `json:"cancelled_at,omitempty"`
+	TriggeredBy   string                     `json:"triggered_by"`
+	TriggerType   string                     `json:"trigger_type,omitempty"`
+	RepoName      string                     `json:"repo_name"`
+	Branch        string                     `json:"branch"`
+	CommitSHA     string                     `json:"commit_sha"`
+	CommitMsg     string                     `json:"commit_msg"`
+	CommitAuthor  string                     `json:"commit_author"`
+	Provider      string                     `json:"provider,omitempty"`
+	CloneURL      string                     `json:"clone_url,omitempty"` // Where the run's workspace was cloned from
+	Ref           string                     `json:"ref,omitempty"`
+	DefaultBranch string                     `json:"default_branch,omitempty"`
+	Event         string                     `json:"event,omitempty"`
+	DeliveryID    string                     `json:"delivery_id,omitempty"`
+	SkipReason    string                     `json:"skip_reason,omitempty"`
+	PRNumber      int                        `json:"pr_number,omitempty"`
+	BaseBranch    string                     `json:"base_branch,omitempty"`
+	HeadRepo      string                     `json:"head_repo,omitempty"`
+	HeadSHA       string                     `json:"head_sha,omitempty"`
+	FromFork      bool                       `json:"from_fork,omitempty"`
 }
 
+// RepoAuth holds the credentials of a repository at its Git hosting provider.
+// The access token is stored encrypted with the secrets master key; use
+// AccessToken to read it.
 type RepoAuth struct {
-	RepoName    string `json:"repo_name"`
-	GithubToken string `json:"github_token"`
+	RepoName      string `json:"repo_name"`
+	Provider      string `json:"provider,omitempty"`       // types.ProviderGitHub if empty
+	SealedToken   string `json:"sealed_token,omitempty"`   // Access token for cloning and the provider's API, encrypted
+	WebhookSecret string `json:"webhook_secret,omitempty"` // HMAC key of signed webhooks, or GitLab's secret token
+	plainToken    string // GitHub PAT of a record stored before tokens were encrypted
 }
 
-const (
-	authDataDir = "auth_data"
-)
-
-func StoreRepoAuth(repoName, githubToken string) error {
-	err := os.MkdirAll(authDataDir, 0700)
-	if err != nil {
-		return fmt.Errorf("failed to create auth data directory: %w", err)
+// ProviderName returns the provider of the repository, GitHub if not stored.
+func (a RepoAuth) ProviderName() string {
+	if a.Provider == "" {
+		return types.ProviderGitHub
 	}
+	return a.Provider
+}
 
-	authID := strings.ReplaceAll(repoName, "/", "_")
-	filename := filepath.Join(authDataDir, fmt.Sprintf("%s.json", authID))
+// HasToken reports whether an access token is stored for the repository.
+func (a RepoAuth) HasToken() bool {
+	return a.SealedToken != "" || a.plainToken != ""
+}
 
-	authData := RepoAuth{
-		RepoName:    repoName,
-		GithubToken: githubToken,
+// AccessToken decrypts the stored access token, or returns "" if there is none.
+func (a RepoAuth) AccessToken() (string, error) {
+	if a.SealedToken == "" {
+		return a.plainToken, nil
 	}
+	token, err := secrets.Decrypt(a.SealedToken, tokenContext(a.RepoName))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt the access token of %s: %w", a.RepoName, err)
+	}
+	return token, nil
+}
 
-	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0600)
+// setToken encrypts and stores token in the record.
+func (a *RepoAuth) setToken(token string) error {
+	a.plainToken = ""
+	if token == "" {
+		a.SealedToken = ""
+		return nil
+	}
+	sealed, err := secrets.Encrypt(token, tokenContext(a.RepoName))
 	if err != nil {
-		return fmt.Errorf("failed to create/open auth data file: %w", err)
+		return fmt.Errorf("failed to encrypt the access token of %s: %w", a.RepoName, err)
 	}
-	defer file.Close()
+	a.SealedToken = sealed
+	return nil
+}
 
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
-	if err := encoder.Encode(authData); err != nil {
-		return fmt.Errorf("failed to encode auth data to JSON: %w", err)
+// sealPlainToken encrypts the token of a record stored before tokens were
+// encrypted, which would otherwise be lost when the record is saved.
+func (a *RepoAuth) sealPlainToken() error {
+	if a.plainToken == "" {
+		return nil
 	}
+	return a.setToken(a.plainToken)
+}
+
+// tokenContext binds an encrypted access token to its repository.
+func tokenContext(repoName string) string {
+	return "access-token\x00" + repoName
+}
 
-	fmt.Printf("Authentication data for %s stored in: %s\n", repoName, filename)
+// UnmarshalJSON decodes a RepoAuth, also accepting records stored before
+// tokens were encrypted, when only a GitHub PAT could be stored.
+func (a *RepoAuth) UnmarshalJSON(data []byte) error {
+	type repoAuth RepoAuth // Same fields, without this method
+	var decoded struct {
+		repoAuth
+		GithubToken string `json:"github_token"`
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	*a = RepoAuth(decoded.repoAuth)
+	if a.SealedToken == "" {
+		a.plainToken = decoded.GithubToken
+	}
 	return nil
 }
 
-// GetRepoAuth retrieves the authentication token for a given repository.
-func GetRepoAuth(repoName string) (*RepoAuth, error) {
-	authID := strings.ReplaceAll(repoName, "/", "_")
-	filename := filepath.Join(authDataDir, fmt.Sprintf("%s.json", authID))
+// ValidProvider reports whether provider names a supported Git hosting provider.
+func ValidProvider(provider string) bool {
+	switch provider {
+	case types.ProviderGitHub, types.ProviderGitLab, types.ProviderGitea:
+		return true
+	}
+	return false
+}
 
-	file, err := os.Open(filename)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, fmt.Errorf("authentication data for repository '%s' not found", repoName)
-		}
-		return nil, fmt.Errorf("failed to open auth data file: %w", err)
+// StoreRepoAuth stores the access token of a repository at its provider,
+// keeping any webhook secret already stored for it.
+func StoreRepoAuth(repoName, provider, token string) error {
+	if !ValidProvider(provider) {
+		return fmt.Errorf("unknown provider '%s': expected %s, %s or %s", provider, types.ProviderGitHub, types.ProviderGitLab, types.ProviderGitea)
+	}
+	authData := loadRepoAuthOrEmpty(repoName)
+	authData.Provider = provider
+	if err := authData.setToken(token); err != nil {
+		return err
 	}
-	defer file.Close()
 
-	var authData RepoAuth
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&authData); err != nil {
-		return nil, fmt.Errorf("failed to decode auth data from JSON: %w", err)
+	if err := activeStore().SaveRepoAuth(authData); err != nil {
+		return err
 	}
 
-	return &authData, nil
+	fmt.Printf("Authentication data for %s stored.\n", repoName)
+	return nil
 }
 
-// StoreRun stores the results of a pipeline run to a JSON file
-func StoreRun(
-	cfg *config.Config,
-	results map[string]types.JobResult,
-	repoName string,
-	branch string,
-	commitSHA string,
-	commitMsg string,
-	commitAuthor string,
-	triggeredBy string,
-) error {
-	err := os.MkdirAll(runMetadataDir, 0755)
-	if err != nil {
-		return fmt.Errorf("failed to create run metadata directory: %w", err)
+// StoreWebhookSecret stores the webhook signing secret for a repository,
+// keeping any token already stored for it.
+func StoreWebhookSecret(repoName, secret string) error {
+	authData := loadRepoAuthOrEmpty(repoName)
+	authData.WebhookSecret = secret
+	if err := authData.sealPlainToken(); err != nil {
+		return err
 	}
 
-	runID := time.Now().Format("20060102150405") // Unique ID based on timestamp
-	metadata := RunMetadata{
-		ID:           runID,
-		Config:       *cfg,
-		Results:      results,
-		StartTime:    time.Now(),
-		EndTime:      time.Now(),
-		Status:       calculateOverallStatus(results),
-		RepoName:     repoName,
-		Branch:       branch,
-		CommitSHA:    commitSHA,
-		CommitMsg:    commitMsg,
-		CommitAuthor: commitAuthor,
-		TriggeredBy:  triggeredBy,
-	}
-
-	filename := filepath.Join(runMetadataDir, fmt.Sprintf("run_%s.json", runID))
-	file, err := os.Create(filename)
-	if err != nil {
-		return fmt.Errorf("failed to create metadata file: %w", err)
+	return activeStore().SaveRepoAuth(authData)
+}
+
+// loadRepoAuthOrEmpty returns the stored auth data of a repository, or an
+// empty record for it if nothing is stored yet.
+func loadRepoAuthOrEmpty(repoName string) RepoAuth {
+	if existing, err := GetRepoAuth(repoName); err == nil {
+		return *existing
 	}
-	defer file.Close()
+	return RepoAuth{RepoName: repoName}
+}
 
-	encoder := json.NewEncoder(file)
-	err = encoder.Encode(metadata)
-	if err != nil {
-		return fmt.Errorf("failed to encode metadata to JSON: %w", err)
+// GetRepoAuth retrieves the authentication token for a given repository.
+func GetRepoAuth(repoName string) (*RepoAuth, error) {
+	return activeStore().GetRepoAuth(repoName)
+}
+
+// StoreRun persists the current state of a pipeline run under its own ID,
+// keeping the run's own timestamps. A run without an ID is given a new one
+// from NewRunID, and a run without a status gets one derived from its job
+// results. StoreRun is called on every state transition (pending, running,
+// finished), so the dashboard can show queued and in-progress runs. cfg may
+// be nil while the run's .ci.yaml has not been loaded yet.
+func StoreRun(cfg *config.Config, run *types.PipelineRun) error {
+	if run.ID == "" {
+		run.ID = NewRunID()
+	}
+	if run.Status == "" {
+		run.Status = calculateOverallStatus(run.Results)
 	}
 
-	fmt.Printf("Run metadata stored in: %s\n", filename)
-	return nil
+	metadata := RunMetadata{
+		ID:            run.ID,
+		Results:       run.Results,
+		QueuedAt:      run.QueuedAt,
+		StartTime:     run.StartTime,
+		EndTime:       run.EndTime,
+		Status:        run.Status,
+		Error:         run.Error,
+		CancelledBy:   run.CancelledBy,
+		CancelledAt:   run.CancelledAt,
+		RepoName:      run.RepoName,
+		Branch:        run.Branch,
+		CommitSHA:     run.CommitSHA,
+		CommitMsg:     run.CommitMsg,
+		CommitAuthor:  run.CommitAuthor,
+		TriggeredBy:   run.TriggeredBy,
+		TriggerType:   run.TriggerType,
+		Provider:      run.Provider,
+		CloneURL:      run.CloneURL,
+		Ref:           run.Ref,
+		DefaultBranch: run.DefaultBranch,
+		Event:         run.Event,
+		DeliveryID:    run.DeliveryID,
+		SkipReason:    run.SkipReason,
+		PRNumber:      run.PRNumber,
+		BaseBranch:    run.BaseBranch,
+		HeadRepo:      run.HeadRepo,
+		HeadSHA:       run.HeadSHA,
+		FromFork:      run.FromFork,
+	}
+	if cfg != nil {
+		metadata.Config = *cfg
+	}
+
+	return activeStore().SaveRun(metadata)
 }
 
+// calculateOverallStatus derives a run status from its job results.
 func calculateOverallStatus(results map[string]types.JobResult) string {
-	overallStatus := "Success"
+	overallStatus := types.RunSuccess
 	for _, result := range results {
-		if result.Status == "Failure" {
-			overallStatus = "Failure"
-			break
+		switch result.Status {
+		case types.StatusCancelled:
+			return types.RunCancelled
+		case types.StatusSuccess:
+		default:
+			overallStatus = types.RunFailure
 		}
 	}
 	return overallStatus
@@ -157,58 +249,30 @@ func calculateOverallStatus(results map[string]types.JobResult) string {
 
 // GetRun retrieves the metadata for a specific run ID
 func GetRun(runID string) (*RunMetadata, error) {
-	filename := filepath.Join(runMetadataDir, fmt.Sprintf("run_%s.json", runID))
-	file, err := os.Open(filename)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, fmt.Errorf("run with ID '%s' not found", runID)
-		}
-		return nil, fmt.Errorf("failed to open metadata file: %w", err)
-	}
-	defer file.Close()
-
-	var metadata RunMetadata
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(&metadata)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode metadata from JSON: %w", err)
-	}
-
-	return &metadata, nil
+	return activeStore().GetRun(runID)
 }
 
 // GetRecentRuns retrieves a list of the most recent pipeline runs
 func GetRecentRuns(limit int) ([]RunMetadata, error) {
-	files, err := os.ReadDir(runMetadataDir)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return []RunMetadata{}, nil // No runs yet
-		}
-		return nil, fmt.Errorf("failed to read run metadata directory: %w", err)
-	}
-
-	var runs []RunMetadata
-	for _, file := range files {
-		if !file.IsDir() && filepath.Ext(file.Name()) == ".json" && len(file.Name()) > 8 && file.Name()[:4] == "run_" {
-			runID := file.Name()[4 : len(file.Name())-5]
-			metadata, err := GetRun(runID)
-			if err == nil {
-				runs = append(runs, *metadata)
-			} else {
-				fmt.Printf("Error reading run %s: %v\n", runID, err)
-			}
-		}
-	}
+	return activeStore().ListRuns(RunFilter{Limit: limit})
+}
 
-	// Sort runs by start time in descending order (most recent first)
-	sort.Slice(runs, func(i, j int) bool {
-		return runs[i].StartTime.After(runs[j].StartTime)
-	})
+// ListRuns retrieves the runs matching filter, most recent first
+func ListRuns(filter RunFilter) ([]RunMetadata, error) {
+	return activeStore().ListRuns(filter)
+}
+
+// Finished reports whether the run has left the pending and running states.
+func (m RunMetadata) Finished() bool {
+	return m.Status != types.RunPending && m.Status != types.RunRunning
+}
 
-	if len(runs) > limit {
-		return runs[:limit], nil
+// sortTime is the start time of a run, or its queue time if it hasn't started yet.
+func (m RunMetadata) sortTime() time.Time {
+	if m.StartTime.IsZero() {
+		return m.QueuedAt
 	}
-	return runs, nil
+	return m.StartTime
 }
 
 // DisplayRunResults displays the results in the CLI (remains the same)
@@ -216,8 +280,8 @@ func DisplayRunResults(results map[string]types.JobResult) {
 	fmt.Println("Pipeline Results:")
 	for jobName, result := range results {
 		fmt.Printf("%s: %s\n", jobName, result.Status)
-		for stepName, stepResult := range result.Steps {
-			fmt.Printf("Step: %s - Status: %s\n", stepName, stepResult.Status)
+		for _, stepResult := range result.Steps {
+			fmt.Printf("Step %d: %s - Status: %s\n", stepResult.Index+1, stepResult.Name, stepResult.Status)
 			fmt.Printf("Logs:\n%s\n", stepResult.Logs)
 		}
 		fmt.Println("---")
@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Storage backends
+const (
+	BackendJSON   = "json"   // One JSON file per run and repository, the default
+	BackendSQLite = "sqlite" // A single embedded SQLite database
+)
+
+// DefaultSQLitePath is the database file used by the SQLite backend when no
+// path is configured.
+const DefaultSQLitePath = "snapci.db"
+
+// RunFilter selects runs from a Store. Empty fields match every run.
+type RunFilter struct {
+	RepoName    string
+	Branch      string
+	Status      string
+	TriggerType string    // e.g. "webhook", "manual", "cli"
+	Since       time.Time // Only runs started (or, if pending, queued) at or after Since
+	Until       time.Time // Only runs started (or, if pending, queued) before Until
+	Limit       int       // Maximum number of runs returned, 0 = no limit
+	Offset      int       // Number of matching runs skipped, for pagination
+}
+
+// Store persists runs, repository authentication, run logs, webhook
+// deliveries and cancel requests.
+// The package-level functions use the store selected with Configure.
+type Store interface {
+	// SaveRun creates or replaces a run.
+	SaveRun(metadata RunMetadata) error
+	// GetRun returns a run by ID.
+	GetRun(runID string) (*RunMetadata, error)
+	// ListRuns returns the runs matching filter, most recent first.
+	ListRuns(filter RunFilter) ([]RunMetadata, error)
+
+	// SaveRepoAuth creates or replaces the authentication data of a repository.
+	SaveRepoAuth(auth RepoAuth) error
+	// GetRepoAuth returns the authentication data of a repository.
+	GetRepoAuth(repoName string) (*RepoAuth, error)
+	// ListRepoAuth returns the authentication data of every repository.
+	ListRepoAuth() ([]RepoAuth, error)
+
+	// OpenRunLog opens the log of a run for appending.
+	OpenRunLog(runID string) (io.WriteCloser, error)
+	// ReadRunLog returns the complete lines of a run's log written after
+	// offset, and the offset to continue reading from.
+	ReadRunLog(runID string, offset int64) ([]byte, int64, error)
+
+	// RecordDelivery records a webhook delivery. It returns false, and
+	// keeps the existing record, if the delivery was already recorded.
+	RecordDelivery(record DeliveryRecord) (bool, error)
+	// ForgetDelivery removes the record of a delivery, if any.
+	ForgetDelivery(deliveryID string) error
+	// ListDeliveries returns every recorded delivery.
+	ListDeliveries() ([]DeliveryRecord, error)
+
+	// SaveCancelRequest records a cancel request, unless the run already has one.
+	SaveCancelRequest(request CancelRequest) error
+	// GetCancelRequest returns the cancel request of a run, or nil if there is none.
+	GetCancelRequest(runID string) (*CancelRequest, error)
+	// DeleteCancelRequest removes the cancel request of a run, if any.
+	DeleteCancelRequest(runID string) error
+	// ListCancelRequests returns every pending cancel request.
+	ListCancelRequests() ([]CancelRequest, error)
+
+	Close() error
+}
+
+var (
+	storeMu sync.RWMutex
+	current Store = NewJSONStore(".")
+)
+
+// Open opens a store of the given backend. path is the root directory of
+// the JSON backend or the database file of the SQLite backend; an empty path
+// selects the default.
+func Open(backend, path string) (Store, error) {
+	switch backend {
+	case BackendJSON, "":
+		if path == "" {
+			path = "."
+		}
+		return NewJSONStore(path), nil
+	case BackendSQLite:
+		if path == "" {
+			path = DefaultSQLitePath
+		}
+		return OpenSQLiteStore(path)
+	default:
+		return nil, fmt.Errorf("unknown storage backend '%s' (expected %s or %s)", backend, BackendJSON, BackendSQLite)
+	}
+}
+
+// Configure opens the store used by the package-level functions, closing
+// the previous one.
+func Configure(backend, path string) error {
+	store, err := Open(backend, path)
+	if err != nil {
+		return err
+	}
+	storeMu.Lock()
+	previous := current
+	current = store
+	storeMu.Unlock()
+	return previous.Close()
+}
+
+// Close closes the configured store.
+func Close() error {
+	return activeStore().Close()
+}
+
+func activeStore() Store {
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	return current
+}
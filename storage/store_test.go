@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+// openStore opens an empty store of backend in a temporary directory.
+func openStore(t *testing.T, backend string) Store {
+	t.Helper()
+	path := t.TempDir()
+	if backend == BackendSQLite {
+		path = filepath.Join(path, "snapci.db")
+	}
+	store, err := Open(backend, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestNewRunIDIsOrdered(t *testing.T) {
+	ids := make([]string, 1000)
+	for i := range ids {
+		ids[i] = NewRunID()
+	}
+	if !slices.IsSorted(ids) {
+		t.Error("run IDs created one after another do not sort in creation order")
+	}
+	if len(slices.Compact(slices.Clone(ids))) != len(ids) {
+		t.Error("NewRunID() returned the same ID twice")
+	}
+	for _, id := range ids[:3] {
+		if err := validateRunID(id); err != nil {
+			t.Errorf("NewRunID() = %q: %v", id, err)
+		}
+	}
+}
+
+func TestRunConditions(t *testing.T) {
+	since := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	filter := RunFilter{RepoName: "owner/repo", Branch: "main", Status: "failure", TriggerType: "webhook", Since: since}
+
+	want := []string{"repo_name = ?", "branch = ?", "status = ?", "json_extract(data, '$.trigger_type') = ?", "start_time >= ?"}
+	wantArgs := []any{"owner/repo", "main", "failure", "webhook", since.UnixNano()}
+	for i := 0; i < 20; i++ { // Map iteration order used to vary between calls
+		conditions, args := runConditions(filter)
+		if !slices.Equal(conditions, want) || !reflect.DeepEqual(args, wantArgs) {
+			t.Fatalf("runConditions() = %v, %v; want %v, %v", conditions, args, want, wantArgs)
+		}
+	}
+
+	if conditions, args := runConditions(RunFilter{Status: "success"}); !slices.Equal(conditions, []string{"status = ?"}) || len(args) != 1 {
+		t.Errorf("runConditions(status only) = %v, %v", conditions, args)
+	}
+}
+
+func TestListRuns(t *testing.T) {
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	runs := []RunMetadata{
+		{ID: "01", RepoName: "owner/a", Branch: "main", Status: "success", TriggerType: "webhook", StartTime: start},
+		{ID: "02", RepoName: "owner/a", Branch: "dev", Status: "failure", TriggerType: "manual", StartTime: start.Add(time.Hour)},
+		{ID: "03", RepoName: "owner/b", Branch: "main", Status: "failure", TriggerType: "webhook", StartTime: start.Add(2 * time.Hour)},
+		{ID: "04", RepoName: "owner/a", Branch: "main", Status: "pending", TriggerType: "webhook", QueuedAt: start.Add(3 * time.Hour)},
+	}
+
+	tests := []struct {
+		name   string
+		filter RunFilter
+		want   []string
+	}{
+		{"all, most recent first", RunFilter{}, []string{"04", "03", "02", "01"}},
+		{"repository", RunFilter{RepoName: "owner/a"}, []string{"04", "02", "01"}},
+		{"repository and branch", RunFilter{RepoName: "owner/a", Branch: "main"}, []string{"04", "01"}},
+		{"status", RunFilter{Status: "failure"}, []string{"03", "02"}},
+		{"trigger type", RunFilter{TriggerType: "manual"}, []string{"02"}},
+		{"time range", RunFilter{Since: start.Add(time.Hour), Until: start.Add(3 * time.Hour)}, []string{"03", "02"}},
+		{"page", RunFilter{Limit: 2, Offset: 1}, []string{"03", "02"}},
+		{"offset only", RunFilter{Offset: 3}, []string{"01"}},
+		{"no match", RunFilter{RepoName: "owner/c"}, []string{}},
+	}
+	for _, backend := range []string{BackendJSON, BackendSQLite} {
+		t.Run(backend, func(t *testing.T) {
+			store := openStore(t, backend)
+			for _, run := range runs {
+				if err := store.SaveRun(run); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, tt := range tests {
+				listed, err := store.ListRuns(tt.filter)
+				if err != nil {
+					t.Fatalf("%s: %v", tt.name, err)
+				}
+				ids := []string{}
+				for _, run := range listed {
+					ids = append(ids, run.ID)
+				}
+				if !slices.Equal(ids, tt.want) {
+					t.Errorf("%s: ListRuns() = %v, want %v", tt.name, ids, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	from, to := openStore(t, BackendJSON), openStore(t, BackendSQLite)
+	runID := NewRunID()
+	if err := from.SaveRun(RunMetadata{ID: runID, RepoName: "owner/repo", Status: "success", StartTime: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := from.RecordDelivery(DeliveryRecord{ID: "delivery-1", RepoName: "owner/repo", ReceivedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := from.SaveCancelRequest(CancelRequest{RunID: runID, RequestedBy: "admin", RequestedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ { // Migrating twice must not duplicate anything
+		stats, err := Migrate(from, to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Runs != 1 || stats.Deliveries != 1 || stats.CancelRequests != 1 {
+			t.Errorf("Migrate() = %+v", stats)
+		}
+	}
+
+	if run, err := to.GetRun(runID); err != nil || run.RepoName != "owner/repo" {
+		t.Errorf("GetRun() after migrating = %+v, %v", run, err)
+	}
+	if runs, _ := to.ListRuns(RunFilter{}); len(runs) != 1 {
+		t.Errorf("%d runs after migrating twice, want 1", len(runs))
+	}
+	if isNew, err := to.RecordDelivery(DeliveryRecord{ID: "delivery-1", ReceivedAt: time.Now()}); err != nil || isNew {
+		t.Errorf("the migrated delivery was recorded again: %v, %v", isNew, err)
+	}
+	if request, err := to.GetCancelRequest(runID); err != nil || request == nil || request.RequestedBy != "admin" {
+		t.Errorf("GetCancelRequest() after migrating = %+v, %v", request, err)
+	}
+}
@@ -0,0 +1,154 @@
+// tokens/tokens.go
+
+package tokens
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	"snap-ci/storage"
+	"snap-ci/users"
+)
+
+// DefaultFile is where API tokens are stored when not configured.
+const DefaultFile = "api_tokens.json"
+
+// prefix marks snapci API tokens, so they are easy to recognise in configs and logs.
+const prefix = "snapci_"
+
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// ErrInvalidToken is returned by Verify for a token that was never created or
+// has been revoked.
+var ErrInvalidToken = errors.New("invalid API token")
+
+// Info describes an API token without revealing it.
+type Info struct {
+	Name      string    `json:"name"`
+	Role      string    `json:"role"` // One of the users roles
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Allows reports whether the token's role includes role.
+func (i Info) Allows(role string) bool {
+	return users.RoleAllows(i.Role, role)
+}
+
+// entry is a token as stored on disk. Only the SHA-256 hash of the token is
+// kept, so the file does not grant API access if it leaks.
+type entry struct {
+	Info
+	Hash string `json:"hash"` // Hex SHA-256 of the token
+}
+
+// File holds the stored tokens. Its lock serializes writers.
+var File = storage.NewJSONFile(DefaultFile, "API tokens")
+
+// Create generates a new token with a unique name and role and stores its
+// hash. The token itself is only returned here; it cannot be recovered later.
+func Create(name, role string) (string, error) {
+	if !namePattern.MatchString(name) {
+		return "", fmt.Errorf("invalid token name '%s': use letters, digits, '.', '_' and '-'", name)
+	}
+	if !users.ValidRole(role) {
+		return "", fmt.Errorf("invalid role '%s': use %s, %s or %s", role, users.RoleViewer, users.RoleOperator, users.RoleAdmin)
+	}
+
+	File.Lock()
+	defer File.Unlock()
+
+	entries, err := readEntries()
+	if err != nil {
+		return "", err
+	}
+	for _, e := range entries {
+		if e.Name == name {
+			return "", fmt.Errorf("a token named '%s' already exists", name)
+		}
+	}
+
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	token := prefix + hex.EncodeToString(random)
+
+	entries = append(entries, entry{
+		Info: Info{Name: name, Role: role, CreatedAt: time.Now()},
+		Hash: hash(token),
+	})
+	if err := File.Write(entries); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Revoke deletes the token with the given name.
+func Revoke(name string) error {
+	File.Lock()
+	defer File.Unlock()
+
+	entries, err := readEntries()
+	if err != nil {
+		return err
+	}
+	for i, e := range entries {
+		if e.Name == name {
+			return File.Write(append(entries[:i], entries[i+1:]...))
+		}
+	}
+	return fmt.Errorf("token '%s' not found", name)
+}
+
+// List returns the stored tokens, sorted by name.
+func List() ([]Info, error) {
+	entries, err := readEntries()
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]Info, 0, len(entries))
+	for _, e := range entries {
+		infos = append(infos, e.Info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+// Verify returns the token matching the presented value, or an error if
+// there is none. The file is read on every call, so tokens created or
+// revoked by the CLI take effect without a restart.
+func Verify(token string) (*Info, error) {
+	entries, err := readEntries()
+	if err != nil {
+		return nil, err
+	}
+	presented := []byte(hash(token))
+	for _, e := range entries {
+		if subtle.ConstantTimeCompare(presented, []byte(e.Hash)) == 1 {
+			if !users.ValidRole(e.Role) { // Never guess the rights of a damaged entry
+				return nil, fmt.Errorf("API token '%s' has no valid role; revoke and recreate it", e.Name)
+			}
+			info := e.Info
+			return &info, nil
+		}
+	}
+	return nil, ErrInvalidToken
+}
+
+func hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func readEntries() ([]entry, error) {
+	var entries []entry
+	err := File.Read(&entries)
+	return entries, err
+}
@@ -0,0 +1,113 @@
+package tokens
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"snap-ci/users"
+)
+
+func useTempFile(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "api_tokens.json")
+	File.Configure(path)
+	t.Cleanup(func() { File.Configure("") })
+	return path
+}
+
+func TestCreateVerifyRevoke(t *testing.T) {
+	path := useTempFile(t)
+
+	token, err := Create("deploy-bot", users.RoleOperator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(token, prefix) {
+		t.Errorf("token %q lacks the %s prefix", token, prefix)
+	}
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), token) {
+		t.Error("the token file holds the token itself")
+	}
+
+	info, err := Verify(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "deploy-bot" || info.Role != users.RoleOperator {
+		t.Errorf("Verify() = %+v", info)
+	}
+	if _, err := Verify(token + "x"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Verify(wrong token) error = %v, want ErrInvalidToken", err)
+	}
+
+	if _, err := Create("deploy-bot", users.RoleViewer); err == nil {
+		t.Error("Create() accepted a duplicate name")
+	}
+
+	if err := Revoke("deploy-bot"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Verify(token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Verify(revoked token) error = %v, want ErrInvalidToken", err)
+	}
+	if err := Revoke("deploy-bot"); err == nil {
+		t.Error("Revoke() of a missing token succeeded")
+	}
+}
+
+func TestCreateValidation(t *testing.T) {
+	useTempFile(t)
+	for _, tt := range []struct{ name, role string }{
+		{"", users.RoleViewer},
+		{"has space", users.RoleViewer},
+		{"bot/1", users.RoleViewer},
+		{"bot", ""},
+		{"bot", "superuser"},
+	} {
+		if _, err := Create(tt.name, tt.role); err == nil {
+			t.Errorf("Create(%q, %q) succeeded", tt.name, tt.role)
+		}
+	}
+}
+
+func TestVerifyRejectsTokensWithoutValidRole(t *testing.T) {
+	path := useTempFile(t)
+
+	for _, role := range []string{"", "root"} {
+		token := prefix + "0123456789abcdef"
+		entries := `[{"name":"damaged","role":"` + role + `","created_at":"2026-01-01T00:00:00Z","hash":"` + hash(token) + `"}]`
+		if err := os.WriteFile(path, []byte(entries), 0600); err != nil {
+			t.Fatal(err)
+		}
+		info, err := Verify(token)
+		if err == nil {
+			t.Errorf("Verify() of a token with role %q = %+v, want an error", role, info)
+		} else if errors.Is(err, ErrInvalidToken) || !strings.Contains(err.Error(), "no valid role") {
+			t.Errorf("Verify() of a token with role %q: error = %v", role, err)
+		}
+	}
+}
+
+func TestAllows(t *testing.T) {
+	tests := []struct {
+		role, want string
+		allowed    bool
+	}{
+		{users.RoleViewer, users.RoleViewer, true},
+		{users.RoleViewer, users.RoleOperator, false},
+		{users.RoleOperator, users.RoleViewer, true},
+		{users.RoleOperator, users.RoleOperator, true},
+		{users.RoleAdmin, users.RoleOperator, true},
+		{"", users.RoleViewer, false},
+		{users.RoleAdmin, "", false},
+	}
+	for _, tt := range tests {
+		if got := (Info{Role: tt.role}).Allows(tt.want); got != tt.allowed {
+			t.Errorf("Info{Role: %q}.Allows(%q) = %v, want %v", tt.role, tt.want, got, tt.allowed)
+		}
+	}
+}
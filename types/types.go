@@ -2,35 +2,140 @@
 
 package types
 
-import "time"
+import (
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// Job and step statuses recorded in JobResult and StepResult
+const (
+	StatusSuccess   = "Success"
+	StatusFailure   = "Failure"
+	StatusSkipped   = "Skipped"   // An upstream job in `needs` did not succeed
+	StatusTimedOut  = "TimedOut"  // The step exceeded its timeout-minutes and was terminated
+	StatusCancelled = "Cancelled" // The run was cancelled before or while the step ran
+)
+
+// Lifecycle states of a PipelineRun
+const (
+	RunPending   = "pending" // Queued, waiting for a worker
+	RunRunning   = "running"
+	RunSuccess   = "success"
+	RunFailure   = "failure"
+	RunCancelled = "cancelled"
+	RunSkipped   = "skipped" // The event does not match the pipeline's `on:` triggers
+)
+
+// Git hosting providers that send webhooks and hold repository credentials
+const (
+	ProviderGitHub = "github"
+	ProviderGitLab = "gitlab"
+	ProviderGitea  = "gitea" // Also Forgejo, which sends the same webhooks
+)
+
+// NoExitCode is the ExitCode of a step whose process never ran or was killed by a signal.
+const NoExitCode = -1
 
 // StepResult stores the result of a single step execution
 type StepResult struct {
-	Name   string `json:"name"`
-	Status string `json:"status"`
-	Logs   string `json:"logs"`
-	// StartTime time.Time `json:"start_time"` // If you add timestamps
-	// EndTime   time.Time `json:"end_time"`
+	Index     int           `json:"index"` // Position of the step within its job, from 0
+	Name      string        `json:"name"`
+	Status    string        `json:"status"`
+	Logs      string        `json:"logs"` // Captured stdout and stderr, also for failed steps
+	ExitCode  int           `json:"exit_code"`
+	StartTime time.Time     `json:"start_time"`
+	EndTime   time.Time     `json:"end_time"`
+	Duration  time.Duration `json:"duration"` // Nanoseconds
 }
 
 // JobResult stores the result of a job execution
 type JobResult struct {
-	Status string                `json:"status"`
-	Steps  map[string]StepResult `json:"steps"`
+	Status    string        `json:"status"`
+	Steps     []StepResult  `json:"steps"`      // In the order the job defines them
+	StartTime time.Time     `json:"start_time"` // Zero for jobs that never started
+	EndTime   time.Time     `json:"end_time"`
+	Duration  time.Duration `json:"duration"` // Nanoseconds
+}
+
+// UnmarshalJSON decodes a JobResult, also accepting results stored before
+// steps were kept in order, when they were a map keyed by step name. Those
+// steps are ordered by start time, and steps that never started go last.
+func (r *JobResult) UnmarshalJSON(data []byte) error {
+	type jobResult JobResult // Same fields, without this method
+	var decoded struct {
+		jobResult
+		Steps json.RawMessage `json:"steps"`
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	*r = JobResult(decoded.jobResult)
+	r.Steps = nil
+
+	steps := decoded.Steps
+	if len(steps) == 0 || string(steps) == "null" {
+		return nil
+	}
+	if steps[0] == '[' {
+		return json.Unmarshal(steps, &r.Steps)
+	}
+
+	var legacy map[string]StepResult
+	if err := json.Unmarshal(steps, &legacy); err != nil {
+		return err
+	}
+	for name, step := range legacy {
+		if step.Name == "" {
+			step.Name = name
+		}
+		r.Steps = append(r.Steps, step)
+	}
+	sort.Slice(r.Steps, func(i, j int) bool {
+		a, b := r.Steps[i], r.Steps[j]
+		if a.StartTime.IsZero() != b.StartTime.IsZero() {
+			return b.StartTime.IsZero()
+		}
+		if !a.StartTime.Equal(b.StartTime) {
+			return a.StartTime.Before(b.StartTime)
+		}
+		return a.Name < b.Name
+	})
+	for i := range r.Steps {
+		r.Steps[i].Index = i
+	}
+	return nil
 }
 
 // PipelineRun represents a single execution of a CI/CD pipeline.
 type PipelineRun struct {
-	ID           string               `json:"id"`
-	RepoName     string               `json:"repo_name"`
-	Branch       string               `json:"branch"`
-	CommitSHA    string               `json:"commit_sha"`
-	CommitMsg    string               `json:"commit_msg"`
-	CommitAuthor string               `json:"commit_author"`
-	TriggeredBy  string               `json:"triggered_by"` // User/system that triggered it
-	TriggerType  string               `json:"trigger_type"` // New field: e.g., "webhook", "manual", "scheduled"
-	Status       string               `json:"status"`       // e.g., "pending", "running", "success", "failure"
-	StartTime    time.Time            `json:"start_time"`
-	EndTime      time.Time            `json:"end_time"`
-	Results      map[string]JobResult `json:"results"`
+	ID            string               `json:"id"`
+	RepoName      string               `json:"repo_name"`
+	Branch        string               `json:"branch"`
+	CommitSHA     string               `json:"commit_sha"`
+	CommitMsg     string               `json:"commit_msg"`
+	CommitAuthor  string               `json:"commit_author"`
+	TriggeredBy   string               `json:"triggered_by"`             // User/system that triggered it
+	TriggerType   string               `json:"trigger_type"`             // New field: e.g., "webhook", "manual", "scheduled"
+	Status        string               `json:"status"`                   // e.g., "pending", "running", "success", "failure"
+	Provider      string               `json:"provider,omitempty"`       // Provider whose webhook created the run; empty for other runs
+	CloneURL      string               `json:"clone_url"`                // URL the workspace is cloned from
+	Ref           string               `json:"ref"`                      // Full ref to build, e.g. "refs/heads/main"
+	DefaultBranch string               `json:"default_branch,omitempty"` // The repository's default branch, if known; schedules are taken from its .ci.yaml
+	Event         string               `json:"event,omitempty"`          // Webhook event that created the run, matched against `on:`
+	DeliveryID    string               `json:"delivery_id,omitempty"`    // The provider's delivery ID of that event, e.g. X-GitHub-Delivery
+	ChangedFiles  []string             `json:"changed_files,omitempty"`  // Paths changed by the event, nil if unknown
+	SkipReason    string               `json:"skip_reason,omitempty"`    // Why the `on:` triggers did not match
+	PRNumber      int                  `json:"pr_number,omitempty"`      // Pull request (or GitLab merge request) built by the run, 0 for other runs
+	BaseBranch    string               `json:"base_branch,omitempty"`    // Branch the pull request targets
+	HeadRepo      string               `json:"head_repo,omitempty"`      // Repository the pull request comes from
+	HeadSHA       string               `json:"head_sha,omitempty"`       // Head commit of the pull request, which gets its commit statuses
+	FromFork      bool                 `json:"from_fork,omitempty"`      // Head repository differs from RepoName; the run gets no secrets or PAT
+	QueuedAt      time.Time            `json:"queued_at"`
+	StartTime     time.Time            `json:"start_time"`
+	EndTime       time.Time            `json:"end_time"`
+	Error         string               `json:"error,omitempty"` // Why the run failed before or outside its jobs
+	CancelledBy   string               `json:"cancelled_by,omitempty"`
+	CancelledAt   time.Time            `json:"cancelled_at,omitempty"`
+	Results       map[string]JobResult `json:"results"`
 }
@@ -0,0 +1,202 @@
+// users/users.go
+
+package users
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"snap-ci/storage"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// DefaultFile is where dashboard users are stored when not configured.
+const DefaultFile = "users.json"
+
+// Roles, from least to most privileged. Each role may do everything the
+// roles before it may.
+const (
+	RoleViewer   = "viewer"   // Read runs and logs
+	RoleOperator = "operator" // Also trigger, rerun and cancel runs
+	RoleAdmin    = "admin"    // Also manage repository auth, webhooks and secrets
+)
+
+var roleRank = map[string]int{RoleViewer: 1, RoleOperator: 2, RoleAdmin: 3}
+
+// MinPasswordLength is the shortest password accepted by Add and SetPassword.
+const MinPasswordLength = 8
+
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9_.@-]+$`)
+
+// ErrInvalidCredentials is returned by Authenticate for an unknown user or a
+// wrong password, without telling which.
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+// User is a dashboard account.
+type User struct {
+	Username     string    `json:"username"`
+	Role         string    `json:"role"`
+	PasswordHash string    `json:"password_hash"` // bcrypt
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Allows reports whether the user's role includes role.
+func (u User) Allows(role string) bool {
+	return RoleAllows(u.Role, role)
+}
+
+// RoleAllows reports whether the role have includes the role want. API
+// tokens are checked against the same roles as users.
+func RoleAllows(have, want string) bool {
+	return roleRank[have] >= roleRank[want] && roleRank[want] > 0
+}
+
+var (
+	// File holds the users. Its lock serializes writers.
+	File = storage.NewJSONFile(DefaultFile, "users")
+
+	// dummyHash is compared against for unknown users, so a login takes
+	// as long whether or not the username exists.
+	dummyHash = sync.OnceValue(func() []byte {
+		hash, _ := bcrypt.GenerateFromPassword([]byte("snapci-dummy-password"), bcrypt.DefaultCost)
+		return hash
+	})
+)
+
+// ValidRole reports whether role is one of the known roles.
+func ValidRole(role string) bool {
+	_, ok := roleRank[role]
+	return ok
+}
+
+// Add creates a user.
+func Add(username, password, role string) error {
+	if !namePattern.MatchString(username) {
+		return fmt.Errorf("invalid username '%s': use letters, digits, '.', '_', '@' and '-'", username)
+	}
+	if !ValidRole(role) {
+		return fmt.Errorf("invalid role '%s': use %s, %s or %s", role, RoleViewer, RoleOperator, RoleAdmin)
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	File.Lock()
+	defer File.Unlock()
+
+	all, err := readUsers()
+	if err != nil {
+		return err
+	}
+	if _, exists := all[username]; exists {
+		return fmt.Errorf("user '%s' already exists", username)
+	}
+	all[username] = User{Username: username, Role: role, PasswordHash: hash, CreatedAt: time.Now()}
+	return File.Write(all)
+}
+
+// Remove deletes a user.
+func Remove(username string) error {
+	File.Lock()
+	defer File.Unlock()
+
+	all, err := readUsers()
+	if err != nil {
+		return err
+	}
+	if _, exists := all[username]; !exists {
+		return fmt.Errorf("user '%s' not found", username)
+	}
+	delete(all, username)
+	return File.Write(all)
+}
+
+// SetPassword replaces the password of a user.
+func SetPassword(username, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	File.Lock()
+	defer File.Unlock()
+
+	all, err := readUsers()
+	if err != nil {
+		return err
+	}
+	user, exists := all[username]
+	if !exists {
+		return fmt.Errorf("user '%s' not found", username)
+	}
+	user.PasswordHash = hash
+	all[username] = user
+	return File.Write(all)
+}
+
+// List returns all users, sorted by username.
+func List() ([]User, error) {
+	all, err := readUsers()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]User, 0, len(all))
+	for _, user := range all {
+		list = append(list, user)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Username < list[j].Username })
+	return list, nil
+}
+
+// Get returns a user by name.
+func Get(username string) (*User, error) {
+	all, err := readUsers()
+	if err != nil {
+		return nil, err
+	}
+	user, exists := all[username]
+	if !exists {
+		return nil, fmt.Errorf("user '%s' not found", username)
+	}
+	return &user, nil
+}
+
+// Authenticate checks a username and password and returns the user.
+func Authenticate(username, password string) (*User, error) {
+	all, err := readUsers()
+	if err != nil {
+		return nil, err
+	}
+	user, exists := all[username]
+	if !exists {
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return nil, ErrInvalidCredentials
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		return nil, ErrInvalidCredentials
+	}
+	return &user, nil
+}
+
+func hashPassword(password string) (string, error) {
+	if len(password) < MinPasswordLength {
+		return "", fmt.Errorf("password must be at least %d characters", MinPasswordLength)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash password: %w", err)
+	}
+	return string(hash), nil
+}
+
+func readUsers() (map[string]User, error) {
+	all := map[string]User{}
+	err := File.Read(&all)
+	return all, err
+}
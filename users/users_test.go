@@ -0,0 +1,120 @@
+package users
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func useTempFile(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "users.json")
+	File.Configure(path)
+	t.Cleanup(func() { File.Configure("") })
+	return path
+}
+
+func TestAddAndAuthenticate(t *testing.T) {
+	path := useTempFile(t)
+
+	if err := Add("alice", "correct horse", RoleOperator); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), "correct horse") {
+		t.Error("the users file holds the password itself")
+	}
+
+	user, err := Authenticate("alice", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Username != "alice" || user.Role != RoleOperator {
+		t.Errorf("Authenticate() = %+v", user)
+	}
+	for _, tt := range []struct{ username, password string }{
+		{"alice", "wrong horse"},
+		{"alice", ""},
+		{"bob", "correct horse"},
+	} {
+		if _, err := Authenticate(tt.username, tt.password); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("Authenticate(%q, %q) error = %v, want ErrInvalidCredentials", tt.username, tt.password, err)
+		}
+	}
+
+	if err := SetPassword("alice", "battery staple"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Authenticate("alice", "correct horse"); err == nil {
+		t.Error("the old password still works after SetPassword")
+	}
+	if _, err := Authenticate("alice", "battery staple"); err != nil {
+		t.Errorf("the new password does not work: %v", err)
+	}
+
+	if err := Remove("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Authenticate("alice", "battery staple"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("a removed user signed in: %v", err)
+	}
+}
+
+func TestAddValidation(t *testing.T) {
+	useTempFile(t)
+	if err := Add("alice", "correct horse", RoleViewer); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name, username, password, role string
+	}{
+		{"duplicate", "alice", "correct horse", RoleViewer},
+		{"empty name", "", "correct horse", RoleViewer},
+		{"name with a space", "bob smith", "correct horse", RoleViewer},
+		{"short password", "bob", "short", RoleViewer},
+		{"no role", "bob", "correct horse", ""},
+		{"unknown role", "bob", "correct horse", "root"},
+	} {
+		if err := Add(tt.username, tt.password, tt.role); err == nil {
+			t.Errorf("%s: Add(%q, %q, %q) succeeded", tt.name, tt.username, tt.password, tt.role)
+		}
+	}
+	if err := SetPassword("alice", "short"); err == nil {
+		t.Error("SetPassword() accepted a short password")
+	}
+	if err := SetPassword("nobody", "correct horse"); err == nil {
+		t.Error("SetPassword() of a missing user succeeded")
+	}
+
+	list, err := List()
+	if err != nil || len(list) != 1 || list[0].Username != "alice" {
+		t.Errorf("List() = %+v, %v", list, err)
+	}
+}
+
+func TestRoleAllows(t *testing.T) {
+	tests := []struct {
+		have, want string
+		allowed    bool
+	}{
+		{RoleViewer, RoleViewer, true},
+		{RoleViewer, RoleOperator, false},
+		{RoleViewer, RoleAdmin, false},
+		{RoleOperator, RoleViewer, true},
+		{RoleOperator, RoleAdmin, false},
+		{RoleAdmin, RoleViewer, true},
+		{RoleAdmin, RoleAdmin, true},
+		{"", RoleViewer, false},
+		{"root", RoleViewer, false},
+		{RoleAdmin, "", false},
+		{RoleAdmin, "root", false},
+	}
+	for _, tt := range tests {
+		if got := RoleAllows(tt.have, tt.want); got != tt.allowed {
+			t.Errorf("RoleAllows(%q, %q) = %v, want %v", tt.have, tt.want, got, tt.allowed)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// watch/watch.go
+
+package watch
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"snap-ci/storage"
+)
+
+// DefaultFile is where watched repositories and their last-seen branch heads
+// are stored when not configured.
+const DefaultFile = "watches.json"
+
+// Repo is a repository polled with `git ls-remote` instead of receiving webhooks.
+type Repo struct {
+	Name     string            `json:"name"`     // e.g. owner/repo-name; also the key of its stored auth and secrets
+	URL      string            `json:"url"`      // Any URL git understands, without credentials
+	Branches []string          `json:"branches"` // Globs of the branches to watch; empty for the default branch only
+	Heads    map[string]string `json:"heads"`    // Branch -> last-seen commit SHA
+	Polled   time.Time         `json:"polled"`   // When the heads were last read; zero until the first poll
+	AddedAt  time.Time         `json:"added_at"`
+}
+
+// File holds the watched repositories. Its lock serializes writers.
+var File = storage.NewJSONFile(DefaultFile, "watched repositories")
+
+// Add starts watching a repository, or changes the URL and branches of a
+// watched one while keeping its last-seen heads. When the branches change,
+// the next poll records the heads of the newly watched branches instead of
+// starting runs for them.
+func Add(name, url string, branches []string) error {
+	if name == "" || url == "" {
+		return fmt.Errorf("a repository name and URL are required")
+	}
+
+	File.Lock()
+	defer File.Unlock()
+
+	repos, err := readRepos()
+	if err != nil {
+		return err
+	}
+	for i, repo := range repos {
+		if repo.Name == name {
+			if !slices.Equal(repo.Branches, branches) {
+				repos[i].Polled = time.Time{}
+			}
+			repos[i].URL, repos[i].Branches = url, branches
+			return File.Write(repos)
+		}
+	}
+	repos = append(repos, Repo{Name: name, URL: url, Branches: branches, Heads: map[string]string{}, AddedAt: time.Now()})
+	return File.Write(repos)
+}
+
+// Remove stops watching a repository.
+func Remove(name string) error {
+	File.Lock()
+	defer File.Unlock()
+
+	repos, err := readRepos()
+	if err != nil {
+		return err
+	}
+	for i, repo := range repos {
+		if repo.Name == name {
+			return File.Write(append(repos[:i], repos[i+1:]...))
+		}
+	}
+	return fmt.Errorf("repository '%s' is not watched", name)
+}
+
+// List returns the watched repositories, sorted by name.
+func List() ([]Repo, error) {
+	File.Lock()
+	defer File.Unlock()
+
+	repos, err := readRepos()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(repos, func(i, j int) bool { return repos[i].Name < repos[j].Name })
+	return repos, nil
+}
+
+// SetHead records the last-seen commit of a branch, or forgets the branch
+// if sha is empty. The file is re-read first, so changes made meanwhile by
+// `snapci watch add` are kept.
+func SetHead(name, branch, sha string) error {
+	return update(name, func(repo *Repo) {
+		if sha == "" {
+			delete(repo.Heads, branch)
+		} else {
+			repo.Heads[branch] = sha
+		}
+	})
+}
+
+// MarkPolled records that the heads of a repository were read.
+func MarkPolled(name string, at time.Time) error {
+	return update(name, func(repo *Repo) { repo.Polled = at })
+}
+
+func update(name string, change func(*Repo)) error {
+	File.Lock()
+	defer File.Unlock()
+
+	repos, err := readRepos()
+	if err != nil {
+		return err
+	}
+	for i := range repos {
+		if repos[i].Name == name {
+			if repos[i].Heads == nil {
+				repos[i].Heads = map[string]string{}
+			}
+			change(&repos[i])
+			return File.Write(repos)
+		}
+	}
+	return nil // Removed meanwhile
+}
+
+func readRepos() ([]Repo, error) {
+	var repos []Repo
+	err := File.Read(&repos)
+	return repos, err
+}
@@ -0,0 +1,422 @@
+package web
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"snap-ci/git"
+	"snap-ci/storage"
+	"snap-ci/tokens"
+	"snap-ci/types"
+	"snap-ci/users"
+)
+
+// The JSON API is versioned by path; incompatible changes get a new prefix.
+const apiPrefix = "/api/v1"
+
+// Pagination of GET /api/v1/runs
+const (
+	defaultPerPage = 20
+	maxPerPage     = 100
+)
+
+//go:embed openapi.json
+var openAPIDocument []byte
+
+// apiRun is a run as returned by the API. Jobs are only included when a
+// single run is requested.
+type apiRun struct {
+	ID           string     `json:"id"`
+	Repo         string     `json:"repo"`
+	Branch       string     `json:"branch"`
+	CommitSHA    string     `json:"commit_sha"`
+	CommitMsg    string     `json:"commit_msg"`
+	CommitAuthor string     `json:"commit_author"`
+	TriggeredBy  string     `json:"triggered_by"`
+	TriggerType  string     `json:"trigger_type"`
+	Status       string     `json:"status"`
+	Error        string     `json:"error,omitempty"`
+	CancelledBy  string     `json:"cancelled_by,omitempty"`
+	SkipReason   string     `json:"skip_reason,omitempty"`
+	PRNumber     int        `json:"pr_number,omitempty"`
+	BaseBranch   string     `json:"base_branch,omitempty"`
+	HeadRepo     string     `json:"head_repo,omitempty"`
+	FromFork     bool       `json:"from_fork,omitempty"`
+	QueuedAt     *time.Time `json:"queued_at,omitempty"`
+	StartTime    *time.Time `json:"start_time,omitempty"`
+	EndTime      *time.Time `json:"end_time,omitempty"`
+	DurationMs   *int64     `json:"duration_ms,omitempty"`
+	Jobs         []apiJob   `json:"jobs,omitempty"`
+}
+
+type apiJob struct {
+	Name       string     `json:"name"`
+	Status     string     `json:"status"`
+	StartTime  *time.Time `json:"start_time,omitempty"`
+	EndTime    *time.Time `json:"end_time,omitempty"`
+	DurationMs *int64     `json:"duration_ms,omitempty"`
+	Steps      []apiStep  `json:"steps"`
+}
+
+type apiStep struct {
+	Index      int        `json:"index"`
+	Name       string     `json:"name"`
+	Status     string     `json:"status"`
+	ExitCode   *int       `json:"exit_code"` // null if the process never ran or was killed by a signal
+	StartTime  *time.Time `json:"start_time,omitempty"`
+	EndTime    *time.Time `json:"end_time,omitempty"`
+	DurationMs *int64     `json:"duration_ms,omitempty"`
+	LogsURL    string     `json:"logs_url"`
+}
+
+type apiRunList struct {
+	Runs     []apiRun `json:"runs"`
+	Page     int      `json:"page"`
+	PerPage  int      `json:"per_page"`
+	NextPage *int     `json:"next_page"` // null on the last page
+}
+
+// triggerRequest is the body of POST /api/v1/runs.
+type triggerRequest struct {
+	Repo      string `json:"repo"`
+	Branch    string `json:"branch"`
+	CommitSHA string `json:"commit_sha"`
+}
+
+// registerAPI adds the /api/v1 routes to the default mux.
+func registerAPI() {
+	http.HandleFunc("GET "+apiPrefix+"/openapi.json", openAPIHandler)
+	http.HandleFunc("GET "+apiPrefix+"/runs", requireToken(users.RoleViewer, apiListRunsHandler))
+	http.HandleFunc("POST "+apiPrefix+"/runs", requireToken(users.RoleOperator, apiTriggerRunHandler))
+	http.HandleFunc("GET "+apiPrefix+"/runs/{id}", requireToken(users.RoleViewer, apiGetRunHandler))
+	http.HandleFunc("GET "+apiPrefix+"/runs/{id}/logs", requireToken(users.RoleViewer, apiRunLogHandler))
+	http.HandleFunc("GET "+apiPrefix+"/runs/{id}/jobs/{job}/steps/{index}/logs", requireToken(users.RoleViewer, apiStepLogHandler))
+	http.HandleFunc("POST "+apiPrefix+"/runs/{id}/cancel", requireToken(users.RoleOperator, apiCancelRunHandler))
+	http.HandleFunc("POST "+apiPrefix+"/runs/{id}/rerun", requireToken(users.RoleOperator, apiRerunHandler))
+	http.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusNotFound, "no such API endpoint")
+	})
+}
+
+// apiHandler is an API handler that knows which token authenticated the request.
+type apiHandler func(w http.ResponseWriter, r *http.Request, token *tokens.Info)
+
+// requireToken rejects requests without a valid `Authorization: Bearer <token>`
+// header, and requests whose token's role does not include role.
+func requireToken(role string, next apiHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		presented, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || presented == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="snapci"`)
+			writeAPIError(w, http.StatusUnauthorized, "missing API token")
+			return
+		}
+		token, err := tokens.Verify(strings.TrimSpace(presented))
+		if err != nil {
+			if !errors.Is(err, tokens.ErrInvalidToken) {
+				log.Printf("API authentication failed: %v", err)
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="snapci", error="invalid_token"`)
+			writeAPIError(w, http.StatusUnauthorized, "invalid API token")
+			return
+		}
+		if !token.Allows(role) {
+			writeAPIError(w, http.StatusForbidden, fmt.Sprintf("API token %s has role %s; this endpoint requires %s", token.Name, token.Role, role))
+			return
+		}
+		next(w, r, token)
+	}
+}
+
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIDocument)
+}
+
+func apiListRunsHandler(w http.ResponseWriter, r *http.Request, _ *tokens.Info) {
+	query := r.URL.Query()
+	page, err := positiveIntParam(query.Get("page"), 1)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "page: "+err.Error())
+		return
+	}
+	perPage, err := positiveIntParam(query.Get("per_page"), defaultPerPage)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "per_page: "+err.Error())
+		return
+	}
+	perPage = min(perPage, maxPerPage)
+
+	filter := storage.RunFilter{
+		RepoName:    query.Get("repo"),
+		Branch:      query.Get("branch"),
+		Status:      query.Get("status"),
+		TriggerType: query.Get("trigger_type"),
+		Offset:      (page - 1) * perPage,
+		Limit:       perPage + 1, // One extra to tell whether there is a next page
+	}
+	for name, target := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if value := query.Get(name); value != "" {
+			if *target, err = time.Parse(time.RFC3339, value); err != nil {
+				writeAPIError(w, http.StatusBadRequest, name+": expected an RFC 3339 time")
+				return
+			}
+		}
+	}
+
+	runs, err := storage.ListRuns(filter)
+	if err != nil {
+		log.Printf("API: error listing runs: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "failed to list runs")
+		return
+	}
+
+	list := apiRunList{Runs: []apiRun{}, Page: page, PerPage: perPage}
+	if len(runs) > perPage {
+		runs = runs[:perPage]
+		next := page + 1
+		list.NextPage = &next
+	}
+	for _, run := range runs {
+		list.Runs = append(list.Runs, toAPIRun(run, false))
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func apiGetRunHandler(w http.ResponseWriter, r *http.Request, _ *tokens.Info) {
+	run, ok := lookupRun(w, r.PathValue("id"))
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, toAPIRun(*run, true))
+}
+
+// apiRunLogHandler returns the run's combined live log as plain text.
+func apiRunLogHandler(w http.ResponseWriter, r *http.Request, _ *tokens.Info) {
+	runID := r.PathValue("id")
+	if _, ok := lookupRun(w, runID); !ok {
+		return
+	}
+	data, _, err := storage.ReadRunLog(runID, 0)
+	if err != nil {
+		log.Printf("API: error reading log of run %s: %v", runID, err)
+		writeAPIError(w, http.StatusInternalServerError, "failed to read run log")
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(data)
+}
+
+// apiStepLogHandler returns the captured output of one step as plain text.
+func apiStepLogHandler(w http.ResponseWriter, r *http.Request, _ *tokens.Info) {
+	run, ok := lookupRun(w, r.PathValue("id"))
+	if !ok {
+		return
+	}
+	job, ok := run.Results[r.PathValue("job")]
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("run %s has no job '%s'", run.ID, r.PathValue("job")))
+		return
+	}
+	index, err := strconv.Atoi(r.PathValue("index"))
+	if err != nil || index < 0 || index >= len(job.Steps) {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("job '%s' has no step %s", r.PathValue("job"), r.PathValue("index")))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(job.Steps[index].Logs))
+}
+
+func apiTriggerRunHandler(w http.ResponseWriter, r *http.Request, token *tokens.Info) {
+	var request triggerRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&request); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	if request.Repo == "" {
+		writeAPIError(w, http.StatusBadRequest, "repo is required")
+		return
+	}
+
+	run, err := git.QueueManualRun(request.Repo, request.Branch, request.CommitSHA, apiActor(token))
+	if err != nil {
+		log.Printf("API: error queueing run for %s: %v", request.Repo, err)
+		writeAPIError(w, http.StatusServiceUnavailable, "failed to queue run: "+err.Error())
+		return
+	}
+	log.Printf("API: run %s queued for %s by %s", run.ID, run.RepoName, apiActor(token))
+	writeQueuedRun(w, run.ID)
+}
+
+func apiCancelRunHandler(w http.ResponseWriter, r *http.Request, token *tokens.Info) {
+	runID := r.PathValue("id")
+	if _, ok := lookupRun(w, runID); !ok {
+		return
+	}
+	if err := storage.RequestCancel(runID, apiActor(token)); err != nil {
+		writeAPIError(w, http.StatusConflict, err.Error())
+		return
+	}
+	log.Printf("API: cancellation of run %s requested by %s", runID, apiActor(token))
+	writeJSON(w, http.StatusAccepted, map[string]string{"run_id": runID, "status": "cancel_requested"})
+}
+
+func apiRerunHandler(w http.ResponseWriter, r *http.Request, token *tokens.Info) {
+	runID := r.PathValue("id")
+	if _, ok := lookupRun(w, runID); !ok {
+		return
+	}
+	run, err := git.Rerun(runID, apiActor(token))
+	if err != nil {
+		log.Printf("API: error rerunning run %s: %v", runID, err)
+		writeAPIError(w, http.StatusConflict, err.Error())
+		return
+	}
+	log.Printf("API: run %s queued as a rerun of %s by %s", run.ID, runID, apiActor(token))
+	writeQueuedRun(w, run.ID)
+}
+
+// writeQueuedRun answers 202 Accepted with the newly queued run.
+func writeQueuedRun(w http.ResponseWriter, runID string) {
+	run, err := storage.GetRun(runID)
+	if err != nil {
+		writeJSON(w, http.StatusAccepted, map[string]string{"id": runID})
+		return
+	}
+	w.Header().Set("Location", apiPrefix+"/runs/"+runID)
+	writeJSON(w, http.StatusAccepted, toAPIRun(*run, false))
+}
+
+// lookupRun loads a run, answering 404 if it doesn't exist.
+func lookupRun(w http.ResponseWriter, runID string) (*storage.RunMetadata, bool) {
+	run, err := storage.GetRun(runID)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("run '%s' not found", runID))
+		return nil, false
+	}
+	return run, true
+}
+
+// apiActor is how runs and cancellations record the token that requested them.
+func apiActor(token *tokens.Info) string {
+	return "api:" + token.Name
+}
+
+func toAPIRun(run storage.RunMetadata, withJobs bool) apiRun {
+	out := apiRun{
+		ID:           run.ID,
+		Repo:         run.RepoName,
+		Branch:       run.Branch,
+		CommitSHA:    run.CommitSHA,
+		CommitMsg:    run.CommitMsg,
+		CommitAuthor: run.CommitAuthor,
+		TriggeredBy:  run.TriggeredBy,
+		TriggerType:  run.TriggerType,
+		Status:       run.Status,
+		Error:        run.Error,
+		CancelledBy:  run.CancelledBy,
+		SkipReason:   run.SkipReason,
+		PRNumber:     run.PRNumber,
+		BaseBranch:   run.BaseBranch,
+		HeadRepo:     run.HeadRepo,
+		FromFork:     run.FromFork,
+		QueuedAt:     optionalTime(run.QueuedAt),
+		StartTime:    optionalTime(run.StartTime),
+		EndTime:      optionalTime(run.EndTime),
+	}
+	if !run.StartTime.IsZero() && !run.EndTime.IsZero() {
+		out.DurationMs = durationMs(run.EndTime.Sub(run.StartTime))
+	}
+	if !withJobs {
+		return out
+	}
+
+	out.Jobs = []apiJob{}
+	for name, result := range run.Results {
+		job := apiJob{
+			Name:      name,
+			Status:    result.Status,
+			StartTime: optionalTime(result.StartTime),
+			EndTime:   optionalTime(result.EndTime),
+			Steps:     []apiStep{},
+		}
+		if !result.StartTime.IsZero() {
+			job.DurationMs = durationMs(result.Duration)
+		}
+		for _, step := range result.Steps {
+			s := apiStep{
+				Index:     step.Index,
+				Name:      step.Name,
+				Status:    step.Status,
+				StartTime: optionalTime(step.StartTime),
+				EndTime:   optionalTime(step.EndTime),
+				LogsURL:   fmt.Sprintf("%s/runs/%s/jobs/%s/steps/%d/logs", apiPrefix, run.ID, url.PathEscape(name), step.Index),
+			}
+			if step.ExitCode != types.NoExitCode {
+				exitCode := step.ExitCode
+				s.ExitCode = &exitCode
+			}
+			if !step.StartTime.IsZero() {
+				s.DurationMs = durationMs(step.Duration)
+			}
+			job.Steps = append(job.Steps, s)
+		}
+		out.Jobs = append(out.Jobs, job)
+	}
+	// Jobs in the order they ran; jobs that never started last
+	sort.Slice(out.Jobs, func(i, j int) bool {
+		a, b := out.Jobs[i], out.Jobs[j]
+		if (a.StartTime == nil) != (b.StartTime == nil) {
+			return b.StartTime == nil
+		}
+		if a.StartTime != nil && !a.StartTime.Equal(*b.StartTime) {
+			return a.StartTime.Before(*b.StartTime)
+		}
+		return a.Name < b.Name
+	})
+	return out
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func durationMs(d time.Duration) *int64 {
+	ms := d.Milliseconds()
+	return &ms
+}
+
+func positiveIntParam(value string, fallback int) (int, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, errors.New("must be a positive integer")
+	}
+	return n, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("API: error encoding response: %v", err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,70 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"snap-ci/tokens"
+	"snap-ci/users"
+)
+
+func TestRequireToken(t *testing.T) {
+	tokens.File.Configure(filepath.Join(t.TempDir(), "api_tokens.json"))
+	t.Cleanup(func() { tokens.File.Configure("") })
+
+	viewer, err := tokens.Create("viewer-bot", users.RoleViewer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	operator, err := tokens.Create("operator-bot", users.RoleOperator)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		authorization string
+		role          string
+		wantStatus    int
+		wantToken     string
+	}{
+		{"no header", "", users.RoleViewer, http.StatusUnauthorized, ""},
+		{"basic auth", "Basic dXNlcjpwYXNz", users.RoleViewer, http.StatusUnauthorized, ""},
+		{"empty bearer", "Bearer ", users.RoleViewer, http.StatusUnauthorized, ""},
+		{"unknown token", "Bearer snapci_nope", users.RoleViewer, http.StatusUnauthorized, ""},
+		{"viewer reads", "Bearer " + viewer, users.RoleViewer, http.StatusOK, "viewer-bot"},
+		{"viewer triggers", "Bearer " + viewer, users.RoleOperator, http.StatusForbidden, ""},
+		{"operator reads", "Bearer " + operator, users.RoleViewer, http.StatusOK, "operator-bot"},
+		{"operator triggers", "Bearer " + operator, users.RoleOperator, http.StatusOK, "operator-bot"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var called *tokens.Info
+			handler := requireToken(tt.role, func(w http.ResponseWriter, r *http.Request, token *tokens.Info) {
+				called = token
+			})
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/runs", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantToken == "" {
+				if called != nil {
+					t.Errorf("handler ran for token %s", called.Name)
+				}
+			} else if called == nil || called.Name != tt.wantToken {
+				t.Errorf("handler got token %+v, want %s", called, tt.wantToken)
+			}
+			if rec.Code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Error("401 without a WWW-Authenticate header")
+			}
+		})
+	}
+}
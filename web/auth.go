@@ -0,0 +1,248 @@
+package web
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"snap-ci/users"
+)
+
+const (
+	sessionCookieName = "snapci_session"
+	sessionTTL        = 12 * time.Hour
+	csrfFieldName     = "csrf_token"
+)
+
+// session is a signed-in dashboard user. Sessions live in memory, so
+// restarting the web server signs everyone out.
+type session struct {
+	username  string
+	csrfToken string // Must accompany every POST made with this session
+	expires   time.Time
+}
+
+var (
+	sessionsMu sync.Mutex
+	sessions   = map[string]*session{}
+)
+
+type contextKey int
+
+const userContextKey contextKey = iota
+
+// signedInUser is the user handling a request, with their session.
+type signedInUser struct {
+	user    *users.User
+	session *session
+}
+
+func newSession(username string) (string, *session) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+
+	// Drop expired sessions while we're here
+	now := time.Now()
+	for id, s := range sessions {
+		if now.After(s.expires) {
+			delete(sessions, id)
+		}
+	}
+
+	id := randomToken()
+	s := &session{username: username, csrfToken: randomToken(), expires: now.Add(sessionTTL)}
+	sessions[id] = s
+	return id, s
+}
+
+func lookupSession(r *http.Request) (string, *session) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return "", nil
+	}
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	s, ok := sessions[cookie.Value]
+	if !ok {
+		return "", nil
+	}
+	if time.Now().After(s.expires) {
+		delete(sessions, cookie.Value)
+		return "", nil
+	}
+	return cookie.Value, s
+}
+
+func deleteSession(id string) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	delete(sessions, id)
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic("failed to read random bytes for session: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
+func setSessionCookie(w http.ResponseWriter, r *http.Request, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// requireRole only lets signed-in users with at least the given role through;
+// others are sent to the login page (GET) or refused. POST requests must also
+// carry the session's CSRF token.
+func requireRole(role string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, s := lookupSession(r)
+		var user *users.User
+		if s != nil {
+			// Reload the user so removed users and role changes take effect immediately
+			user, _ = users.Get(s.username)
+		}
+		if user == nil {
+			if r.Method == http.MethodGet {
+				http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+				return
+			}
+			http.Error(w, "Sign in required", http.StatusUnauthorized)
+			return
+		}
+		if !user.Allows(role) {
+			http.Error(w, "Forbidden: this requires the "+role+" role", http.StatusForbidden)
+			return
+		}
+		if r.Method == http.MethodPost && !validCSRFToken(r, s) {
+			log.Printf("Rejected POST %s by %s: missing or invalid CSRF token", r.URL.Path, user.Username)
+			http.Error(w, "Invalid or missing CSRF token; reload the page and try again", http.StatusForbidden)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), userContextKey, &signedInUser{user: user, session: s})))
+	}
+}
+
+func validCSRFToken(r *http.Request, s *session) bool {
+	token := r.PostFormValue(csrfFieldName)
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.csrfToken)) == 1
+}
+
+// signedIn returns the signed-in user of a request that passed requireRole.
+func signedIn(r *http.Request) *signedInUser {
+	v, _ := r.Context().Value(userContextKey).(*signedInUser)
+	return v
+}
+
+// authorize checks a stricter role than the route's within a handler, for
+// routes that mix read and write actions.
+func authorize(w http.ResponseWriter, r *http.Request, role string) bool {
+	if v := signedIn(r); v != nil && v.user.Allows(role) {
+		return true
+	}
+	http.Error(w, "Forbidden: this requires the "+role+" role", http.StatusForbidden)
+	return false
+}
+
+// render executes a dashboard template with the session helpers bound to the
+// signed-in user: csrfToken, currentUser, currentRole and `can "<role>"`.
+func render(w http.ResponseWriter, r *http.Request, name string, data any) {
+	v := signedIn(r)
+	tmpl, err := templates.Clone()
+	if err != nil {
+		log.Printf("Error cloning templates: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	tmpl.Funcs(template.FuncMap{
+		"csrfToken": func() string {
+			if v == nil {
+				return ""
+			}
+			return v.session.csrfToken
+		},
+		"currentUser": func() string {
+			if v == nil {
+				return ""
+			}
+			return v.user.Username
+		},
+		"currentRole": func() string {
+			if v == nil {
+				return ""
+			}
+			return v.user.Role
+		},
+		"can": func(role string) bool { return v != nil && v.user.Allows(role) },
+	})
+	if err := tmpl.ExecuteTemplate(w, name, data); err != nil {
+		log.Printf("Error executing template: %v", err)
+	}
+}
+
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	next := r.FormValue("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		next = "/" // Only redirect within the dashboard
+	}
+	data := struct {
+		Next    string
+		Error   string
+		NoUsers bool
+	}{Next: next}
+
+	if r.Method == http.MethodPost {
+		username := strings.TrimSpace(r.FormValue("username"))
+		user, err := users.Authenticate(username, r.FormValue("password"))
+		if err == nil {
+			id, _ := newSession(user.Username)
+			setSessionCookie(w, r, id, int(sessionTTL.Seconds()))
+			log.Printf("User %s signed in to the Web UI", user.Username)
+			http.Redirect(w, r, next, http.StatusSeeOther)
+			return
+		}
+		log.Printf("Failed Web UI sign-in for '%s' from %s: %v", username, r.RemoteAddr, err)
+		data.Error = "Invalid username or password."
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+
+	if all, err := users.List(); err == nil && len(all) == 0 {
+		data.NoUsers = true
+	}
+	render(w, r, "login.html", data)
+}
+
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, s := lookupSession(r)
+	if s != nil {
+		if !validCSRFToken(r, s) {
+			http.Error(w, "Invalid or missing CSRF token; reload the page and try again", http.StatusForbidden)
+			return
+		}
+		deleteSession(id)
+		log.Printf("User %s signed out of the Web UI", s.username)
+	}
+	setSessionCookie(w, r, "", -1)
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
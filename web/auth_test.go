@@ -0,0 +1,230 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"snap-ci/users"
+)
+
+const testPassword = "correct horse battery"
+
+// useUsers stores dashboard users in a temporary file and adds one user per role.
+func useUsers(t *testing.T) {
+	t.Helper()
+	users.File.Configure(filepath.Join(t.TempDir(), "users.json"))
+	t.Cleanup(func() { users.File.Configure("") })
+	for _, role := range []string{users.RoleViewer, users.RoleOperator, users.RoleAdmin} {
+		if err := users.Add(role, testPassword, role); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// signIn opens a session for username and returns its cookie and CSRF token.
+func signIn(t *testing.T, username string) (*http.Cookie, string) {
+	t.Helper()
+	form := url.Values{"username": {username}, "password": {testPassword}}
+	rec := httptest.NewRecorder()
+	loginHandler(rec, requestWith(http.MethodPost, "/login", nil, form))
+
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("sign-in of %s: status = %d (%s)", username, rec.Code, rec.Body)
+	}
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == sessionCookieName {
+			_, s := lookupSession(requestWith(http.MethodGet, "/", cookie, nil))
+			if s == nil {
+				t.Fatal("the session cookie names no session")
+			}
+			return cookie, s.csrfToken
+		}
+	}
+	t.Fatalf("sign-in of %s set no session cookie", username)
+	return nil, ""
+}
+
+func requestWith(method, target string, cookie *http.Cookie, form url.Values) *http.Request {
+	body := ""
+	if form != nil {
+		body = form.Encode()
+	}
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	return req
+}
+
+func TestLogin(t *testing.T) {
+	useUsers(t)
+
+	tests := []struct {
+		name         string
+		username     string
+		password     string
+		next         string
+		wantStatus   int
+		wantLocation string
+	}{
+		{"valid", "viewer", testPassword, "/runs/abc", http.StatusSeeOther, "/runs/abc"},
+		{"wrong password", "viewer", "wrong password!", "/", http.StatusUnauthorized, ""},
+		{"unknown user", "nobody", testPassword, "/", http.StatusUnauthorized, ""},
+		{"absolute next", "viewer", testPassword, "https://evil.example/", http.StatusSeeOther, "/"},
+		{"protocol-relative next", "viewer", testPassword, "//evil.example/", http.StatusSeeOther, "/"},
+		{"backslash next", "viewer", testPassword, "/\\evil.example/", http.StatusSeeOther, "/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{"username": {tt.username}, "password": {tt.password}, "next": {tt.next}}
+			rec := httptest.NewRecorder()
+			loginHandler(rec, requestWith(http.MethodPost, "/login", nil, form))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if location := rec.Header().Get("Location"); location != tt.wantLocation {
+				t.Errorf("Location = %q, want %q", location, tt.wantLocation)
+			}
+			var cookie *http.Cookie
+			for _, c := range rec.Result().Cookies() {
+				if c.Name == sessionCookieName {
+					cookie = c
+				}
+			}
+			if (cookie != nil) != (tt.wantStatus == http.StatusSeeOther) {
+				t.Fatalf("session cookie = %v", cookie)
+			}
+			if cookie != nil && (!cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode) {
+				t.Errorf("session cookie %+v is not HttpOnly and SameSite=Lax", cookie)
+			}
+		})
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	useUsers(t)
+	viewer, viewerCSRF := signIn(t, "viewer")
+	operator, operatorCSRF := signIn(t, "operator")
+	admin, adminCSRF := signIn(t, "admin")
+	stale := &http.Cookie{Name: sessionCookieName, Value: randomToken()}
+
+	tests := []struct {
+		name       string
+		method     string
+		cookie     *http.Cookie
+		csrf       string
+		role       string
+		wantStatus int
+	}{
+		{"signed out GET", http.MethodGet, nil, "", users.RoleViewer, http.StatusSeeOther},
+		{"signed out POST", http.MethodPost, nil, "", users.RoleViewer, http.StatusUnauthorized},
+		{"unknown session", http.MethodGet, stale, "", users.RoleViewer, http.StatusSeeOther},
+		{"viewer reads", http.MethodGet, viewer, "", users.RoleViewer, http.StatusOK},
+		{"viewer posts", http.MethodPost, viewer, viewerCSRF, users.RoleViewer, http.StatusOK},
+		{"viewer on an operator route", http.MethodPost, viewer, viewerCSRF, users.RoleOperator, http.StatusForbidden},
+		{"operator on an operator route", http.MethodPost, operator, operatorCSRF, users.RoleOperator, http.StatusOK},
+		{"operator on an admin route", http.MethodGet, operator, "", users.RoleAdmin, http.StatusForbidden},
+		{"admin on an admin route", http.MethodPost, admin, adminCSRF, users.RoleAdmin, http.StatusOK},
+		{"POST without CSRF token", http.MethodPost, admin, "", users.RoleAdmin, http.StatusForbidden},
+		{"POST with another session's CSRF token", http.MethodPost, admin, viewerCSRF, users.RoleAdmin, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			handler := requireRole(tt.role, func(w http.ResponseWriter, r *http.Request) {
+				called = true
+				if signedIn(r) == nil {
+					t.Error("the handler ran without a signed-in user")
+				}
+			})
+			var form url.Values
+			if tt.method == http.MethodPost {
+				form = url.Values{}
+				if tt.csrf != "" {
+					form.Set(csrfFieldName, tt.csrf)
+				}
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, requestWith(tt.method, "/runs/abc?x=1", tt.cookie, form))
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if called != (tt.wantStatus == http.StatusOK) {
+				t.Errorf("handler called = %v", called)
+			}
+			if tt.wantStatus == http.StatusSeeOther {
+				if location := rec.Header().Get("Location"); location != "/login?next="+url.QueryEscape("/runs/abc?x=1") {
+					t.Errorf("Location = %q", location)
+				}
+			}
+		})
+	}
+}
+
+func TestRoleChangesTakeEffectImmediately(t *testing.T) {
+	useUsers(t)
+	cookie, _ := signIn(t, "operator")
+	handler := requireRole(users.RoleViewer, func(w http.ResponseWriter, r *http.Request) {})
+
+	if err := users.Remove("operator"); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	handler(rec, requestWith(http.MethodGet, "/", cookie, nil))
+	if rec.Code != http.StatusSeeOther {
+		t.Errorf("status for a removed user = %d, want a redirect to the login page", rec.Code)
+	}
+}
+
+func TestExpiredSession(t *testing.T) {
+	useUsers(t)
+	cookie, _ := signIn(t, "viewer")
+	sessionsMu.Lock()
+	sessions[cookie.Value].expires = time.Now().Add(-time.Second)
+	sessionsMu.Unlock()
+
+	rec := httptest.NewRecorder()
+	requireRole(users.RoleViewer, func(w http.ResponseWriter, r *http.Request) {})(rec, requestWith(http.MethodGet, "/", cookie, nil))
+	if rec.Code != http.StatusSeeOther {
+		t.Errorf("status = %d, want a redirect to the login page", rec.Code)
+	}
+	if _, s := lookupSession(requestWith(http.MethodGet, "/", cookie, nil)); s != nil {
+		t.Error("the expired session is still known")
+	}
+}
+
+func TestLogout(t *testing.T) {
+	useUsers(t)
+	cookie, csrf := signIn(t, "viewer")
+
+	rec := httptest.NewRecorder()
+	logoutHandler(rec, requestWith(http.MethodGet, "/logout", cookie, nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /logout: status = %d, want 405", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	logoutHandler(rec, requestWith(http.MethodPost, "/logout", cookie, url.Values{}))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("POST /logout without CSRF token: status = %d, want 403", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	logoutHandler(rec, requestWith(http.MethodPost, "/logout", cookie, url.Values{csrfFieldName: {csrf}}))
+	if rec.Code != http.StatusSeeOther {
+		t.Errorf("POST /logout: status = %d, want 303", rec.Code)
+	}
+	if _, s := lookupSession(requestWith(http.MethodGet, "/", cookie, nil)); s != nil {
+		t.Error("the session survived signing out")
+	}
+}
@@ -0,0 +1,81 @@
+package web
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"snap-ci/storage"
+)
+
+// logPollInterval is how often the run log is checked for new lines.
+const logPollInterval = 500 * time.Millisecond
+
+// logStreamHandler streams a run's log as Server-Sent Events. Each log line is
+// sent as one `data:` message; the event ID is the byte offset after it, so a
+// reconnecting EventSource resumes where it left off via Last-Event-ID.
+// An `end` event is sent once the run has finished and its log is drained.
+func logStreamHandler(w http.ResponseWriter, r *http.Request, runID string) {
+	if _, err := storage.GetRun(runID); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	var offset int64
+	if lastID := r.Header.Get("Last-Event-ID"); lastID != "" {
+		if parsed, err := strconv.ParseInt(lastID, 10, 64); err == nil && parsed >= 0 {
+			offset = parsed
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(logPollInterval)
+	defer ticker.Stop()
+
+	for {
+		// Check the status before reading so no line written before the run finished is missed
+		run, err := storage.GetRun(runID)
+		finished := err == nil && run.Finished()
+
+		data, next, err := storage.ReadRunLog(runID, offset)
+		if err != nil {
+			log.Printf("Error reading log of run %s: %v", runID, err)
+			return
+		}
+
+		if len(data) > 0 {
+			for _, line := range bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n")) {
+				offset += int64(len(line)) + 1
+				fmt.Fprintf(w, "id: %d\ndata: %s\n\n", offset, line)
+			}
+			offset = next
+			flusher.Flush()
+		}
+
+		if finished && len(data) == 0 {
+			fmt.Fprintf(w, "event: end\ndata: %s\n\n", run.Status)
+			flusher.Flush()
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
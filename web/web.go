@@ -9,12 +9,29 @@ import (
 	"log"
 	"net/http"
 	"snap-ci/git"
+	"snap-ci/secrets"
 	"snap-ci/storage"
+	"snap-ci/types"
+	"snap-ci/users"
 	"strings"
+	"time"
 )
 
 var funcMap = template.FuncMap{
-	"lower": strings.ToLower,
+	"lower":    strings.ToLower,
+	"duration": formatDuration,
+	"inc":      func(i int) int { return i + 1 },
+
+	// Bound to the signed-in user by render
+	"csrfToken":   func() string { return "" },
+	"currentUser": func() string { return "" },
+	"currentRole": func() string { return "" },
+	"can":         func(role string) bool { return false },
+}
+
+// formatDuration rounds a job or step duration for display, e.g. "1.234s".
+func formatDuration(d time.Duration) string {
+	return d.Round(time.Millisecond).String()
 }
 
 //go:embed templates/*.html
@@ -41,15 +58,29 @@ func runHistoryHandler(w http.ResponseWriter, r *http.Request) {
 	// }
 
 	// <--- FIX 2: Use ExecuteTemplate to specify which template from the collection to execute
-	if err := templates.ExecuteTemplate(w, "run_history.html", runs); err != nil {
-		log.Printf("Error executing template: %v", err)
-	}
+	render(w, r, "run_history.html", runs)
 }
 
 func runDetailsHandler(w http.ResponseWriter, r *http.Request) {
 	runIDStr := r.URL.Path[len("/runs/"):] // Extract run ID from path
 	runID := runIDStr                      // Assuming run ID is a string
 
+	// /runs/{id}/logs/stream tails the run's log live
+	if id, ok := strings.CutSuffix(runIDStr, "/logs/stream"); ok {
+		logStreamHandler(w, r, id)
+		return
+	}
+	// POST /runs/{id}/cancel asks the run's worker to stop it
+	if id, ok := strings.CutSuffix(runIDStr, "/cancel"); ok {
+		cancelRunHandler(w, r, id)
+		return
+	}
+	// POST /runs/{id}/rerun queues a new run of the same commit
+	if id, ok := strings.CutSuffix(runIDStr, "/rerun"); ok {
+		rerunHandler(w, r, id)
+		return
+	}
+
 	run, err := storage.GetRun(runID)
 	if err != nil {
 		log.Printf("Error fetching run %s: %v", runID, err)
@@ -66,9 +97,49 @@ func runDetailsHandler(w http.ResponseWriter, r *http.Request) {
 	// }
 
 	// <--- FIX 3: Use ExecuteTemplate to specify which template from the collection to execute
-	if err := templates.ExecuteTemplate(w, "run_details.html", run); err != nil {
-		log.Printf("Error executing template: %v", err)
+	render(w, r, "run_details.html", run)
+}
+
+func cancelRunHandler(w http.ResponseWriter, r *http.Request, runID string) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !authorize(w, r, users.RoleOperator) {
+		return
+	}
+
+	username := signedIn(r).user.Username
+	if err := storage.RequestCancel(runID, username); err != nil {
+		log.Printf("Error cancelling run %s via Web UI: %v", runID, err)
+		http.Error(w, fmt.Sprintf("Failed to cancel run: %v", err), http.StatusConflict)
+		return
 	}
+	log.Printf("Cancellation of run %s requested by %s via Web UI.", runID, username)
+	http.Redirect(w, r, "/runs/"+runID, http.StatusSeeOther)
+}
+
+func rerunHandler(w http.ResponseWriter, r *http.Request, runID string) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorize(w, r, users.RoleOperator) {
+		return
+	}
+
+	username := signedIn(r).user.Username
+	run, err := git.Rerun(runID, username)
+	if err != nil {
+		log.Printf("Error rerunning run %s via Web UI: %v", runID, err)
+		http.Error(w, fmt.Sprintf("Failed to rerun: %v", err), http.StatusConflict)
+		return
+	}
+	log.Printf("Run %s queued as a rerun of %s by %s via Web UI.", run.ID, runID, username)
+	http.Redirect(w, r, "/runs/"+run.ID, http.StatusSeeOther)
 }
 
 func setupWebhookHandler(w http.ResponseWriter, r *http.Request) {
@@ -95,9 +166,7 @@ func setupWebhookHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	if err := templates.ExecuteTemplate(w, "setup_webhook.html", data); err != nil {
-		log.Printf("Error executing template: %v", err)
-	}
+	render(w, r, "setup_webhook.html", data)
 }
 
 func addAuthHandler(w http.ResponseWriter, r *http.Request) {
@@ -108,13 +177,17 @@ func addAuthHandler(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method == http.MethodPost {
 		repo := r.FormValue("repo")
-		token := r.FormValue("token") // This is the PAT
+		provider := r.FormValue("provider")
+		token := r.FormValue("token") // The provider's access token, e.g. a GitHub PAT
+		if provider == "" {
+			provider = types.ProviderGitHub
+		}
 
 		if repo == "" || token == "" {
 			data.Error = "Repository and Token are required."
 		} else {
 			log.Printf("Storing authentication for %s via Web UI...", repo)
-			if err := storage.StoreRepoAuth(repo, token); err != nil {
+			if err := storage.StoreRepoAuth(repo, provider, token); err != nil {
 				data.Error = fmt.Sprintf("Failed to store authentication data: %v", err)
 				log.Printf("Error storing authentication via Web UI for %s: %v", repo, err)
 			} else {
@@ -124,16 +197,65 @@ func addAuthHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	if err := templates.ExecuteTemplate(w, "add_auth.html", data); err != nil {
-		log.Printf("Error executing template: %v", err)
+	render(w, r, "add_auth.html", data)
+}
+
+func secretsHandler(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		Repo    string
+		Secrets []secrets.Info
+		Message string
+		Error   string
+	}{
+		Repo: strings.TrimSpace(r.FormValue("repo")),
+	}
+
+	if r.Method == http.MethodPost {
+		name := r.FormValue("name")
+		switch r.FormValue("action") {
+		case "set":
+			value := strings.ReplaceAll(r.FormValue("value"), "\r\n", "\n") // Browsers submit CRLF line endings
+			if data.Repo == "" || name == "" || value == "" {
+				data.Error = "Repository, name and value are required."
+			} else if err := secrets.Set(data.Repo, name, value); err != nil {
+				data.Error = fmt.Sprintf("Failed to store secret: %v", err)
+				log.Printf("Error storing secret %s for %s via Web UI: %v", name, data.Repo, err)
+			} else {
+				data.Message = fmt.Sprintf("Secret %s stored for %s.", name, data.Repo)
+				log.Printf("Secret %s stored for %s via Web UI.", name, data.Repo)
+			}
+		case "delete":
+			if err := secrets.Remove(data.Repo, name); err != nil {
+				data.Error = fmt.Sprintf("Failed to remove secret: %v", err)
+			} else {
+				data.Message = fmt.Sprintf("Secret %s removed from %s.", name, data.Repo)
+				log.Printf("Secret %s removed from %s via Web UI.", name, data.Repo)
+			}
+		default:
+			data.Error = "Unknown action."
+		}
+	}
+
+	if data.Repo != "" {
+		infos, err := secrets.List(data.Repo)
+		if err != nil {
+			data.Error = fmt.Sprintf("Failed to list secrets: %v", err)
+		}
+		data.Secrets = infos
 	}
+
+	render(w, r, "secrets.html", data)
 }
 
 func StartWebServer() error {
-	http.HandleFunc("/", runHistoryHandler)
-	http.HandleFunc("/runs/", runDetailsHandler)
-	http.HandleFunc("/setup-webhook", setupWebhookHandler)
-	http.HandleFunc("/add-auth", addAuthHandler)
+	http.HandleFunc("/login", loginHandler)
+	http.HandleFunc("/logout", logoutHandler)
+	http.HandleFunc("/", requireRole(users.RoleViewer, runHistoryHandler))
+	http.HandleFunc("/runs/", requireRole(users.RoleViewer, runDetailsHandler)) // Cancel and rerun check for operator
+	http.HandleFunc("/setup-webhook", requireRole(users.RoleAdmin, setupWebhookHandler))
+	http.HandleFunc("/add-auth", requireRole(users.RoleAdmin, addAuthHandler))
+	http.HandleFunc("/secrets", requireRole(users.RoleAdmin, secretsHandler))
+	registerAPI()
 
 	port := ":8081" // Use a consistent port for the web UI
 	fmt.Printf("Web dashboard listening on http://localhost%s...\n", port)
@@ -0,0 +1,196 @@
+// workspace/workspace.go
+
+package workspace
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"snap-ci/storage"
+)
+
+const (
+	// DefaultRoot is the directory under which per-run workspaces are created.
+	DefaultRoot = "workspaces"
+)
+
+// Cleanup modes for finished workspaces
+const (
+	CleanupOnSuccess = "on-success" // Delete after successful runs, keep failed ones for debugging
+	CleanupAlways    = "always"     // Delete after every run
+	CleanupNever     = "never"      // Keep every workspace
+)
+
+// Policy decides what happens to a run's workspace once the run has finished.
+type Policy struct {
+	Cleanup  string // One of the Cleanup* modes
+	KeepLast int    // Keep at most this many finished workspaces on disk, 0 = no limit
+}
+
+var (
+	mu     sync.Mutex
+	root   = DefaultRoot
+	policy = Policy{Cleanup: CleanupOnSuccess}
+	active = make(map[string]func()) // Run ID -> releases the lock of its workspace
+)
+
+// lockSuffix names the lock file next to each workspace in use, e.g.
+// workspaces/<run-id>.lock. Every process sharing the workspace root, such
+// as `snapci webhooks` and `snapci watch start`, holds the lock of the
+// workspaces it runs in, so that no process prunes them. Run IDs are never
+// reused, so a lock file can be removed together with its workspace.
+const lockSuffix = ".lock"
+
+// Configure sets the workspace root directory and the cleanup policy.
+func Configure(rootDir string, p Policy) error {
+	switch p.Cleanup {
+	case CleanupOnSuccess, CleanupAlways, CleanupNever:
+	default:
+		return fmt.Errorf("invalid workspace cleanup mode '%s' (expected %s, %s or %s)",
+			p.Cleanup, CleanupOnSuccess, CleanupAlways, CleanupNever)
+	}
+	if p.KeepLast < 0 {
+		return fmt.Errorf("keep-last must not be negative, got %d", p.KeepLast)
+	}
+	if rootDir == "" {
+		rootDir = DefaultRoot
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	root = rootDir
+	policy = p
+	return nil
+}
+
+// Path returns the workspace directory of a run.
+func Path(runID string) string {
+	mu.Lock()
+	defer mu.Unlock()
+	return filepath.Join(root, runID)
+}
+
+// Create prepares an empty workspace directory for a run and returns its
+// absolute path. The workspace stays locked until Cleanup.
+func Create(runID string) (string, error) {
+	dir, err := filepath.Abs(Path(runID))
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve workspace path for run %s: %w", runID, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return "", fmt.Errorf("failed to create workspace root: %w", err)
+	}
+	unlock, err := storage.TryLockFile(dir + lockSuffix)
+	if err != nil {
+		return "", fmt.Errorf("failed to lock workspace %s: %w", dir, err)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		unlock()
+		return "", fmt.Errorf("failed to remove stale workspace %s: %w", dir, err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		unlock()
+		return "", fmt.Errorf("failed to create workspace %s: %w", dir, err)
+	}
+
+	mu.Lock()
+	active[runID] = unlock
+	mu.Unlock()
+
+	log.Printf("Created workspace for run %s: %s", runID, dir)
+	return dir, nil
+}
+
+// Cleanup applies the cleanup policy to a finished run's workspace and prunes
+// older workspaces beyond the KeepLast limit. Errors are logged, not returned,
+// since a leftover workspace must never fail a run.
+func Cleanup(runID string, succeeded bool) {
+	mu.Lock()
+	unlock := active[runID]
+	delete(active, runID)
+	p := policy
+	mu.Unlock()
+
+	dir := Path(runID)
+	remove := p.Cleanup == CleanupAlways || (p.Cleanup == CleanupOnSuccess && succeeded)
+	if remove {
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("Warning: Failed to remove workspace %s: %v", dir, err)
+		} else {
+			log.Printf("Removed workspace for run %s", runID)
+		}
+	} else {
+		log.Printf("Keeping workspace for run %s at %s", runID, dir)
+	}
+	if unlock != nil {
+		os.Remove(dir + lockSuffix)
+		unlock()
+	}
+
+	if p.KeepLast > 0 {
+		prune(p.KeepLast)
+	}
+}
+
+// prune removes the oldest finished workspaces until at most keep remain.
+// Workspaces of runs that are still in progress, in this process or any
+// other, are locked and never removed.
+func prune(keep int) {
+	mu.Lock()
+	rootDir := root
+	mu.Unlock()
+
+	entries, err := os.ReadDir(rootDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: Failed to read workspace root %s: %v", rootDir, err)
+		}
+		return
+	}
+
+	type finished struct {
+		name    string
+		modTime int64
+	}
+	var candidates []finished
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		candidates = append(candidates, finished{name: entry.Name(), modTime: info.ModTime().UnixNano()})
+	}
+	if len(candidates) <= keep {
+		return
+	}
+
+	// Newest first, everything past `keep` goes
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].modTime > candidates[j].modTime
+	})
+	for _, c := range candidates[keep:] {
+		dir := filepath.Join(rootDir, c.name)
+		unlock, err := storage.TryLockFile(dir + lockSuffix)
+		if err != nil {
+			if !errors.Is(err, storage.ErrLocked) {
+				log.Printf("Warning: Not pruning workspace %s: %v", dir, err)
+			}
+			continue // In use
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("Warning: Failed to prune workspace %s: %v", dir, err)
+		} else {
+			log.Printf("Pruned old workspace %s", dir)
+		}
+		os.Remove(dir + lockSuffix)
+		unlock()
+	}
+}
@@ -0,0 +1,100 @@
+package workspace
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"snap-ci/storage"
+)
+
+func useRoot(t *testing.T, p Policy) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := Configure(dir, p); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { Configure("", Policy{Cleanup: CleanupOnSuccess}) })
+	return dir
+}
+
+// makeOld creates a finished workspace whose modification time lies age in the past.
+func makeOld(t *testing.T, root, runID string, age time.Duration) {
+	t.Helper()
+	dir := filepath.Join(root, runID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-age)
+	if err := os.Chtimes(dir, old, old); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestCreateAndCleanup(t *testing.T) {
+	root := useRoot(t, Policy{Cleanup: CleanupOnSuccess})
+
+	dir, err := Create("run1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !filepath.IsAbs(dir) || !exists(dir) {
+		t.Fatalf("Create() = %s, want an existing absolute path", dir)
+	}
+	if _, err := storage.TryLockFile(filepath.Join(root, "run1"+lockSuffix)); err != storage.ErrLocked {
+		t.Errorf("the workspace of a running run is not locked: %v", err)
+	}
+
+	Cleanup("run1", false)
+	if !exists(dir) {
+		t.Error("the workspace of a failed run was removed with cleanup on-success")
+	}
+	if exists(filepath.Join(root, "run1"+lockSuffix)) {
+		t.Error("the lock file outlived the run")
+	}
+
+	if _, err := Create("run2"); err != nil {
+		t.Fatal(err)
+	}
+	Cleanup("run2", true)
+	if exists(filepath.Join(root, "run2")) {
+		t.Error("the workspace of a successful run was kept with cleanup on-success")
+	}
+}
+
+func TestPruneSkipsLockedWorkspaces(t *testing.T) {
+	root := useRoot(t, Policy{Cleanup: CleanupNever, KeepLast: 1})
+
+	makeOld(t, root, "finished-old", 3*time.Hour)
+	makeOld(t, root, "finished-new", 2*time.Hour)
+	// Running in another process, which holds its lock
+	makeOld(t, root, "running-elsewhere", 4*time.Hour)
+	unlock, err := storage.LockFile(filepath.Join(root, "running-elsewhere"+lockSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+
+	if _, err := Create("current"); err != nil {
+		t.Fatal(err)
+	}
+	Cleanup("current", true)
+
+	if !exists(filepath.Join(root, "current")) {
+		t.Error("the newest workspace was pruned")
+	}
+	if !exists(filepath.Join(root, "running-elsewhere")) {
+		t.Error("a workspace locked by another process was pruned")
+	}
+	for _, runID := range []string{"finished-old", "finished-new"} {
+		if exists(filepath.Join(root, runID)) {
+			t.Errorf("the finished workspace %s was not pruned", runID)
+		}
+	}
+}